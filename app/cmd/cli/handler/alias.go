@@ -0,0 +1,80 @@
+package cli
+
+import (
+	log "keeper/internal/logger"
+
+	"github.com/urfave/cli/v2"
+)
+
+func (h *Handler) setAlias(c *cli.Context) error {
+	alias, model := c.Args().Get(0), c.Args().Get(1)
+	if alias == "" || model == "" {
+		return log.Errorf("alias and model are required")
+	}
+
+	profile, err := h.targetProfile(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.keeper.SetModelAlias(c.Context, profile, alias, model); err != nil {
+		return log.Errorf("error setting alias: %w", err)
+	}
+
+	log.Infof("%s -> %s set for profile %s", alias, model, profile)
+
+	return nil
+}
+
+func (h *Handler) removeAlias(c *cli.Context) error {
+	alias := c.Args().First()
+	if alias == "" {
+		return log.Errorf("alias is required")
+	}
+
+	profile, err := h.targetProfile(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.keeper.DeleteModelAlias(c.Context, profile, alias); err != nil {
+		return log.Errorf("error removing alias: %w", err)
+	}
+
+	log.Infof("%s removed from profile %s", alias, profile)
+
+	return nil
+}
+
+func (h *Handler) listAliases(c *cli.Context) error {
+	aliases, err := h.keeper.ListModelAliases(c.Context)
+	if err != nil {
+		return log.Errorf("error listing aliases: %w", err)
+	}
+
+	profile := c.String("profile")
+
+	for _, a := range aliases {
+		if profile != "" && a.ProfileName != profile {
+			continue
+		}
+
+		log.Infof("%s: %s -> %s", a.ProfileName, a.Alias, a.Model)
+	}
+
+	return nil
+}
+
+// targetProfile is the profile named by --profile, or the active one
+func (h *Handler) targetProfile(c *cli.Context) (string, error) {
+	if profile := c.String("profile"); profile != "" {
+		return profile, nil
+	}
+
+	profile, err := h.keeper.GetActiveProfile(c.Context)
+	if err != nil {
+		return "", log.Errorf("error getting active profile: %w", err)
+	}
+
+	return profile.Name, nil
+}
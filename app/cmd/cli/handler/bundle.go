@@ -0,0 +1,268 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "keeper/internal/logger"
+	"keeper/services/bundle"
+	"keeper/services/keeper"
+
+	"filippo.io/age"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+func passphraseFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "passphrase-file",
+			Usage: "Read the passphrase from this file instead of prompting",
+		},
+		&cli.StringFlag{
+			Name:  "passphrase-env",
+			Usage: "Read the passphrase from this environment variable",
+		},
+	}
+}
+
+// exportBundle writes profiles, provider overrides and optionally keys to a
+// bundle teammates can import
+func (h *Handler) exportBundle(c *cli.Context) error {
+	out := c.String("out")
+	if out == "" {
+		return log.Errorf("--out is required, e.g. keeper export --out team.keeper --encrypt")
+	}
+
+	// the bundle goes to stdout, logs must not end up in it
+	if out == "-" {
+		log.UseStderr()
+	}
+
+	recipients := c.StringSlice("recipient")
+	for _, path := range c.StringSlice("recipients-file") {
+		r, err := bundle.ParseRecipientsFile(path)
+		if err != nil {
+			return log.Errorf("error reading recipients: %v", err)
+		}
+		recipients = append(recipients, r...)
+	}
+
+	encrypt := c.Bool("encrypt") || len(recipients) > 0
+	if c.Bool("with-keys") && !encrypt {
+		return log.Errorf("keys are only exported encrypted, add --encrypt or --recipient")
+	}
+
+	enc := bundle.Encryption{Recipients: recipients}
+	if encrypt && len(recipients) == 0 {
+		passphrase, err := readPassphrase(c, true)
+		if err != nil {
+			return log.Errorf("error reading passphrase: %v", err)
+		}
+		enc.Passphrase = passphrase
+	}
+
+	b, err := h.keeper.Export(c.Context, c.Bool("with-keys"))
+	if err != nil {
+		return log.Errorf("error exporting: %w", err)
+	}
+
+	w := os.Stdout
+	if out != "-" {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if c.Bool("force") {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+
+		// the bundle may hold keys, only the current user may read it
+		f, err := os.OpenFile(out, flags, 0o600)
+		if err != nil {
+			if os.IsExist(err) {
+				return log.Errorf("%s already exists, use --force to replace it", out)
+			}
+			return log.Errorf("error creating %s: %v", out, err)
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	if err := bundle.Write(w, b, enc); err != nil {
+		return log.Errorf("error writing bundle: %v", err)
+	}
+
+	if w != os.Stdout {
+		if err := w.Close(); err != nil {
+			return log.Errorf("error writing bundle: %v", err)
+		}
+	}
+
+	how := "unencrypted"
+	switch {
+	case len(recipients) > 0:
+		how = fmt.Sprintf("encrypted to %d recipients", len(recipients))
+	case encrypt:
+		how = "encrypted with a passphrase"
+	}
+
+	// stdout carries the bundle
+	if out != "-" {
+		log.Infof("exported %d profiles, %d providers and %d keys to %s, %s", len(b.Profiles), len(b.Providers), len(b.Keys), out, how)
+	}
+
+	return nil
+}
+
+// importBundle adds the profiles, provider overrides and keys of a bundle
+func (h *Handler) importBundle(c *cli.Context) error {
+	args, err := commandArgs(c)
+	if err != nil {
+		return log.Errorf("%v", err)
+	}
+
+	if len(args) != 1 {
+		return log.Errorf("expected exactly one bundle, e.g. keeper import team.keeper")
+	}
+
+	onConflict := keeper.ConflictStrategy(c.String("on-conflict"))
+	if !onConflict.Valid() {
+		return log.Errorf("unknown --on-conflict %q, expected skip, overwrite or rename", onConflict)
+	}
+
+	var identities []age.Identity
+	for _, path := range c.StringSlice("identity") {
+		ids, err := bundle.ParseIdentityFile(path)
+		if err != nil {
+			return log.Errorf("error reading identity: %v", err)
+		}
+		identities = append(identities, ids...)
+	}
+
+	var r io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return log.Errorf("error opening bundle: %v", err)
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	b, err := bundle.Read(r, bundle.Decryption{
+		Identities: identities,
+		Passphrase: func() (string, error) { return readPassphrase(c, false) },
+	})
+	if err != nil {
+		return log.Errorf("error reading bundle: %v", err)
+	}
+
+	changes, err := h.keeper.Import(c.Context, b, keeper.ImportOptions{
+		OnConflict:      onConflict,
+		DryRun:          c.Bool("dry-run"),
+		AllowReferences: c.Bool("allow-references"),
+	})
+	if err != nil {
+		return log.Errorf("error importing bundle: %w", err)
+	}
+
+	if len(changes) == 0 {
+		log.Infof("nothing to import, the setup already matches the bundle")
+		return nil
+	}
+
+	for _, ch := range changes {
+		if ch.Detail != "" {
+			log.Infof("%s %s: %s (%s)", ch.Kind, ch.Name, ch.Action, ch.Detail)
+			continue
+		}
+
+		log.Infof("%s %s: %s", ch.Kind, ch.Name, ch.Action)
+	}
+
+	// references are resolved on this machine, whoever wrote the bundle
+	// chose what they run or read
+	var references []keeper.ImportChange
+	for _, ch := range changes {
+		if ch.Reference != "" {
+			references = append(references, ch)
+		}
+	}
+
+	if len(references) > 0 {
+		log.Infof("keys stored as references, resolved on this machine whenever they are used:")
+		for _, ch := range references {
+			log.Infof("  %s: %s", ch.Name, ch.Reference)
+		}
+	}
+
+	if c.Bool("dry-run") {
+		log.Infof("dry run, nothing was changed")
+	}
+
+	return nil
+}
+
+// readPassphrase reads the bundle passphrase from the source chosen by the
+// flags, the terminal when none is, asking twice when confirm is set
+func readPassphrase(c *cli.Context, confirm bool) (string, error) {
+	var passphrase string
+
+	switch {
+	case c.String("passphrase-file") != "" && c.String("passphrase-env") != "":
+		return "", fmt.Errorf("only one of --passphrase-file and --passphrase-env can be used")
+
+	case c.String("passphrase-file") != "":
+		data, err := os.ReadFile(c.String("passphrase-file"))
+		if err != nil {
+			return "", err
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+
+	case c.String("passphrase-env") != "":
+		value, ok := os.LookupEnv(c.String("passphrase-env"))
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", c.String("passphrase-env"))
+		}
+		passphrase = value
+
+	default:
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return "", fmt.Errorf("stdin is not a terminal, pass the passphrase with --passphrase-file or --passphrase-env")
+		}
+
+		var err error
+		if passphrase, err = promptPassword("Passphrase: "); err != nil {
+			return "", err
+		}
+
+		if confirm {
+			again, err := promptPassword("Confirm passphrase: ")
+			if err != nil {
+				return "", err
+			}
+
+			if again != passphrase {
+				return "", fmt.Errorf("the passphrases do not match")
+			}
+		}
+	}
+
+	if passphrase == "" {
+		return "", fmt.Errorf("the passphrase is empty")
+	}
+
+	return passphrase, nil
+}
+
+func promptPassword(prompt string) (string, error) {
+	// stdout may carry the bundle
+	fmt.Fprint(os.Stderr, prompt)
+
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+
+	return string(password), err
+}
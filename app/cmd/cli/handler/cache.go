@@ -0,0 +1,141 @@
+package cli
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"keeper/internal/database"
+	log "keeper/internal/logger"
+	"keeper/services/cache"
+
+	"github.com/urfave/cli/v2"
+)
+
+// cachePath is the cache database, only the server and the cache commands
+// open it
+func (h *Handler) cachePath() (string, error) {
+	if h.opts.CacheDatabase != "" {
+		return h.opts.CacheDatabase, nil
+	}
+
+	path, err := cache.DefaultPath()
+	if err != nil {
+		return "", log.Errorf("error locating cache database: %w", err)
+	}
+
+	return path, nil
+}
+
+// openCache opens the cache database, creating it when create is set. The
+// repository is nil when the database doesn't exist and create is not set.
+func (h *Handler) openCache(create bool) (*cache.SQLiteRepository, func(), error) {
+	path, err := h.cachePath()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) && !create {
+		return nil, func() {}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, nil, log.Errorf("error creating cache directory: %w", err)
+	}
+
+	db, err := database.NewSQLite(database.Options{Database: path})
+	if err != nil {
+		return nil, nil, log.Errorf("failed to open cache database: %w", err)
+	}
+
+	repo, err := cache.NewSQLite(db)
+	if err != nil {
+		db.Close()
+		return nil, nil, log.Errorf("failed to create cache repository: %w", err)
+	}
+
+	return repo, func() { db.Close() }, nil
+}
+
+func (h *Handler) cacheStats(c *cli.Context) error {
+	repo, closeCache, err := h.openCache(false)
+	if err != nil {
+		return err
+	}
+
+	defer closeCache()
+
+	// the cache is empty until the server stored a response
+	stats := &cache.Stats{}
+	if repo != nil {
+		if stats, err = repo.Stats(c.Context); err != nil {
+			return log.Errorf("error getting cache stats: %w", err)
+		}
+	}
+
+	log.Infof("Entries: %d (%d expired)", stats.Entries, stats.Expired)
+	log.Infof("Hits:    %d", stats.Hits)
+	log.Infof("Size:    %d bytes", stats.Bytes)
+
+	profiles, err := h.keeper.ListProfiles(c.Context)
+	if err != nil {
+		return log.Errorf("error listing profiles: %w", err)
+	}
+
+	for _, p := range profiles {
+		if p.CacheEnabled {
+			log.Infof("Enabled for profile %s", p.Name)
+		}
+	}
+
+	return nil
+}
+
+func (h *Handler) clearCache(c *cli.Context) error {
+	repo, closeCache, err := h.openCache(false)
+	if err != nil {
+		return err
+	}
+
+	defer closeCache()
+
+	var n int64
+	if repo != nil {
+		if n, err = repo.Clear(c.Context, c.Bool("expired")); err != nil {
+			return log.Errorf("error clearing cache: %w", err)
+		}
+	}
+
+	log.Infof("removed %d cached responses", n)
+
+	return nil
+}
+
+func (h *Handler) enableCache(c *cli.Context) error {
+	return h.setProfileCache(c, true)
+}
+
+func (h *Handler) disableCache(c *cli.Context) error {
+	return h.setProfileCache(c, false)
+}
+
+func (h *Handler) setProfileCache(c *cli.Context, enabled bool) error {
+	profile, err := h.targetProfile(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.keeper.SetProfileCache(c.Context, profile, enabled); err != nil {
+		return log.Errorf("error updating profile: %w", err)
+	}
+
+	state := "disabled"
+	if enabled {
+		state = "enabled"
+	}
+
+	log.Infof("caching %s for profile %s", state, profile)
+
+	return nil
+}
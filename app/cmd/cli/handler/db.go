@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"time"
+
+	"keeper/internal/database"
+	log "keeper/internal/logger"
+
+	"github.com/urfave/cli/v2"
+)
+
+// database is the keeper database, an error when the repository is not
+// kept in one
+func (h *Handler) database() (*sql.DB, error) {
+	if h.opts.DB == nil {
+		return nil, log.Errorf("the keeper setup is not kept in a database")
+	}
+
+	return h.opts.DB, nil
+}
+
+// backupDatabase copies the database to the given file, a new file in the
+// backup directory by default
+func (h *Handler) backupDatabase(c *cli.Context) error {
+	db, err := h.database()
+	if err != nil {
+		return err
+	}
+
+	dest := c.Args().First()
+	if dest == "" {
+		if err := os.MkdirAll(h.opts.Backup.Dir, 0o700); err != nil {
+			return log.Errorf("error creating backup directory: %v", err)
+		}
+
+		dest = filepath.Join(h.opts.Backup.Dir, database.BackupName("keeper-", time.Now()))
+	}
+
+	if err := database.Backup(c.Context, db, dest); err != nil {
+		return log.Errorf("error backing up database: %v", err)
+	}
+
+	log.Infof("database backed up to %s", dest)
+
+	return nil
+}
+
+// restoreDatabase replaces the database with a backup, saving the current
+// one to the backup directory first
+func (h *Handler) restoreDatabase(c *cli.Context) error {
+	db, err := h.database()
+	if err != nil {
+		return err
+	}
+
+	src := c.Args().First()
+	if src == "" {
+		return log.Errorf("expected a backup, e.g. keeper db restore %s", filepath.Join(h.opts.Backup.Dir, "keeper-20260101-000000.db"))
+	}
+
+	if err := database.VerifyBackup(c.Context, src); err != nil {
+		return log.Errorf("error restoring database: %v", err)
+	}
+
+	if err := os.MkdirAll(h.opts.Backup.Dir, 0o700); err != nil {
+		return log.Errorf("error creating backup directory: %v", err)
+	}
+
+	saved := filepath.Join(h.opts.Backup.Dir, database.BackupName("keeper-pre-restore-", time.Now()))
+	if err := database.Backup(c.Context, db, saved); err != nil {
+		return log.Errorf("error saving the current database: %v", err)
+	}
+
+	if err := database.Restore(c.Context, db, src); err != nil {
+		return log.Errorf("error restoring database: %v, the current database is unchanged", err)
+	}
+
+	// the backup may predate migrations
+	if err := database.Migrate(c.Context, db); err != nil {
+		return log.Errorf("error migrating restored database: %v", err)
+	}
+
+	log.Infof("database restored from %s, the previous one was saved to %s", src, saved)
+
+	if _, err := h.getRunningServerInfo(); err == nil {
+		log.Infof("the running server reloads the restored settings")
+	}
+
+	return nil
+}
+
+// checkDatabase checks the database, or the given backup, for corruption
+// and rows referring to missing ones
+func (h *Handler) checkDatabase(c *cli.Context) error {
+	var db *sql.DB
+	var err error
+	name := "database"
+
+	if path := c.Args().First(); path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return log.Errorf("error opening %s: %v", path, err)
+		}
+
+		if db, err = sql.Open("sqlite3", "file:"+path+"?mode=ro"); err != nil {
+			return log.Errorf("error opening %s: %v", path, err)
+		}
+		defer db.Close()
+
+		name = path
+	} else if db, err = h.database(); err != nil {
+		return err
+	}
+
+	problems, err := database.Check(c.Context, db)
+	if err != nil {
+		return log.Errorf("error checking %s: %v", name, err)
+	}
+
+	for _, p := range problems {
+		log.Infof("%s", p)
+	}
+
+	if len(problems) > 0 {
+		return log.Errorf("%s failed the check", name)
+	}
+
+	log.Infof("%s is ok", name)
+
+	return nil
+}
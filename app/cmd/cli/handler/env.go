@@ -0,0 +1,304 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"keeper/internal/dirconfig"
+	log "keeper/internal/logger"
+	provider_registry "keeper/internal/provider-registry"
+	"keeper/services/keeper"
+	"keeper/services/proxy"
+
+	"github.com/urfave/cli/v2"
+)
+
+// envVar is an environment variable handed to a tool, Secret marks values
+// that must not be displayed
+type envVar struct {
+	Name   string
+	Value  string
+	Secret bool
+}
+
+type envOptions struct {
+	// Profile selects the profile, the active one when empty
+	Profile string
+	// Dir holds the overrides of the working directory's .keeper file
+	Dir *dirconfig.Config
+	// Providers limits the variables to these providers, all when empty
+	Providers []string
+	// TTL is the lifetime of proxy tokens
+	TTL time.Duration
+	// Direct injects the real keys even when a server is running
+	Direct bool
+}
+
+// providerEnv builds the variables that point each provider's SDKs at the
+// running proxy with a virtual token, or straight at the provider with the
+// real key when no server is running.
+func (h *Handler) providerEnv(ctx context.Context, opts envOptions) ([]envVar, error) {
+	providers, err := h.envProviders(opts.Providers)
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.Direct {
+		if info, err := h.getRunningServerInfo(); err == nil {
+			if admin, ok := h.adminClient(info); ok {
+				return h.proxyEnv(ctx, admin, info, providers, opts)
+			}
+		}
+	}
+
+	return h.directEnv(ctx, providers, opts)
+}
+
+func (h *Handler) proxyEnv(ctx context.Context, admin *proxy.AdminClient, info *ProcessInfo, providers []provider_registry.Provider, opts envOptions) ([]envVar, error) {
+	var vars []envVar
+	for _, p := range providers {
+		token, err := admin.IssueToken(ctx, proxy.TokenRequest{
+			Profile:  opts.Profile,
+			Provider: p.Name,
+			Key:      opts.Dir.KeyFor(p.Name),
+			TTL:      opts.TTL,
+		})
+		if err != nil {
+			return nil, log.Errorf("error issuing token for %s: %w", p.Name, err)
+		}
+
+		vars = append(vars,
+			envVar{Name: p.Env.BaseURL, Value: info.URL()},
+			envVar{Name: p.Env.APIKey, Value: token.Token, Secret: true},
+		)
+	}
+
+	return vars, nil
+}
+
+func (h *Handler) directEnv(ctx context.Context, providers []provider_registry.Provider, opts envOptions) ([]envVar, error) {
+	settings, err := h.profileSettings(ctx, opts.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	var vars []envVar
+	for _, p := range providers {
+		baseURL, key := settings.BaseURL, settings.ProviderKey
+
+		switch {
+		case opts.Dir.KeyFor(p.Name) != "":
+			provider, err := h.namedKey(ctx, p.Name, opts.Dir.KeyFor(p.Name))
+			if err != nil {
+				return nil, err
+			}
+
+			baseURL, key = provider.BaseURL, provider.ProviderKey
+
+		// other providers fall back to their most recent active key
+		case p.Name != settings.Name || settings.ProviderKey.ID == 0:
+			provider, err := h.keeper.GetProviderByNameWithKey(ctx, p.Name)
+			if err != nil {
+				return nil, log.Errorf("error getting provider %s: %w", p.Name, err)
+			}
+
+			baseURL, key = provider.BaseURL, provider.ProviderKey
+		}
+
+		if key.Secret == "" {
+			log.Debugf("Skipping %s, no key is set", p.Name)
+			continue
+		}
+
+		secret, err := h.opts.Secrets.ResolveKey(ctx, key)
+		if err != nil {
+			return nil, log.Errorf("error resolving key of %s: %w", p.Name, err)
+		}
+
+		vars = append(vars,
+			envVar{Name: p.Env.BaseURL, Value: p.SDKBaseURL(baseURL)},
+			envVar{Name: p.Env.APIKey, Value: secret, Secret: true},
+		)
+	}
+
+	return vars, nil
+}
+
+// namedKey returns the provider with its active key of the given name
+func (h *Handler) namedKey(ctx context.Context, provider, name string) (*keeper.Provider, error) {
+	keys, err := h.keeper.ListActiveKeys(ctx)
+	if err != nil {
+		return nil, log.Errorf("error listing keys: %w", err)
+	}
+
+	for _, k := range keys {
+		if k.Name == provider && k.ProviderKey.Name == name {
+			return &k, nil
+		}
+	}
+
+	return nil, log.Errorf("no active key %s for provider %s", name, provider)
+}
+
+// dirEnvOptions applies the working directory's .keeper file to opts, an
+// explicit --profile still wins over the file.
+func (h *Handler) dirEnvOptions(opts envOptions) (envOptions, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return opts, log.Errorf("error getting working directory: %w", err)
+	}
+
+	dir, err := dirconfig.Find(cwd)
+	if err != nil {
+		return opts, log.Errorf("error reading directory config: %w", err)
+	}
+
+	if dir == nil {
+		return opts, nil
+	}
+
+	log.Debugf("Using directory config %s", dir.Path)
+
+	opts.Dir = dir
+	if opts.Profile == "" {
+		opts.Profile = dir.Profile
+	}
+
+	return opts, nil
+}
+
+// profileSettings returns the settings of the named profile, or of the active
+// profile when name is empty
+func (h *Handler) profileSettings(ctx context.Context, name string) (*keeper.ProfileSettings, error) {
+	if name == "" {
+		settings, err := h.keeper.GetActiveProfileSettingsWithKey(ctx)
+		if err != nil {
+			return nil, log.Errorf("error getting active profile settings: %w", err)
+		}
+
+		return settings, nil
+	}
+
+	settings, err := h.keeper.GetProfileSettingsWithKey(ctx, name)
+	if err != nil {
+		return nil, log.Errorf("error getting settings of profile %s: %w", name, err)
+	}
+
+	return settings, nil
+}
+
+// envProviders returns the registry providers that declare environment
+// variables, optionally limited to the given names.
+func (h *Handler) envProviders(names []string) ([]provider_registry.Provider, error) {
+	if len(names) == 0 {
+		var providers []provider_registry.Provider
+		for _, p := range h.registry.Providers {
+			if p.Env.BaseURL != "" && p.Env.APIKey != "" {
+				providers = append(providers, p)
+			}
+		}
+
+		return providers, nil
+	}
+
+	providers := make([]provider_registry.Provider, 0, len(names))
+	for _, name := range names {
+		p, ok := h.registry.Provider(name)
+		if !ok {
+			return nil, log.Errorf("unknown provider %s", name)
+		}
+
+		if p.Env.BaseURL == "" || p.Env.APIKey == "" {
+			return nil, log.Errorf("provider %s does not declare environment variables", name)
+		}
+
+		providers = append(providers, p)
+	}
+
+	return providers, nil
+}
+
+func (h *Handler) printEnv(c *cli.Context) error {
+	// the exports are evaluated by the shell, logs must not end up in them
+	log.UseStderr()
+
+	shell := c.String("shell")
+	if shell == "" {
+		shell = defaultShell()
+	}
+
+	format, ok := shellFormats[shell]
+	if !ok {
+		return log.Errorf("unsupported shell %s, use one of bash, zsh, fish, powershell or dotenv", shell)
+	}
+
+	opts, err := h.dirEnvOptions(envOptions{
+		Profile:   c.String("profile"),
+		Providers: c.StringSlice("provider"),
+		TTL:       c.Duration("ttl"),
+		Direct:    c.Bool("direct"),
+	})
+	if err != nil {
+		return err
+	}
+
+	vars, err := h.providerEnv(c.Context, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vars {
+		value := v.Value
+		if v.Secret && c.Bool("mask") {
+			value = maskSecret(value)
+		}
+
+		fmt.Fprintln(c.App.Writer, format(v.Name, value))
+	}
+
+	return nil
+}
+
+var shellFormats = map[string]func(name, value string) string{
+	"bash": posixExport,
+	"zsh":  posixExport,
+	"sh":   posixExport,
+	"fish": func(name, value string) string {
+		value = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+		return fmt.Sprintf("set -gx %s '%s';", name, value)
+	},
+	"powershell": func(name, value string) string {
+		return fmt.Sprintf("$Env:%s = '%s'", name, strings.ReplaceAll(value, "'", "''"))
+	},
+	"dotenv": func(name, value string) string {
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		return fmt.Sprintf(`%s="%s"`, name, value)
+	},
+}
+
+func posixExport(name, value string) string {
+	return fmt.Sprintf("export %s='%s'", name, strings.ReplaceAll(value, "'", `'\''`))
+}
+
+// defaultShell guesses the output format from $SHELL, falling back to bash
+func defaultShell() string {
+	shell := filepath.Base(os.Getenv("SHELL"))
+	if _, ok := shellFormats[shell]; ok {
+		return shell
+	}
+
+	return "bash"
+}
+
+// maskSecret hides all but the last 4 characters of a secret
+func maskSecret(secret string) string {
+	if len(secret) <= 4 {
+		return strings.Repeat("*", len(secret))
+	}
+
+	return strings.Repeat("*", len(secret)-4) + secret[len(secret)-4:]
+}
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	log "keeper/internal/logger"
+
+	"github.com/urfave/cli/v2"
+)
+
+func (h *Handler) execCommand(c *cli.Context) error {
+	args := c.Args().Slice()
+	if len(args) == 0 {
+		return log.Errorf("command is required")
+	}
+
+	opts, err := h.dirEnvOptions(envOptions{
+		Profile:   c.String("profile"),
+		Providers: c.StringSlice("provider"),
+		TTL:       c.Duration("ttl"),
+		Direct:    c.Bool("direct"),
+	})
+	if err != nil {
+		return err
+	}
+
+	vars, err := h.providerEnv(c.Context, opts)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+
+	for _, v := range vars {
+		cmd.Env = append(cmd.Env, v.Name+"="+v.Value)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return log.Errorf("error running %s: %w", args[0], err)
+	}
+
+	// relay termination signals so the command can shut down on its own terms
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	go func() {
+		for s := range sig {
+			cmd.Process.Signal(s)
+		}
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return cli.Exit("", exitErr.ExitCode())
+		}
+
+		return log.Errorf("error running %s: %w", args[0], err)
+	}
+
+	return nil
+}
@@ -1,35 +1,71 @@
 package cli
 
 import (
-	"syscall"
-
+	"database/sql"
 	_ "embed"
-	"fmt"
+	"errors"
+	"net"
 	"os"
-	"strings"
+	"time"
 
+	"keeper/internal/database"
 	log "keeper/internal/logger"
+	provider_registry "keeper/internal/provider-registry"
+	"keeper/services/cache"
+	"keeper/services/cassette"
 	"keeper/services/keeper"
+	"keeper/services/keycheck"
+	"keeper/services/proxy"
 
 	"github.com/urfave/cli/v2"
-	"golang.org/x/term"
 )
 
 type proxyService interface {
-	Start(addr string) error
+	Listen(opts proxy.ListenOptions) ([]net.Addr, error)
+	UseCassette(repo *cassette.SQLiteRepository, opts proxy.CassetteOptions) error
+	UseCache(repo *cache.SQLiteRepository)
+	Serve() error
 	Stop() error
 }
 
+// Options configures the CLI handler
+type Options struct {
+	// AdminSocket is where a server started by this CLI serves its admin API
+	AdminSocket string
+	// TLSDir holds the local CA and certificate, the user config dir when empty
+	TLSDir string
+	// CacheDatabase holds the proxy's cached responses, under the user cache
+	// dir when empty
+	CacheDatabase string
+	// RotateAfter is the default rotation period of new keys, e.g. 90d,
+	// none when empty
+	RotateAfter string
+	// Secrets resolves keys stored as references, e.g. for `keeper env
+	// --direct`
+	Secrets *keeper.SecretResolver
+	// DB is the keeper database, for backups
+	DB *sql.DB
+	// Backup says where backups go and how often a running server takes
+	// them
+	Backup database.BackupOptions
+}
+
 type Handler struct {
-	keeper *keeper.SQLiteRepository
+	keeper   keeper.Repository
+	registry provider_registry.Registry
+	checker  *keycheck.Checker
 
 	proxyService proxyService
+	opts         Options
 }
 
-func New(keeper *keeper.SQLiteRepository, proxyService proxyService) *Handler {
+func New(keeper keeper.Repository, registry provider_registry.Registry, proxyService proxyService, opts Options) *Handler {
 	return &Handler{
 		keeper:       keeper,
+		registry:     registry,
+		checker:      keycheck.New(),
 		proxyService: proxyService,
+		opts:         opts,
 	}
 }
 
@@ -37,6 +73,9 @@ func (h *Handler) Run() error {
 	app := &cli.App{
 		Name:  "keeper",
 		Usage: "A CLI tool for managing key-value pairs",
+		// urfave exits on its own for errors carrying an exit code, they are
+		// returned instead so the caller exits after its cleanup
+		ExitErrHandler: func(*cli.Context, error) {},
 		Commands: []*cli.Command{
 			{
 				Name:  "start",
@@ -46,7 +85,50 @@ func (h *Handler) Run() error {
 						Name:    "port",
 						Aliases: []string{"p"},
 						Value:   "8080",
-						Usage:   "Port to run the server on",
+						Usage:   "Port to run the server on, 0 picks a free port",
+					},
+					&cli.IntFlag{
+						Name:  "retry",
+						Value: 0,
+						Usage: "Retry binding this many times while the port is in use",
+					},
+					&cli.DurationFlag{
+						Name:  "retry-delay",
+						Value: time.Second,
+						Usage: "Wait between bind attempts",
+					},
+					&cli.StringFlag{
+						Name:    "bind",
+						Aliases: []string{"b"},
+						Value:   "127.0.0.1",
+						Usage:   "Address to bind the TCP listener to",
+					},
+					&cli.StringFlag{
+						Name:    "socket",
+						Aliases: []string{"s"},
+						Usage:   "Also listen on this Unix socket, accessible only by the current user",
+					},
+					&cli.BoolFlag{
+						Name:  "tls",
+						Value: false,
+						Usage: "Serve HTTPS with the certificate from 'keeper tls init'",
+					},
+					&cli.StringFlag{
+						Name:  "metrics-addr",
+						Usage: "Also serve Prometheus metrics on this TCP address, they are always on the admin socket",
+					},
+					&cli.StringFlag{
+						Name:  "record",
+						Usage: "Record every request and its response to this cassette file",
+					},
+					&cli.StringFlag{
+						Name:  "replay",
+						Usage: "Answer requests from this cassette file without reaching the network",
+					},
+					&cli.StringFlag{
+						Name:  "match",
+						Value: "method,path,body",
+						Usage: "Request fields a replayed request must match, any of method, path, query and body",
 					},
 					&cli.BoolFlag{
 						Name:    "detached",
@@ -67,6 +149,312 @@ func (h *Handler) Run() error {
 				Usage:  "Get the status of the server",
 				Action: h.statusServer,
 			},
+			{
+				Name:   "reload",
+				Usage:  "Reload settings in the running server",
+				Action: h.reloadServer,
+			},
+			{
+				Name:   "usage",
+				Usage:  "Show request counts of the running server",
+				Action: h.showUsage,
+			},
+			{
+				Name:      "use",
+				Usage:     "Switch the active profile",
+				ArgsUsage: "<profile>",
+				Action:    h.useProfile,
+			},
+			{
+				Name:  "profile",
+				Usage: "Manage profiles",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "List profiles",
+						Action: h.listProfiles,
+					},
+					{
+						Name:      "create",
+						Usage:     "Create a profile using the active profile's provider",
+						ArgsUsage: "<profile>",
+						Action:    h.createProfile,
+					},
+					{
+						Name:      "use",
+						Usage:     "Switch the active profile",
+						ArgsUsage: "<profile>",
+						Action:    h.useProfile,
+					},
+				},
+			},
+			{
+				Name:      "exec",
+				Usage:     "Run a command with provider environment variables set",
+				ArgsUsage: "-- <command> [args...]",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:    "provider",
+						Aliases: []string{"p"},
+						Usage:   "Only set variables for these providers",
+					},
+					&cli.StringFlag{
+						Name:  "profile",
+						Usage: "Use this profile instead of the one from .keeper or the active one",
+					},
+					&cli.DurationFlag{
+						Name:  "ttl",
+						Value: time.Hour,
+						Usage: "Lifetime of the proxy token handed to the command",
+					},
+					&cli.BoolFlag{
+						Name:  "direct",
+						Usage: "Inject the real keys even when the server is running",
+					},
+				},
+				Action: h.execCommand,
+			},
+			{
+				Name:  "env",
+				Usage: "Print shell exports pointing provider SDKs at keeper",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "shell",
+						Usage: "Output format: bash, zsh, fish, powershell or dotenv (default from $SHELL)",
+					},
+					&cli.StringFlag{
+						Name:  "profile",
+						Usage: "Use this profile instead of the one from .keeper or the active one",
+					},
+					&cli.StringSliceFlag{
+						Name:    "provider",
+						Aliases: []string{"p"},
+						Usage:   "Only print variables for these providers",
+					},
+					&cli.DurationFlag{
+						Name:  "ttl",
+						Value: 12 * time.Hour,
+						Usage: "Lifetime of the proxy token",
+					},
+					&cli.BoolFlag{
+						Name:  "direct",
+						Usage: "Print the real keys even when the server is running",
+					},
+					&cli.BoolFlag{
+						Name:  "mask",
+						Usage: "Mask secrets for display",
+					},
+				},
+				Action: h.printEnv,
+			},
+			{
+				Name:  "alias",
+				Usage: "Manage model aliases rewritten by the proxy",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "profile",
+						Usage: "Profile the aliases belong to, the active one by default",
+					},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:      "set",
+						Usage:     "Forward requests for <alias> to <model>",
+						ArgsUsage: "<alias> <model>",
+						Action:    h.setAlias,
+					},
+					{
+						Name:      "rm",
+						Usage:     "Remove an alias",
+						ArgsUsage: "<alias>",
+						Action:    h.removeAlias,
+					},
+					{
+						Name:   "list",
+						Usage:  "List aliases",
+						Action: h.listAliases,
+					},
+				},
+			},
+			{
+				Name:  "cache",
+				Usage: "Manage the cache of deterministic (temperature 0) responses",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "stats",
+						Usage:  "Show how many responses are cached and how often they were served",
+						Action: h.cacheStats,
+					},
+					{
+						Name:  "clear",
+						Usage: "Remove cached responses",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "expired",
+								Usage: "Only remove expired responses",
+							},
+						},
+						Action: h.clearCache,
+					},
+					{
+						Name:  "enable",
+						Usage: "Cache responses for a profile",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "profile",
+								Usage: "Profile to enable caching for, the active one by default",
+							},
+						},
+						Action: h.enableCache,
+					},
+					{
+						Name:  "disable",
+						Usage: "Stop caching responses for a profile",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "profile",
+								Usage: "Profile to disable caching for, the active one by default",
+							},
+						},
+						Action: h.disableCache,
+					},
+				},
+			},
+			{
+				Name:  "key",
+				Usage: "Manage provider keys",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "set",
+						Usage:     "Add a key for a provider, read from the terminal, stdin, a variable or a file",
+						ArgsUsage: "<provider>",
+						Flags:     keySetFlags(),
+						Action:    h.setKey,
+					},
+					{
+						Name:      "list",
+						Usage:     "List keys with the outcome of their last health check",
+						ArgsUsage: "[provider]",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "expiring",
+								Usage: "Only list keys that expire or are due for rotation within this window, e.g. 30d",
+							},
+						},
+						Action: h.listKeys,
+					},
+					{
+						Name:      "verify",
+						Usage:     "Check that active keys are accepted by their provider, the proxy skips rejected ones",
+						ArgsUsage: "[provider]",
+						Action:    h.verifyKeys,
+					},
+				},
+			},
+			{
+				Name:  "db",
+				Usage: "Back up, restore and check the database",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "backup",
+						Usage:     "Copy the database to a file, a new one in the backup directory by default",
+						ArgsUsage: "[file]",
+						Action:    h.backupDatabase,
+					},
+					{
+						Name:      "restore",
+						Usage:     "Replace the database with a backup, the current one is saved to the backup directory",
+						ArgsUsage: "<file>",
+						Action:    h.restoreDatabase,
+					},
+					{
+						Name:      "check",
+						Usage:     "Check the database or a backup for corruption and broken references",
+						ArgsUsage: "[file]",
+						Action:    h.checkDatabase,
+					},
+				},
+			},
+			{
+				Name:  "export",
+				Usage: "Write profiles, provider overrides and optionally keys to a bundle teammates can import",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "out",
+						Aliases: []string{"o"},
+						Usage:   "Bundle file to write, - for stdout",
+					},
+					&cli.BoolFlag{
+						Name:  "encrypt",
+						Usage: "Encrypt the bundle with a passphrase",
+					},
+					&cli.StringSliceFlag{
+						Name:  "recipient",
+						Usage: "Encrypt the bundle to this age public key (age1...) instead of a passphrase",
+					},
+					&cli.StringSliceFlag{
+						Name:  "recipients-file",
+						Usage: "Encrypt the bundle to the age public keys in this file",
+					},
+					&cli.BoolFlag{
+						Name:  "with-keys",
+						Usage: "Include provider keys, the bundle must be encrypted",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Replace an existing bundle file",
+					},
+				}, passphraseFlags()...),
+				Action: h.exportBundle,
+			},
+			{
+				Name:      "import",
+				Usage:     "Add the profiles, provider overrides and keys of a bundle, the active profile is kept",
+				ArgsUsage: "<bundle>",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "on-conflict",
+						Value: string(keeper.ConflictSkip),
+						Usage: "What to do with profiles and keys whose name is taken: skip, overwrite or rename",
+					},
+					&cli.StringSliceFlag{
+						Name:    "identity",
+						Aliases: []string{"i"},
+						Usage:   "Decrypt with the age private key in this file",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Show what would change without changing anything",
+					},
+					&cli.BoolFlag{
+						Name:  "allow-references",
+						Usage: "Import keys that are exec: or file: references, which run commands or read files on this machine whenever they are used",
+					},
+				}, passphraseFlags()...),
+				Action: h.importBundle,
+			},
+			{
+				Name:  "tls",
+				Usage: "Manage the local certificate authority used by --tls",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "init",
+						Usage: "Create a local CA and a certificate for localhost",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "Replace existing certificates",
+							},
+						},
+						Action: h.tlsInit,
+					},
+					{
+						Name:   "trust-info",
+						Usage:  "Print where the CA certificate is so tools can trust it",
+						Action: h.tlsTrustInfo,
+					},
+				},
+			},
 			{
 				Name:      "set",
 				Usage:     "Set a key-value pair",
@@ -80,9 +468,11 @@ func (h *Handler) Run() error {
 				Action:    h.getValue,
 			},
 			{
-				Name:   "set-key",
-				Usage:  "Set a key-value pair interactively",
-				Action: h.setKeyInteractive,
+				Name:      "set-key",
+				Usage:     "Set a key-value pair interactively",
+				ArgsUsage: "<provider>",
+				Flags:     keySetFlags(),
+				Action:    h.setKey,
 			},
 		},
 	}
@@ -90,51 +480,28 @@ func (h *Handler) Run() error {
 	return app.Run(os.Args)
 }
 
-func (h *Handler) setKeyValue(c *cli.Context) error {
-	// TODO: Implement set key-value logic
-	return nil
-}
-
-func (h *Handler) getValue(c *cli.Context) error {
-	log.Debugf("Getting value for key:", c.Args().First())
-
-	return nil
-}
-
-func (h *Handler) setKeyInteractive(c *cli.Context) error {
-	providerName := c.Args().First()
-
-	fmt.Printf("Enter key for '%s': ", providerName)
-
-	value, err := h.readSecretFromConsole()
-	if err != nil {
-		return log.Errorf("error reading value: %w", err)
-	}
-
-	// only show last 4 characters of the secret
-	log.Debugf("Setting key %s to value %s", providerName, strings.Repeat("*", len(value)-4)+value[len(value)-4:])
-
-	provider, err := h.keeper.GetProviderByName(c.Context, providerName)
-	if err != nil {
-		return log.Errorf("error getting provider: %w", err)
+// ExitCode is the process exit code for the error Run returned: the code it
+// carries, such as the exit code of the command run by `keeper exec`, or 1
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
 	}
 
-	if _, err := h.keeper.CreateProviderKey(c.Context, *provider, value); err != nil {
-		return log.Errorf("error setting key: %w", err)
+	var coder cli.ExitCoder
+	if errors.As(err, &coder) {
+		return coder.ExitCode()
 	}
 
-	log.Infof("key successfully created")
+	return 1
+}
 
+func (h *Handler) setKeyValue(c *cli.Context) error {
+	// TODO: Implement set key-value logic
 	return nil
 }
 
-func (h *Handler) readSecretFromConsole() (string, error) {
-	password, err := term.ReadPassword(int(syscall.Stdin))
-	if err != nil {
-		return "", err
-	}
-
-	fmt.Println()
+func (h *Handler) getValue(c *cli.Context) error {
+	log.Debugf("Getting value for key: %s", c.Args().First())
 
-	return string(password), nil
+	return nil
 }
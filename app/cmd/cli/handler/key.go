@@ -0,0 +1,527 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "keeper/internal/logger"
+	"keeper/services/keeper"
+	"keeper/services/keycheck"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+const (
+	// expiryWarning is how far ahead `keeper status` warns about key dates,
+	// and how long after a key expired it still mentions it
+	expiryWarning = 14 * 24 * time.Hour
+	// maxSecretSize bounds a key read from stdin or a file
+	maxSecretSize = 64 << 10
+)
+
+func keySetFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "Name of the key, the provider's name by default",
+		},
+		&cli.BoolFlag{
+			Name:  "from-stdin",
+			Usage: "Read the key from stdin instead of prompting",
+		},
+		&cli.StringFlag{
+			Name:  "from-env",
+			Usage: "Read the key from this environment variable",
+		},
+		&cli.StringFlag{
+			Name:  "from-file",
+			Usage: "Read the key from this file",
+		},
+		&cli.StringFlag{
+			Name:  "ref",
+			Usage: "Store a reference resolved whenever the key is used instead of the key, e.g. exec:pass show openai/team, file:/run/secrets/openai, env:OPENAI_KEY or vault:secret/team/openai#api_key",
+		},
+		&cli.BoolFlag{
+			Name:  "no-verify",
+			Usage: "Store the key without checking it with the provider",
+		},
+		&cli.StringFlag{
+			Name:  "expires",
+			Usage: "Stop using the key at this date (2027-01-01) or after this period (90d)",
+		},
+		&cli.StringFlag{
+			Name:  "rotate-after",
+			Usage: "Remind to rotate the key at this date or after this period, KEY_ROTATE_AFTER by default",
+		},
+	}
+}
+
+// setKey stores a new key for the provider named by the only argument
+func (h *Handler) setKey(c *cli.Context) error {
+	args, err := commandArgs(c)
+	if err != nil {
+		return log.Errorf("%v", err)
+	}
+
+	if len(args) != 1 {
+		return log.Errorf("expected exactly one provider, e.g. keeper key set openai")
+	}
+
+	providerName := args[0]
+
+	provider, err := h.keeper.GetProviderByName(c.Context, providerName)
+	if err != nil {
+		names := make([]string, 0, len(h.registry.Providers))
+		for _, p := range h.registry.Providers {
+			names = append(names, p.Name)
+		}
+		return log.Errorf("unknown provider %q, expected one of %s", providerName, strings.Join(names, ", "))
+	}
+
+	opts, err := h.keyOptions(c)
+	if err != nil {
+		return err
+	}
+
+	value, err := readKeySecret(c, providerName)
+	if err != nil {
+		return log.Errorf("error reading key: %v", err)
+	}
+
+	opts.Reference = c.String("ref") != ""
+	if opts.Reference && !h.opts.Secrets.IsReference(value) {
+		return log.Errorf("invalid reference %q, expected <scheme>:<reference> with a scheme of %s", value, strings.Join(h.opts.Secrets.Schemes(), ", "))
+	}
+
+	log.Debugf("Setting key %s to value %s", providerName, maskSecret(value))
+
+	status := keeper.KeyStatusUnknown
+	if !c.Bool("no-verify") {
+		key := *provider
+		key.Secret = value
+		key.IsReference = opts.Reference
+
+		result, err := h.checkKey(c.Context, key)
+		switch {
+		case err != nil:
+			// an unreachable provider says nothing about the key
+			log.Infof("key could not be verified, storing it unchecked: %v", err)
+		case !result.Status.Usable():
+			return log.Errorf("key rejected by %s (%s): %s, use --no-verify to store it anyway", providerName, result.Status, result.Detail)
+		default:
+			status = result.Status
+		}
+	}
+
+	id, err := h.keeper.CreateProviderKey(c.Context, *provider, value, opts)
+	if err != nil {
+		return log.Errorf("error setting key: %w", err)
+	}
+
+	if status != keeper.KeyStatusUnknown {
+		if err := h.keeper.SetProviderKeyStatus(c.Context, id, status); err != nil {
+			return log.Errorf("error recording key status: %w", err)
+		}
+	}
+
+	log.Infof("key successfully created (%s)", status)
+
+	return nil
+}
+
+// readKeySecret reads the key from the source chosen by the flags, the
+// terminal when none is
+func readKeySecret(c *cli.Context, provider string) (string, error) {
+	sources := 0
+	for _, set := range []bool{c.Bool("from-stdin"), c.String("from-env") != "", c.String("from-file") != "", c.String("ref") != ""} {
+		if set {
+			sources++
+		}
+	}
+
+	if sources > 1 {
+		return "", fmt.Errorf("only one of --from-stdin, --from-env, --from-file and --ref can be used")
+	}
+
+	var secret string
+
+	switch {
+	case c.Bool("from-stdin"):
+		data, err := io.ReadAll(io.LimitReader(os.Stdin, maxSecretSize))
+		if err != nil {
+			return "", err
+		}
+		secret = string(data)
+
+	case c.String("from-env") != "":
+		value, ok := os.LookupEnv(c.String("from-env"))
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", c.String("from-env"))
+		}
+		secret = value
+
+	case c.String("ref") != "":
+		// stored as given, the key is read from the reference when used
+		secret = c.String("ref")
+
+	case c.String("from-file") != "":
+		f, err := os.Open(c.String("from-file"))
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		data, err := io.ReadAll(io.LimitReader(f, maxSecretSize))
+		if err != nil {
+			return "", err
+		}
+		secret = string(data)
+
+	default:
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return "", fmt.Errorf("stdin is not a terminal, pass the key with --from-stdin, --from-env or --from-file")
+		}
+
+		fmt.Printf("Enter key for '%s': ", provider)
+
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		if err != nil {
+			return "", err
+		}
+		fmt.Println()
+
+		secret = string(password)
+	}
+
+	// files and pipes usually end with a newline
+	secret = strings.TrimSpace(secret)
+
+	switch {
+	case secret == "":
+		return "", fmt.Errorf("the key is empty")
+	case strings.ContainsAny(secret, "\r\n"):
+		return "", fmt.Errorf("the key spans several lines")
+	}
+
+	return secret, nil
+}
+
+// commandArgs returns the positional arguments of c and applies the flags
+// that follow them, urfave/cli stops parsing flags at the first argument
+// but `keeper key set openai --from-stdin` reads naturally.
+func commandArgs(c *cli.Context) ([]string, error) {
+	var args []string
+
+	rest := c.Args().Slice()
+	for i := 0; i < len(rest); i++ {
+		arg := rest[i]
+
+		if arg == "--" {
+			args = append(args, rest[i+1:]...)
+			break
+		}
+
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			args = append(args, arg)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+
+		flag := lookupFlag(c.Command.Flags, name)
+		if flag == nil {
+			return nil, fmt.Errorf("flag provided but not defined: %s", arg)
+		}
+
+		if !hasValue {
+			if _, ok := flag.(*cli.BoolFlag); ok {
+				value = "true"
+			} else {
+				if i+1 >= len(rest) {
+					return nil, fmt.Errorf("flag needs an argument: %s", arg)
+				}
+				i++
+				value = rest[i]
+			}
+		}
+
+		if err := c.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for flag %s: %w", value, arg, err)
+		}
+	}
+
+	return args, nil
+}
+
+func lookupFlag(flags []cli.Flag, name string) cli.Flag {
+	for _, f := range flags {
+		for _, n := range f.Names() {
+			if n == name {
+				return f
+			}
+		}
+	}
+
+	return nil
+}
+
+// keyOptions reads the --name, --expires and --rotate-after flags of a new
+// key
+func (h *Handler) keyOptions(c *cli.Context) (keeper.ProviderKeyOptions, error) {
+	opts := keeper.ProviderKeyOptions{Name: c.String("name")}
+	now := time.Now()
+
+	if v := c.String("expires"); v != "" {
+		t, err := parseKeyDate(v, now)
+		if err != nil {
+			return opts, log.Errorf("invalid --expires: %w", err)
+		}
+		opts.ExpiresAt = t
+	}
+
+	rotateAfter := c.String("rotate-after")
+	if rotateAfter == "" {
+		rotateAfter = h.opts.RotateAfter
+	}
+
+	if rotateAfter != "" {
+		t, err := parseKeyDate(rotateAfter, now)
+		if err != nil {
+			return opts, log.Errorf("invalid rotation date: %w", err)
+		}
+		opts.RotateAfter = t
+	}
+
+	if !opts.ExpiresAt.IsZero() && !opts.ExpiresAt.After(now) {
+		return opts, log.Errorf("the key would already be expired")
+	}
+
+	return opts, nil
+}
+
+// parseKeyDate reads a date (2027-01-01, local midnight), a timestamp in
+// RFC 3339 or a period from now (90d, 12h)
+func parseKeyDate(value string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	d, err := parsePeriod(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a date nor a period", value)
+	}
+
+	return now.Add(d), nil
+}
+
+// parsePeriod is time.ParseDuration that also takes whole days, e.g. 30d
+func parsePeriod(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid period %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// keyTime reads a date stored by the repository, false when empty
+func keyTime(value string) (time.Time, bool) {
+	t, err := time.ParseInLocation(time.DateTime, value, time.UTC)
+	return t, err == nil
+}
+
+func (h *Handler) listKeys(c *cli.Context) error {
+	keys, err := h.keeper.ListProviderKeys(c.Context)
+	if err != nil {
+		return log.Errorf("error listing keys: %w", err)
+	}
+
+	provider := c.Args().First()
+
+	var horizon time.Time
+	if v := c.String("expiring"); v != "" {
+		d, err := parsePeriod(v)
+		if err != nil {
+			return log.Errorf("invalid --expiring: %w", err)
+		}
+		horizon = time.Now().Add(d)
+	}
+
+	for _, k := range keys {
+		if provider != "" && k.ProviderName != provider {
+			continue
+		}
+
+		if !horizon.IsZero() && !keyDueBefore(k, horizon) {
+			continue
+		}
+
+		state := "active"
+		if !k.IsActive {
+			state = "disabled"
+		}
+
+		checked := "never checked"
+		if k.LastCheckedAt != "" {
+			checked = "checked " + k.LastCheckedAt
+		}
+
+		if until, ok := keyTime(k.CooldownUntil); ok && until.After(time.Now()) {
+			state += ", cooling down until " + until.Local().Format(time.DateTime)
+		}
+
+		if expires, ok := keyTime(k.ExpiresAt); ok {
+			if expires.After(time.Now()) {
+				state += ", expires " + expires.Local().Format(time.DateOnly)
+			} else {
+				state += ", expired " + expires.Local().Format(time.DateOnly)
+			}
+		}
+
+		if rotate, ok := keyTime(k.RotateAfter); ok {
+			state += ", rotate after " + rotate.Local().Format(time.DateOnly)
+		}
+
+		log.Infof("%s: %s (#%d) %s, %s, %s", k.ProviderName, k.Name, k.ID, state, k.Status, checked)
+	}
+
+	return nil
+}
+
+// verifyKeys checks every active key, or those of one provider, and records
+// the outcome. Keys found invalid or revoked are skipped by the proxy.
+func (h *Handler) verifyKeys(c *cli.Context) error {
+	keys, err := h.keeper.ListProviderKeys(c.Context)
+	if err != nil {
+		return log.Errorf("error listing keys: %w", err)
+	}
+
+	provider := c.Args().First()
+
+	var checked, failed int
+	for _, k := range keys {
+		if !k.Checked() || (provider != "" && k.ProviderName != provider) {
+			continue
+		}
+
+		key, err := h.keeper.GetProviderKey(c.Context, k.ID)
+		if err != nil {
+			return log.Errorf("error getting key: %w", err)
+		}
+
+		checked++
+
+		result, err := h.checkKey(c.Context, *key)
+		if err != nil {
+			failed++
+			log.Errorf("%s: %s (#%d) could not be checked: %v", k.ProviderName, k.Name, k.ID, err)
+			continue
+		}
+
+		if err := h.keeper.SetProviderKeyStatus(c.Context, k.ID, result.Status); err != nil {
+			return log.Errorf("error recording key status: %w", err)
+		}
+
+		if !result.Status.Usable() {
+			failed++
+		}
+
+		logKeyResult(k.ProviderName, k.Name, k.ID, result)
+	}
+
+	if checked == 0 {
+		if provider != "" {
+			return log.Errorf("no active keys for provider %s", provider)
+		}
+		return log.Errorf("no active keys")
+	}
+
+	if failed > 0 {
+		return log.Errorf("%d of %d keys failed verification", failed, checked)
+	}
+
+	return nil
+}
+
+// checkKey sends the registry's health check for the key's provider
+func (h *Handler) checkKey(ctx context.Context, key keeper.Provider) (keycheck.Result, error) {
+	provider, ok := h.registry.Provider(key.Name)
+	if !ok {
+		return keycheck.Result{}, fmt.Errorf("provider %s is not in the registry", key.Name)
+	}
+
+	secret, err := h.opts.Secrets.ResolveKey(ctx, key.ProviderKey)
+	if err != nil {
+		return keycheck.Result{}, fmt.Errorf("failed to resolve key: %w", err)
+	}
+
+	return h.checker.Check(ctx, provider, key.BaseURL, secret)
+}
+
+func logKeyResult(provider, name string, id int64, result keycheck.Result) {
+	if result.Detail != "" {
+		log.Infof("%s: %s (#%d) %s: %s", provider, name, id, result.Status, result.Detail)
+		return
+	}
+
+	log.Infof("%s: %s (#%d) %s", provider, name, id, result.Status)
+}
+
+// keyDueBefore reports whether the key expires or is due for rotation
+// before t
+func keyDueBefore(k keeper.ProviderKeyInfo, t time.Time) bool {
+	if expires, ok := keyTime(k.ExpiresAt); ok && expires.Before(t) {
+		return true
+	}
+
+	rotate, ok := keyTime(k.RotateAfter)
+	return ok && rotate.Before(t)
+}
+
+// warnKeyDates warns about active keys that expire or are due for rotation
+// soon, and about keys that expired recently. A key that expired long ago
+// is left to `keeper key list`.
+func (h *Handler) warnKeyDates(ctx context.Context) {
+	keys, err := h.keeper.ListProviderKeys(ctx)
+	if err != nil {
+		log.Errorf("failed to list keys: %v", err)
+		return
+	}
+
+	now := time.Now()
+
+	for _, k := range keys {
+		if !k.IsActive {
+			continue
+		}
+
+		if expires, ok := keyTime(k.ExpiresAt); ok && expires.Before(now.Add(expiryWarning)) {
+			switch {
+			case expires.Before(now.Add(-expiryWarning)):
+				// not worth a warning on every status any more
+			case expires.After(now):
+				log.Infof("Warning: key %s (#%d) of %s expires on %s", k.Name, k.ID, k.ProviderName, expires.Local().Format(time.DateOnly))
+			default:
+				log.Infof("Warning: key %s (#%d) of %s expired on %s and is no longer used", k.Name, k.ID, k.ProviderName, expires.Local().Format(time.DateOnly))
+			}
+			continue
+		}
+
+		if rotate, ok := keyTime(k.RotateAfter); ok && rotate.Before(now.Add(expiryWarning)) {
+			log.Infof("Warning: key %s (#%d) of %s is due for rotation on %s", k.Name, k.ID, k.ProviderName, rotate.Local().Format(time.DateOnly))
+		}
+	}
+}
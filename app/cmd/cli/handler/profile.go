@@ -0,0 +1,94 @@
+package cli
+
+import (
+	log "keeper/internal/logger"
+	"keeper/services/keeper"
+
+	"github.com/urfave/cli/v2"
+)
+
+func (h *Handler) listProfiles(c *cli.Context) error {
+	profiles, err := h.keeper.ListProfiles(c.Context)
+	if err != nil {
+		return log.Errorf("error listing profiles: %w", err)
+	}
+
+	for _, p := range profiles {
+		marker := " "
+		if p.IsActive {
+			marker = "*"
+		}
+
+		log.Infof("%s %s", marker, p.Name)
+	}
+
+	return nil
+}
+
+func (h *Handler) createProfile(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		return log.Errorf("profile name is required")
+	}
+
+	profiles, err := h.keeper.ListProfiles(c.Context)
+	if err != nil {
+		return log.Errorf("error listing profiles: %w", err)
+	}
+
+	for _, p := range profiles {
+		if p.Name == name {
+			return log.Errorf("profile %s already exists", name)
+		}
+	}
+
+	settings, err := h.keeper.GetActiveProfileSettingsWithKey(c.Context)
+	if err != nil {
+		return log.Errorf("error getting active profile settings: %w", err)
+	}
+
+	id, err := h.keeper.CreateProfile(c.Context, keeper.CreateProfileReq{Name: name})
+	if err != nil {
+		return log.Errorf("error creating profile: %w", err)
+	}
+
+	if _, err := h.keeper.CreateProfileSettings(c.Context, keeper.ProfileSettings{
+		ProfileID:  id,
+		ProviderID: settings.ProviderID,
+	}); err != nil {
+		return log.Errorf("error creating profile settings: %w", err)
+	}
+
+	log.Infof("profile %s created", name)
+
+	return nil
+}
+
+// useProfile switches the active profile, through the running server when
+// there is one so the change applies immediately.
+func (h *Handler) useProfile(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		return log.Errorf("profile name is required")
+	}
+
+	if info, err := h.getRunningServerInfo(); err == nil {
+		if admin, ok := h.adminClient(info); ok {
+			if err := admin.SetProfile(c.Context, name); err != nil {
+				return log.Errorf("error switching profile: %w", err)
+			}
+
+			log.Infof("switched to profile %s", name)
+
+			return nil
+		}
+	}
+
+	if err := h.keeper.SetActiveProfile(c.Context, name); err != nil {
+		return log.Errorf("error switching profile: %w", err)
+	}
+
+	log.Infof("switched to profile %s", name)
+
+	return nil
+}
@@ -1,15 +1,24 @@
 package cli
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"keeper/internal/certs"
+	"keeper/internal/database"
 	log "keeper/internal/logger"
+	"keeper/services/cassette"
+	"keeper/services/proxy"
 
 	"github.com/urfave/cli/v2"
 )
@@ -17,17 +26,42 @@ import (
 const (
 	lockFile    = "keeper.lock"
 	processFile = "process.json"
+
+	detachedStartTimeout = 5 * time.Second
 )
 
 type ProcessInfo struct {
-	PID        int       `json:"pid"`
-	StartTime  time.Time `json:"start_time"`
-	IsDetached bool      `json:"is_detached"`
-	Port       string    `json:"port"`
+	PID         int       `json:"pid"`
+	StartTime   time.Time `json:"start_time"`
+	IsDetached  bool      `json:"is_detached"`
+	Port        string    `json:"port"`
+	Bind        string    `json:"bind"`
+	Socket      string    `json:"socket,omitempty"`
+	AdminSocket string    `json:"admin_socket,omitempty"`
+	TLS         bool      `json:"tls"`
+	Cassette    string    `json:"cassette,omitempty"`
+	// CassetteMode is record or replay
+	CassetteMode string `json:"cassette_mode,omitempty"`
+}
+
+// URL is the base URL clients use to reach the server over TCP
+func (p ProcessInfo) URL() string {
+	scheme := "http"
+	if p.TLS {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(p.Bind, p.Port))
 }
 
 func (h *Handler) startServer(c *cli.Context) error {
-	addr := fmt.Sprintf(":%s", c.String("port"))
+	opts := proxy.ListenOptions{
+		Addr:        net.JoinHostPort(c.String("bind"), c.String("port")),
+		Socket:      c.String("socket"),
+		Retries:     c.Int("retry"),
+		RetryDelay:  c.Duration("retry-delay"),
+		MetricsAddr: c.String("metrics-addr"),
+	}
 	detached := c.Bool("detached")
 
 	if info, err := h.getRunningServerInfo(); err == nil {
@@ -35,27 +69,98 @@ func (h *Handler) startServer(c *cli.Context) error {
 	}
 
 	if detached {
-		return h.startDetached(addr)
+		return h.startDetached(c)
 	}
 
+	if c.Bool("tls") {
+		dir, err := h.tlsDir()
+		if err != nil {
+			return err
+		}
+
+		if opts.TLS, err = certs.ServerConfig(dir); err != nil {
+			return log.Errorf("error loading TLS certificate: %w", err)
+		}
+	}
+
+	cassettePath, mode, err := cassetteFlags(c)
+	if err != nil {
+		return err
+	}
+
+	if mode != 0 {
+		closeCassette, err := h.useCassette(cassettePath, mode, c.String("match"))
+		if err != nil {
+			return err
+		}
+
+		defer closeCassette()
+	}
+
+	responses, closeCache, err := h.openCache(true)
+	if err != nil {
+		return err
+	}
+
+	defer closeCache()
+
+	h.proxyService.UseCache(responses)
+
 	if err := h.acquireLock(); err != nil {
 		return log.Errorf("failed to acquire lock: %w", err)
 	}
 
 	defer h.releaseLock()
 
+	// bind before recording anything so the process file holds the address
+	// actually in use, e.g. the port picked for --port 0
+	addrs, err := h.proxyService.Listen(opts)
+	if err != nil {
+		return log.Errorf("error starting server: %v", err)
+	}
+
 	info := ProcessInfo{
 		PID:        os.Getpid(),
 		StartTime:  time.Now(),
 		IsDetached: false,
-		Port:       c.String("port"),
+		TLS:        opts.TLS != nil,
+	}
+
+	if mode != 0 {
+		info.Cassette, info.CassetteMode = cassettePath, mode.String()
+	}
+
+	// record an absolute path so the CLI reaches the socket from any directory
+	if h.opts.AdminSocket != "" {
+		if info.AdminSocket, err = filepath.Abs(h.opts.AdminSocket); err != nil {
+			return log.Errorf("failed to resolve admin socket path: %w", err)
+		}
+	}
+
+	for _, addr := range addrs {
+		switch a := addr.(type) {
+		case *net.TCPAddr:
+			info.Bind, info.Port = a.IP.String(), strconv.Itoa(a.Port)
+		case *net.UnixAddr:
+			info.Socket, _ = filepath.Abs(a.Name)
+		}
 	}
 
 	if err := h.writeProcessInfo(info); err != nil {
 		return log.Errorf("failed to write process info: %w", err)
 	}
 
-	if err := h.proxyService.Start(addr); err != nil {
+	h.stopOnSignal()
+
+	ctx, cancel := context.WithCancel(c.Context)
+	defer cancel()
+
+	// a repository kept in memory has no database to back up
+	if h.opts.DB != nil {
+		database.BackupSchedule(ctx, h.opts.DB, h.opts.Backup)
+	}
+
+	if err := h.proxyService.Serve(); err != nil {
 		os.Remove(processFile)
 		return log.Errorf("error starting server: %v", err)
 	}
@@ -91,6 +196,12 @@ func (h *Handler) stopServer(c *cli.Context) error {
 }
 
 func (h *Handler) statusServer(c *cli.Context) error {
+	if opts, err := h.dirEnvOptions(envOptions{}); err == nil && opts.Dir != nil {
+		log.Infof("Directory profile: %s (from %s)", opts.Dir.Profile, opts.Dir.Path)
+	}
+
+	h.warnKeyDates(c.Context)
+
 	info, err := h.getRunningServerInfo()
 	if err != nil {
 		log.Infof("server is not running")
@@ -101,11 +212,187 @@ func (h *Handler) statusServer(c *cli.Context) error {
 	log.Infof("  PID: %d", info.PID)
 	log.Infof("  Start Time: %s", info.StartTime.Format(time.RFC3339))
 	log.Infof("  Detached: %t", info.IsDetached)
-	log.Infof("  Port: %s", info.Port)
+	log.Infof("  URL: %s", info.URL())
+	if info.Socket != "" {
+		log.Infof("  Socket: %s", info.Socket)
+	}
+	if info.Cassette != "" {
+		log.Infof("  Cassette: %s (%s)", info.Cassette, info.CassetteMode)
+	}
+
+	admin, ok := h.adminClient(info)
+	if !ok {
+		return nil
+	}
+
+	status, err := admin.Status(c.Context)
+	if err != nil {
+		log.Errorf("failed to get live status: %v", err)
+		return nil
+	}
+
+	log.Infof("  Uptime: %s", status.Uptime)
+	log.Infof("  Requests: %d (%d errors)", status.Requests, status.Errors)
+	log.Infof("  Profile: %s", status.Profile)
+	log.Infof("  Provider: %s", status.Provider)
+	log.Infof("  Key: %s", status.Key)
+
+	return nil
+}
+
+func (h *Handler) showUsage(c *cli.Context) error {
+	info, err := h.getRunningServerInfo()
+	if err != nil {
+		return log.Errorf("server is not running")
+	}
+
+	admin, ok := h.adminClient(info)
+	if !ok {
+		return log.Errorf("server does not expose an admin API")
+	}
+
+	usage, err := admin.Usage(c.Context)
+	if err != nil {
+		return log.Errorf("failed to get usage: %w", err)
+	}
+
+	if len(usage) == 0 {
+		log.Infof("no requests served yet")
+		return nil
+	}
+
+	for _, u := range usage {
+		log.Infof("%s/%s/%s: %d requests, %d errors, last used %s",
+			u.Profile, u.Provider, u.Key, u.Requests, u.Errors, u.LastUsedAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func (h *Handler) reloadServer(c *cli.Context) error {
+	info, err := h.getRunningServerInfo()
+	if err != nil {
+		return log.Errorf("server is not running")
+	}
+
+	if admin, ok := h.adminClient(info); ok {
+		status, err := admin.Reload(c.Context)
+		if err != nil {
+			return log.Errorf("failed to reload server: %w", err)
+		}
+
+		log.Infof("Server reloaded: profile %s, provider %s", status.Profile, status.Provider)
+
+		return nil
+	}
+
+	process, err := os.FindProcess(info.PID)
+	if err != nil {
+		return log.Errorf("failed to find process: %w", err)
+	}
+
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		return log.Errorf("failed to send reload signal: %w", err)
+	}
+
+	log.Infof("Reload requested for server (PID: %d)", info.PID)
 
 	return nil
 }
 
+// cassetteFlags returns the absolute path of the cassette given with --record
+// or --replay and the mode it is used in, 0 when there is none.
+func cassetteFlags(c *cli.Context) (string, proxy.CassetteMode, error) {
+	record, replay := c.String("record"), c.String("replay")
+
+	var path string
+	var mode proxy.CassetteMode
+
+	switch {
+	case record != "" && replay != "":
+		return "", 0, log.Errorf("--record and --replay cannot be used together")
+	case record != "":
+		path, mode = record, proxy.Record
+	case replay != "":
+		path, mode = replay, proxy.Replay
+	default:
+		return "", 0, nil
+	}
+
+	// the detached server runs from the same directory, but the process file
+	// is read from anywhere
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", 0, log.Errorf("failed to resolve cassette path: %w", err)
+	}
+
+	return abs, mode, nil
+}
+
+// useCassette opens the cassette at path and hands it to the proxy. The
+// returned func closes it once the server is done.
+func (h *Handler) useCassette(path string, mode proxy.CassetteMode, match string) (func(), error) {
+	if mode == proxy.Replay {
+		if _, err := os.Stat(path); err != nil {
+			return nil, log.Errorf("cannot replay %s: %w", path, err)
+		}
+	}
+
+	db, err := database.NewSQLite(database.Options{Database: path})
+	if err != nil {
+		return nil, log.Errorf("failed to open cassette: %w", err)
+	}
+
+	repo, err := cassette.NewSQLite(db)
+	if err != nil {
+		db.Close()
+		return nil, log.Errorf("failed to create cassette repository: %w", err)
+	}
+
+	var fields []string
+	for _, f := range strings.Split(match, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+
+	if err := h.proxyService.UseCassette(repo, proxy.CassetteOptions{Mode: mode, Match: fields}); err != nil {
+		db.Close()
+		return nil, log.Errorf("failed to use cassette: %w", err)
+	}
+
+	return func() { db.Close() }, nil
+}
+
+// adminClient returns a client for the admin API of the running server, if it
+// exposes one.
+func (h *Handler) adminClient(info *ProcessInfo) (*proxy.AdminClient, bool) {
+	if info.AdminSocket == "" {
+		return nil, false
+	}
+
+	if _, err := os.Stat(info.AdminSocket); err != nil {
+		return nil, false
+	}
+
+	return proxy.NewAdminClient(info.AdminSocket), true
+}
+
+// stopOnSignal shuts the proxy down gracefully when the process is asked to
+// terminate, so deferred cleanup such as releasing the lock still runs.
+func (h *Handler) stopOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		<-sig
+
+		if err := h.proxyService.Stop(); err != nil {
+			log.Errorf("failed to stop server: %v", err)
+		}
+	}()
+}
+
 func (h *Handler) getRunningServerInfo() (*ProcessInfo, error) {
 	data, err := os.ReadFile(processFile)
 	if err != nil {
@@ -142,8 +429,33 @@ func (h *Handler) writeProcessInfo(info ProcessInfo) error {
 	return os.WriteFile(processFile, data, 0644)
 }
 
-func (h *Handler) startDetached(addr string) error {
-	cmd := exec.Command(os.Args[0], "start", "--port", strings.TrimPrefix(addr, ":"))
+func (h *Handler) startDetached(c *cli.Context) error {
+	args := []string{
+		"start",
+		"--port", c.String("port"),
+		"--bind", c.String("bind"),
+		"--retry", strconv.Itoa(c.Int("retry")),
+		"--retry-delay", c.Duration("retry-delay").String(),
+	}
+	if socket := c.String("socket"); socket != "" {
+		args = append(args, "--socket", socket)
+	}
+	if c.Bool("tls") {
+		args = append(args, "--tls")
+	}
+	if addr := c.String("metrics-addr"); addr != "" {
+		args = append(args, "--metrics-addr", addr)
+	}
+
+	path, mode, err := cassetteFlags(c)
+	if err != nil {
+		return err
+	}
+	if mode != 0 {
+		args = append(args, "--"+mode.String(), path, "--match", c.String("match"))
+	}
+
+	cmd := exec.Command(os.Args[0], args...)
 	cmd.Stdout = nil
 	cmd.Stderr = nil
 
@@ -151,19 +463,48 @@ func (h *Handler) startDetached(addr string) error {
 		return log.Errorf("failed to start detached process: %w", err)
 	}
 
-	// wait a short time to allow the child process to start and write its info
-	time.Sleep(100 * time.Millisecond)
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
 
-	info, err := h.getRunningServerInfo()
-	if err == nil {
-		info.IsDetached = true
-		if err := h.writeProcessInfo(*info); err != nil {
-			log.Errorf("failed to update process info: %v", err)
-		}
-		log.Infof("Server started in detached mode. PID: %d, Port: %s\n", info.PID, info.Port)
-	} else {
-		log.Errorf("Server started in detached mode, but unable to read process info: %v", err)
+	timeout := detachedStartTimeout + c.Duration("retry-delay")*time.Duration(c.Int("retry"))
+
+	info, err := h.waitForServer(cmd.Process.Pid, exited, timeout)
+	if err != nil {
+		return log.Errorf("server started in detached mode, but unable to read process info: %w", err)
 	}
 
+	info.IsDetached = true
+	if err := h.writeProcessInfo(*info); err != nil {
+		log.Errorf("failed to update process info: %v", err)
+	}
+
+	log.Infof("Server started in detached mode. PID: %d, URL: %s\n", info.PID, info.URL())
+
 	return nil
 }
+
+// waitForServer polls the process file until the child with the given PID
+// has bound its listeners and recorded them.
+func (h *Handler) waitForServer(pid int, exited <-chan error, timeout time.Duration) (*ProcessInfo, error) {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		info, err := h.getRunningServerInfo()
+		if err == nil && info.PID == pid {
+			return info, nil
+		}
+
+		select {
+		case err := <-exited:
+			// most likely the child could not bind its listeners
+			return nil, fmt.Errorf("server process exited (%v), see the log for details", err)
+		case <-deadline:
+			return nil, fmt.Errorf("timed out waiting for server to start")
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"keeper/internal/certs"
+	log "keeper/internal/logger"
+
+	"github.com/urfave/cli/v2"
+)
+
+func (h *Handler) tlsInit(c *cli.Context) error {
+	dir, err := h.tlsDir()
+	if err != nil {
+		return err
+	}
+
+	paths, err := certs.Init(dir, c.Bool("force"))
+	if err != nil {
+		return log.Errorf("error creating certificates: %w", err)
+	}
+
+	log.Infof("Created local CA %s", paths.CACert)
+	log.Infof("Created certificate for localhost %s", paths.Cert)
+	log.Infof("Run 'keeper start --tls' to serve HTTPS and 'keeper tls trust-info' to trust the CA")
+
+	return nil
+}
+
+func (h *Handler) tlsTrustInfo(c *cli.Context) error {
+	dir, err := h.tlsDir()
+	if err != nil {
+		return err
+	}
+
+	paths := certs.PathsIn(dir)
+
+	fingerprint, err := certs.Fingerprint(paths.CACert)
+	if err != nil {
+		return log.Errorf("error reading CA certificate, run 'keeper tls init' first: %w", err)
+	}
+
+	log.Infof("CA certificate: %s", paths.CACert)
+	log.Infof("SHA-256 fingerprint: %s", fingerprint)
+	log.Infof("Point your tools at it, e.g. NODE_EXTRA_CA_CERTS, SSL_CERT_FILE or REQUESTS_CA_BUNDLE")
+
+	return nil
+}
+
+func (h *Handler) tlsDir() (string, error) {
+	if h.opts.TLSDir != "" {
+		return h.opts.TLSDir, nil
+	}
+
+	dir, err := certs.DefaultDir()
+	if err != nil {
+		return "", log.Errorf("error locating TLS directory: %w", err)
+	}
+
+	return dir, nil
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"fmt"
 	cli "keeper/cmd/cli/handler"
 	"keeper/internal/database"
 	log "keeper/internal/logger"
 	provider_registry "keeper/internal/provider-registry"
+	"keeper/internal/tracing"
 	"keeper/services/keeper"
+	"keeper/services/mock"
 	"keeper/services/proxy"
+	"keeper/services/vault"
+	"os"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
@@ -23,9 +28,65 @@ type config struct {
 	Database struct {
 		Name string `envconfig:"DATABASE_NAME" default:"keeper.db"`
 	}
+	Cache struct {
+		// Database is under the user cache dir when empty
+		Database string        `envconfig:"CACHE_DATABASE_NAME"`
+		TTL      time.Duration `envconfig:"CACHE_TTL" default:"24h"`
+	}
+	Mock struct {
+		Config string `envconfig:"MOCK_CONFIG"`
+	}
+	Tracing struct {
+		// Exporter is none, file or otlp
+		Exporter    string `envconfig:"TRACING_EXPORTER" default:"none"`
+		File        string `envconfig:"TRACING_FILE" default:"keeper-traces.jsonl"`
+		Endpoint    string `envconfig:"OTEL_EXPORTER_OTLP_ENDPOINT" default:"http://localhost:4318"`
+		ServiceName string `envconfig:"OTEL_SERVICE_NAME" default:"keeper"`
+	}
+	Proxy struct {
+		ReloadInterval time.Duration `envconfig:"PROXY_RELOAD_INTERVAL" default:"1s"`
+		// KeyCheckInterval re-validates active keys in the background, 0 disables it
+		KeyCheckInterval time.Duration `envconfig:"KEY_CHECK_INTERVAL" default:"15m"`
+	}
+	Keys struct {
+		// RotateAfter is the rotation period given to new keys, e.g. 90d
+		RotateAfter string `envconfig:"KEY_ROTATE_AFTER"`
+		// SecretCacheTTL is how long a key resolved from a reference is reused
+		SecretCacheTTL time.Duration `envconfig:"SECRET_CACHE_TTL" default:"5m"`
+	}
+	Vault struct {
+		// Addr enables vault: key references, e.g. https://vault.example.com:8200
+		Addr  string `envconfig:"VAULT_ADDR"`
+		Token string `envconfig:"VAULT_TOKEN"`
+		// RoleID and SecretID log in with AppRole instead of a token
+		RoleID       string `envconfig:"VAULT_ROLE_ID"`
+		SecretID     string `envconfig:"VAULT_SECRET_ID"`
+		AppRoleMount string `envconfig:"VAULT_APPROLE_MOUNT" default:"approle"`
+		Namespace    string `envconfig:"VAULT_NAMESPACE"`
+	}
+	Backup struct {
+		Dir string `envconfig:"BACKUP_DIR" default:"keeper-backups"`
+		// Interval turns on automatic backups while the server runs, e.g. 24h
+		Interval time.Duration `envconfig:"BACKUP_INTERVAL" default:"0"`
+		// Retain is how many automatic backups are kept
+		Retain int `envconfig:"BACKUP_RETAIN" default:"7"`
+	}
+	Admin struct {
+		Socket string `envconfig:"ADMIN_SOCKET" default:"keeper-admin.sock"`
+	}
+	TLS struct {
+		Dir string `envconfig:"TLS_DIR"`
+	}
 }
 
 func main() {
+	// run returns only after its deferred cleanup, a failed command must
+	// fail the script running it
+	os.Exit(run())
+}
+
+// run runs the command and returns the process exit code
+func run() int {
 	ctx := context.Background()
 
 	var cfg config
@@ -60,7 +121,89 @@ func main() {
 		log.Fatalf("failed to seed database: %v", err)
 	}
 
-	proxyService := proxy.New(repo)
+	if err := database.Migrate(ctx, db); err != nil {
+		log.Fatalf("failed to migrate database: %v", err)
+	}
+
+	mockCfg, err := mock.Load(cfg.Mock.Config)
+	if err != nil {
+		log.Fatalf("failed to load mock provider config: %v", err)
+	}
+
+	mockServer, err := mock.New(mockCfg)
+	if err != nil {
+		log.Fatalf("failed to create mock provider: %v", err)
+	}
 
-	cli.New(repo, proxyService).Run()
+	tracer, err := newTracer(cfg)
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
+	}
+
+	defer tracer.Close()
+
+	secrets := keeper.NewSecretResolver(cfg.Keys.SecretCacheTTL)
+
+	if cfg.Vault.Addr != "" {
+		vaultClient, err := vault.New(vault.Options{
+			Addr:         cfg.Vault.Addr,
+			Token:        cfg.Vault.Token,
+			RoleID:       cfg.Vault.RoleID,
+			SecretID:     cfg.Vault.SecretID,
+			AppRoleMount: cfg.Vault.AppRoleMount,
+			Namespace:    cfg.Vault.Namespace,
+		})
+		if err != nil {
+			log.Fatalf("failed to set up Vault: %v", err)
+		}
+
+		defer vaultClient.Close()
+
+		secrets.Register("vault", vaultClient)
+	}
+
+	proxyService := proxy.New(repo, reg, proxy.Options{
+		ReloadInterval:   cfg.Proxy.ReloadInterval,
+		AdminSocket:      cfg.Admin.Socket,
+		CacheTTL:         cfg.Cache.TTL,
+		Mock:             mockServer,
+		Tracer:           tracer,
+		KeyCheckInterval: cfg.Proxy.KeyCheckInterval,
+		Secrets:          secrets,
+	})
+
+	err = cli.New(repo, reg, proxyService, cli.Options{
+		AdminSocket:   cfg.Admin.Socket,
+		TLSDir:        cfg.TLS.Dir,
+		CacheDatabase: cfg.Cache.Database,
+		RotateAfter:   cfg.Keys.RotateAfter,
+		Secrets:       secrets,
+		DB:            db,
+		Backup: database.BackupOptions{
+			Dir:      cfg.Backup.Dir,
+			Interval: cfg.Backup.Interval,
+			Retain:   cfg.Backup.Retain,
+		},
+	}).Run()
+
+	// the error was logged where it happened
+	return cli.ExitCode(err)
+}
+
+// newTracer creates the tracer for the configured exporter, nil when tracing
+// is off
+func newTracer(cfg config) (*tracing.Tracer, error) {
+	switch cfg.Tracing.Exporter {
+	case "", "none":
+		return nil, nil
+
+	case "file":
+		return tracing.New(cfg.Tracing.ServiceName, tracing.NewFileExporter(cfg.Tracing.File)), nil
+
+	case "otlp":
+		return tracing.New(cfg.Tracing.ServiceName, tracing.NewOTLPExporter(cfg.Tracing.Endpoint)), nil
+
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q, expected none, file or otlp", cfg.Tracing.Exporter)
+	}
 }
@@ -0,0 +1,212 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 397 * 24 * time.Hour // the most clients accept for a leaf
+)
+
+// Paths locates the CA and leaf files inside a keeper TLS directory
+type Paths struct {
+	CACert string
+	CAKey  string
+	Cert   string
+	Key    string
+}
+
+func PathsIn(dir string) Paths {
+	return Paths{
+		CACert: filepath.Join(dir, "ca.pem"),
+		CAKey:  filepath.Join(dir, "ca-key.pem"),
+		Cert:   filepath.Join(dir, "localhost.pem"),
+		Key:    filepath.Join(dir, "localhost-key.pem"),
+	}
+}
+
+// DefaultDir is the TLS directory under the user's config dir
+func DefaultDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate config dir: %w", err)
+	}
+
+	return filepath.Join(dir, "keeper", "tls"), nil
+}
+
+// Init creates a local CA and a leaf certificate for localhost signed by it.
+// Existing files are kept unless force is set.
+func Init(dir string, force bool) (Paths, error) {
+	paths := PathsIn(dir)
+
+	if !force {
+		if _, err := os.Stat(paths.CACert); err == nil {
+			return paths, fmt.Errorf("certificates already exist in %s", dir)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return paths, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return paths, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+
+	now := time.Now()
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{Organization: []string{"keeper"}, CommonName: "keeper local CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return paths, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return paths, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return paths, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	leafTemplate := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{Organization: []string{"keeper"}, CommonName: "localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		return paths, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	if err := writeKey(paths.CAKey, caKey); err != nil {
+		return paths, err
+	}
+
+	if err := writeCert(paths.CACert, caDER); err != nil {
+		return paths, err
+	}
+
+	if err := writeKey(paths.Key, leafKey); err != nil {
+		return paths, err
+	}
+
+	if err := writeCert(paths.Cert, leafDER); err != nil {
+		return paths, err
+	}
+
+	return paths, nil
+}
+
+// ServerConfig loads the leaf certificate from dir for serving HTTPS
+func ServerConfig(dir string) (*tls.Config, error) {
+	paths := PathsIn(dir)
+
+	cert, err := tls.LoadX509KeyPair(paths.Cert, paths.Key)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no certificate in %s, run 'keeper tls init' first", dir)
+		}
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the PEM certificate at path
+func Fingerprint(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("%s does not contain a certificate", path)
+	}
+
+	sum := sha256.Sum256(block.Bytes)
+
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":"), nil
+}
+
+func serialNumber() *big.Int {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+
+	return n
+}
+
+func writeCert(path string, der []byte) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,317 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"keeper/internal/logger"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// autoBackupPrefix names the backups BackupSchedule takes, only those
+	// are pruned
+	autoBackupPrefix = "keeper-auto-"
+	// backupTimeFormat sorts backups by name in the order they were taken
+	backupTimeFormat = "20060102-150405"
+)
+
+// Backup copies db to a new file at dest with SQLite's online backup API,
+// writers are not blocked for longer than copying takes. The file is
+// written next to dest first, an interrupted backup leaves no partial file.
+func Backup(ctx context.Context, db *sql.DB, dest string) error {
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+
+	tmp := dest + ".tmp"
+
+	// create the file before SQLite does, the backup holds every key
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	defer os.Remove(tmp)
+
+	destDB, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	if err := copyDatabase(ctx, destDB, db); err != nil {
+		return err
+	}
+
+	if err := destDB.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dest)
+}
+
+// Restore replaces the contents of db with the backup at src after
+// verifying the backup. Connections to db, e.g. a running server's, see the
+// restored data on their next query.
+func Restore(ctx context.Context, db *sql.DB, src string) error {
+	srcDB, err := openBackup(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer srcDB.Close()
+
+	return copyDatabase(ctx, db, srcDB)
+}
+
+// VerifyBackup tells whether src is a sound keeper database Restore accepts
+func VerifyBackup(ctx context.Context, src string) error {
+	srcDB, err := openBackup(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	return srcDB.Close()
+}
+
+func openBackup(ctx context.Context, src string) (*sql.DB, error) {
+	if _, err := os.Stat(src); err != nil {
+		return nil, err
+	}
+
+	// read only, a mistyped path must not create an empty database
+	db, err := sql.Open("sqlite3", "file:"+src+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+
+	if shouldSeed(db) {
+		db.Close()
+		return nil, fmt.Errorf("%s is not a keeper database", src)
+	}
+
+	problems, err := Check(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to check %s: %w", src, err)
+	}
+
+	if len(problems) > 0 {
+		db.Close()
+		return nil, fmt.Errorf("%s is damaged: %s", src, strings.Join(problems, "; "))
+	}
+
+	return db, nil
+}
+
+// copyDatabase overwrites dest with src through the backup API
+func copyDatabase(ctx context.Context, dest, src *sql.DB) error {
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriver any) error {
+		return srcConn.Raw(func(srcDriver any) error {
+			d, ok := destDriver.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("backup needs a SQLite connection")
+			}
+
+			s, ok := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("backup needs a SQLite connection")
+			}
+
+			backup, err := d.Backup("main", s, "main")
+			if err != nil {
+				return err
+			}
+
+			// -1 copies every page in one step
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+
+			return backup.Finish()
+		})
+	})
+}
+
+// Check runs SQLite's integrity check and validates foreign keys, it
+// returns the problems found, none when the database is sound
+func Check(ctx context.Context, db *sql.DB) ([]string, error) {
+	var problems []string
+
+	rows, err := db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return nil, err
+		}
+
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	fkRows, err := db.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		return nil, err
+	}
+	defer fkRows.Close()
+
+	for fkRows.Next() {
+		var table, parent string
+		var rowID sql.NullInt64
+		var fkID int
+		if err := fkRows.Scan(&table, &rowID, &parent, &fkID); err != nil {
+			return nil, err
+		}
+
+		problems = append(problems, fmt.Sprintf("row %d of %s refers to a missing row of %s", rowID.Int64, table, parent))
+	}
+
+	if err := fkRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return problems, nil
+}
+
+// BackupName names a backup taken at t, the prefix tells automatic backups
+// from others
+func BackupName(prefix string, t time.Time) string {
+	return prefix + t.UTC().Format(backupTimeFormat) + ".db"
+}
+
+// BackupOptions configures BackupSchedule
+type BackupOptions struct {
+	// Dir holds the backups
+	Dir string
+	// Interval is the time between backups
+	Interval time.Duration
+	// Retain is how many automatic backups are kept, all when zero
+	Retain int
+}
+
+// BackupSchedule backs db up into opts.Dir every opts.Interval until ctx is
+// done and prunes automatic backups beyond opts.Retain. The first backup is
+// taken once Interval has passed since the newest one in Dir, restarts
+// neither skip nor repeat a backup.
+func BackupSchedule(ctx context.Context, db *sql.DB, opts BackupOptions) {
+	if opts.Interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			wait := time.Until(lastAutoBackup(opts.Dir).Add(opts.Interval))
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+
+			path, err := AutoBackup(ctx, db, opts)
+			if err != nil {
+				logger.Errorf("failed to back up database: %v", err)
+
+				// retry later rather than in a loop
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(opts.Interval):
+				}
+				continue
+			}
+
+			logger.Infof("Backed up database to %s", path)
+		}
+	}()
+}
+
+// AutoBackup takes an automatic backup into opts.Dir and prunes old ones
+func AutoBackup(ctx context.Context, db *sql.DB, opts BackupOptions) (string, error) {
+	if err := os.MkdirAll(opts.Dir, 0o700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(opts.Dir, BackupName(autoBackupPrefix, time.Now()))
+	if err := Backup(ctx, db, path); err != nil {
+		return "", err
+	}
+
+	if opts.Retain > 0 {
+		backups := autoBackups(opts.Dir)
+		for _, old := range backups[:max(0, len(backups)-opts.Retain)] {
+			if err := os.Remove(filepath.Join(opts.Dir, old)); err != nil {
+				logger.Errorf("failed to remove old backup %s: %v", old, err)
+			}
+		}
+	}
+
+	return path, nil
+}
+
+// autoBackups lists the automatic backups in dir, oldest first
+func autoBackups(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), autoBackupPrefix) && strings.HasSuffix(e.Name(), ".db") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// lastAutoBackup returns when the newest automatic backup in dir was taken,
+// the zero time when there is none
+func lastAutoBackup(dir string) time.Time {
+	backups := autoBackups(dir)
+	if len(backups) == 0 {
+		return time.Time{}
+	}
+
+	stamp := strings.TrimSuffix(strings.TrimPrefix(backups[len(backups)-1], autoBackupPrefix), ".db")
+
+	t, err := time.Parse(backupTimeFormat, stamp)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
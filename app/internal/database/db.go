@@ -5,6 +5,10 @@ import (
 	"database/sql"
 	_ "embed"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"keeper/internal/logger"
 	provider_registry "keeper/internal/provider-registry"
@@ -16,24 +20,73 @@ import (
 //go:embed create-tables.sql
 var createTablesSQL string
 
+const (
+	// defaultMaxConns bounds the connection pool. The server's Watch holds
+	// one connection for as long as it runs, the others serve requests.
+	defaultMaxConns = 4
+	// defaultBusyTimeout is how long a write waits for another connection or
+	// process to finish its own before failing with "database is locked"
+	defaultBusyTimeout = 5 * time.Second
+)
+
 type Options struct {
 	Database string
+	// MaxConns bounds the connection pool, defaultMaxConns when zero. At
+	// least two are needed for a server to watch for changes.
+	MaxConns int
+	// BusyTimeout is defaultBusyTimeout when zero
+	BusyTimeout time.Duration
 }
 
+// NewSQLite opens the database for the server and CLI to use at the same
+// time. WAL lets readers go on while one connection writes, and every
+// transaction takes the write lock when it begins, so concurrent writers
+// queue for up to the busy timeout instead of failing when a read turns
+// into a write. Foreign keys are enforced, the schema's cascades rely on it.
 func NewSQLite(opts Options) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", opts.Database)
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = defaultMaxConns
+	}
+
+	if opts.BusyTimeout <= 0 {
+		opts.BusyTimeout = defaultBusyTimeout
+	}
+
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_busy_timeout", strconv.FormatInt(opts.BusyTimeout.Milliseconds(), 10))
+	params.Set("_foreign_keys", "on")
+	params.Set("_txlock", "immediate")
+	// WAL is safe from corruption with NORMAL, only the last commits may be
+	// lost on power failure
+	params.Set("_synchronous", "NORMAL")
+
+	sep := "?"
+	if strings.Contains(opts.Database, "?") {
+		sep = "&"
+	}
+
+	db, err := sql.Open("sqlite3", opts.Database+sep+params.Encode())
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	return db, nil
-}
+	db.SetMaxOpenConns(opts.MaxConns)
+	db.SetMaxIdleConns(opts.MaxConns)
 
-func Seed(ctx context.Context, db *sql.DB, repo *keeper.SQLiteRepository, registry provider_registry.Registry) error {
-	if !shouldSeed(db) {
-		return nil
+	// the journal mode is set when the first connection opens, report a
+	// database that can't be opened here rather than on first use
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
+	return db, nil
+}
+
+// RegistryProviders are the providers of the registry as stored, e.g. to
+// seed a keeper.MemoryRepository with keeper.Seed
+func RegistryProviders(registry provider_registry.Registry) []keeper.Provider {
 	providers := make([]keeper.Provider, 0, len(registry.Providers))
 	for _, p := range registry.Providers {
 		providers = append(providers, keeper.Provider{
@@ -43,34 +96,26 @@ func Seed(ctx context.Context, db *sql.DB, repo *keeper.SQLiteRepository, regist
 		})
 	}
 
-	if _, err := db.Exec(createTablesSQL); err != nil {
-		return logger.Errorf("failed to create tables: %v", err)
-	}
+	return providers
+}
 
-	userID, err := repo.CreateProfile(ctx, keeper.CreateProfileReq{
-		Name:      "default",
-		IsActive:  true,
-		IsDefault: true,
-	})
-	if err != nil {
-		return logger.Errorf("failed to create user: %v", err)
-	}
+func Seed(ctx context.Context, db *sql.DB, repo keeper.Repository, registry provider_registry.Registry) error {
+	providers := RegistryProviders(registry)
 
-	ps, err := repo.CreateProviders(ctx, providers...)
-	if err != nil {
-		return logger.Errorf("failed to create providers: %v", err)
-	}
+	if !shouldSeed(db) {
+		// pick up providers added to the registry since the database was created
+		if err := repo.CreateMissingProviders(ctx, providers...); err != nil {
+			return logger.Errorf("failed to create providers: %v", err)
+		}
 
-	defaultProviderID := ps[0]
+		return nil
+	}
 
-	if _, err := repo.CreateProfileSettings(ctx, keeper.ProfileSettings{
-		ProfileID:  userID,
-		ProviderID: defaultProviderID,
-	}); err != nil {
-		return logger.Errorf("failed to create user settings: %v", err)
+	if _, err := db.Exec(createTablesSQL); err != nil {
+		return logger.Errorf("failed to create tables: %v", err)
 	}
 
-	return nil
+	return keeper.Seed(ctx, repo, providers...)
 }
 func shouldSeed(db *sql.DB) bool {
 	rows, err := db.Query(
@@ -0,0 +1,22 @@
+package database_test
+
+import (
+	"os"
+	"testing"
+
+	"keeper/services/keeper/keepertest"
+)
+
+func TestMain(m *testing.M) {
+	keepertest.WorkerMain()
+	os.Exit(m.Run())
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	opts := keepertest.Options{}
+	if testing.Short() {
+		opts.Processes, opts.Iterations = 2, 10
+	}
+
+	keepertest.Concurrency(t, opts)
+}
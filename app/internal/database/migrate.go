@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"keeper/internal/logger"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Migrate applies the embedded migrations newer than the database's
+// user_version, each in its own transaction. Files are named
+// NNNN_description.sql and applied in order.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	files, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return logger.Errorf("failed to list migrations: %v", err)
+	}
+
+	sort.Strings(files)
+
+	var current int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&current); err != nil {
+		return logger.Errorf("failed to read schema version: %v", err)
+	}
+
+	for _, file := range files {
+		version, err := migrationVersion(file)
+		if err != nil {
+			return logger.Errorf("invalid migration %s: %v", file, err)
+		}
+
+		if version <= current {
+			continue
+		}
+
+		if err := applyMigration(ctx, db, file, version); err != nil {
+			return logger.Errorf("failed to apply migration %s: %v", file, err)
+		}
+
+		logger.Debugf("Applied migration %s", file)
+	}
+
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, file string, version int) error {
+	script, err := migrations.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+		return err
+	}
+
+	// PRAGMA does not accept bound parameters
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func migrationVersion(file string) (int, error) {
+	name := strings.TrimPrefix(file, "migrations/")
+
+	prefix, _, ok := strings.Cut(name, "_")
+	if !ok {
+		return 0, fmt.Errorf("missing version prefix")
+	}
+
+	return strconv.Atoi(prefix)
+}
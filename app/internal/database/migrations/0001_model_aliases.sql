@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS `model_aliases` (
+    `id` integer PRIMARY KEY AUTOINCREMENT NOT NULL,
+    `profile_id` integer NOT NULL,
+    `alias` text NOT NULL,
+    `model` text NOT NULL,
+    `created_at` text DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    `updated_at` text DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    FOREIGN KEY (`profile_id`) REFERENCES `profiles`(`id`) ON UPDATE no action ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_model_aliases_profile_id_alias ON model_aliases(profile_id, alias);
@@ -0,0 +1 @@
+ALTER TABLE `profiles` ADD COLUMN `cache_enabled` integer DEFAULT 0;
@@ -0,0 +1,3 @@
+-- status is one of unknown, valid, invalid, quota_exceeded and revoked
+ALTER TABLE `provider_keys` ADD COLUMN `status` text DEFAULT 'unknown' NOT NULL;
+ALTER TABLE `provider_keys` ADD COLUMN `last_checked_at` text;
@@ -0,0 +1,2 @@
+-- a rate limited key is skipped until cooldown_until, in UTC
+ALTER TABLE `provider_keys` ADD COLUMN `cooldown_until` text;
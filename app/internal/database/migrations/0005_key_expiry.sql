@@ -0,0 +1,4 @@
+-- optional dates in UTC: an expired key is never used, rotate_after only
+-- reminds that the key is due for rotation
+ALTER TABLE `provider_keys` ADD COLUMN `expires_at` text;
+ALTER TABLE `provider_keys` ADD COLUMN `rotate_after` text;
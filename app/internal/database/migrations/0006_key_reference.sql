@@ -0,0 +1,4 @@
+-- only keys stored with --ref are resolved, a key that merely looks like
+-- exec:... is sent as it is. References stored before are not marked, they
+-- need to be stored again with --ref.
+ALTER TABLE `provider_keys` ADD COLUMN `is_reference` integer DEFAULT 0 NOT NULL;
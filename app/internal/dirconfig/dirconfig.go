@@ -0,0 +1,87 @@
+package dirconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileNames are the per-directory config files, in order of precedence
+var FileNames = []string{".keeper", "keeper.yml"}
+
+// Config selects a profile and provider overrides for a directory tree
+type Config struct {
+	// Profile replaces the active profile
+	Profile string `yaml:"profile"`
+	// Providers holds overrides per provider name
+	Providers map[string]ProviderOverride `yaml:"providers"`
+
+	// Path is the file the config was read from
+	Path string `yaml:"-"`
+}
+
+// ProviderOverride customizes how a provider is used within the directory
+type ProviderOverride struct {
+	// Key is the name of the key to use instead of the profile's
+	Key string `yaml:"key"`
+}
+
+// KeyFor returns the key name configured for the provider, if any
+func (c *Config) KeyFor(provider string) string {
+	if c == nil {
+		return ""
+	}
+
+	return c.Providers[provider].Key
+}
+
+// Find walks up from dir and loads the first config file it finds. It
+// returns nil without an error when there is none.
+func Find(dir string) (*Config, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		for _, name := range FileNames {
+			path := filepath.Join(dir, name)
+
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				continue
+			}
+
+			return Load(path)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// Load reads a config file. A file holding nothing but a name is shorthand
+// for selecting that profile.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		var profile string
+		if yaml.Unmarshal(data, &profile) != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		cfg.Profile = profile
+	}
+
+	cfg.Path = path
+
+	return &cfg, nil
+}
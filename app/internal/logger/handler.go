@@ -3,6 +3,7 @@ package logger
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,7 +18,10 @@ const (
 )
 
 type Logger struct {
-	level         int
+	level int
+	// console is where log lines are printed, stdout unless UseStderr was
+	// called
+	console       io.Writer
 	file          *os.File
 	writer        *bufio.Writer
 	buffer        []string
@@ -54,6 +58,7 @@ func newLogger(level string, logFilePath string, bufferSize int, flushInterval t
 
 	l := &Logger{
 		level:         logLevel,
+		console:       os.Stdout,
 		file:          file,
 		writer:        bufio.NewWriter(file),
 		buffer:        make([]string, 0, bufferSize),
@@ -148,7 +153,7 @@ func (l *Logger) log(level int, v ...interface{}) {
 
 	message := formatLogMessage(level, fmt.Sprint(v...))
 	if level >= l.level {
-		fmt.Printf("%s%s\033[0m\n", levelToColor(level), message)
+		fmt.Fprintf(l.console, "%s%s\033[0m\n", levelToColor(level), message)
 	}
 
 	l.bufferLog(message)
@@ -158,6 +163,19 @@ func (l *Logger) logf(level int, format string, v ...interface{}) {
 	l.log(level, fmt.Sprintf(format, v...))
 }
 
+// UseStderr prints log lines to stderr from now on, for commands whose
+// stdout is read by other programs, e.g. eval "$(keeper env)"
+func UseStderr() {
+	if logger == nil {
+		return
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	logger.console = os.Stderr
+}
+
 func Debug(v ...interface{}) {
 	if logger != nil {
 		logger.log(LogLevelDebug, v...)
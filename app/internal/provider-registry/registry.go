@@ -2,6 +2,7 @@ package provider_registry
 
 import (
 	_ "embed"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -19,10 +20,21 @@ type Provider struct {
 	DefaultModel string       `yaml:"default_model"`
 	Models       []Model      `yaml:"models"`
 	Auth         ProviderAuth `yaml:"auth"`
+	Env          ProviderEnv  `yaml:"env"`
+	HealthCheck  HealthCheck  `yaml:"health_check"`
+	// Builtin providers are served by keeper itself and never reach BaseURL
+	Builtin bool `yaml:"builtin"`
 }
 
 type Model struct {
-	Name string `yaml:"name"`
+	Name    string       `yaml:"name"`
+	Pricing ModelPricing `yaml:"pricing"`
+}
+
+// ModelPricing is the price in USD per million tokens
+type ModelPricing struct {
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
 }
 
 type ProviderAuth struct {
@@ -31,6 +43,74 @@ type ProviderAuth struct {
 	Value string `yaml:"value"`
 }
 
+// HealthCheck is a cheap authenticated request that tells whether a key
+// works, such as listing models
+type HealthCheck struct {
+	Method string `yaml:"method"`
+	// Path is appended to the provider's base URL
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// ProviderEnv names the environment variables the provider's SDKs and tools
+// read their endpoint and credentials from
+type ProviderEnv struct {
+	BaseURL string `yaml:"base_url"`
+	APIKey  string `yaml:"api_key"`
+	// SDKPathPrefix is the path the SDKs append to the base URL themselves
+	SDKPathPrefix string `yaml:"sdk_path_prefix"`
+}
+
+// Provider returns the registry entry with the given name
+func (r Registry) Provider(name string) (Provider, bool) {
+	for _, p := range r.Providers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+
+	return Provider{}, false
+}
+
+// AuthHeader returns the header name and value that authenticate a request
+// to the provider with the given secret.
+func (p Provider) AuthHeader(secret string) (string, string) {
+	if p.Auth.Type != "header" || p.Auth.Key == "" {
+		return "Authorization", "Bearer " + secret
+	}
+
+	value := p.Auth.Value
+	if value == "" {
+		value = "{{ api_key }}"
+	}
+
+	return p.Auth.Key, strings.ReplaceAll(value, "{{ api_key }}", secret)
+}
+
+// Cost estimates the price in USD of a request to model. Dated snapshots
+// such as gpt-4o-2024-08-06 are priced as the longest listed model name they
+// start with; false when the model has no known price.
+func (p Provider) Cost(model string, inputTokens, outputTokens int64) (float64, bool) {
+	var match *Model
+	for i, m := range p.Models {
+		if strings.HasPrefix(model, m.Name) && (match == nil || len(m.Name) > len(match.Name)) {
+			match = &p.Models[i]
+		}
+	}
+
+	if match == nil || match.Pricing == (ModelPricing{}) {
+		return 0, false
+	}
+
+	return (float64(inputTokens)*match.Pricing.Input + float64(outputTokens)*match.Pricing.Output) / 1e6, true
+}
+
+// SDKBaseURL is the base URL to hand to the provider's SDKs, which append
+// SDKPathPrefix on their own.
+func (p Provider) SDKBaseURL(baseURL string) string {
+	return strings.TrimSuffix(baseURL, p.Env.SDKPathPrefix)
+}
+
 func New() (Registry, error) {
 	return loadRegistry()
 }
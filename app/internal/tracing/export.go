@@ -0,0 +1,219 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileExporter appends every span as a JSON line to a file, which is
+// created on the first export
+type FileExporter struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileExporter(path string) *FileExporter {
+	return &FileExporter{path: path}
+}
+
+// fileSpan is the JSONL form of a span
+type fileSpan struct {
+	TraceID    string         `json:"trace_id"`
+	SpanID     string         `json:"span_id"`
+	ParentID   string         `json:"parent_span_id,omitempty"`
+	Name       string         `json:"name"`
+	Service    string         `json:"service"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	DurationMS float64        `json:"duration_ms"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+func (e *FileExporter) Export(_ context.Context, spans []*Span) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+
+	for _, s := range spans {
+		end := s.EndTime()
+		if err := enc.Encode(fileSpan{
+			TraceID:    s.TraceID,
+			SpanID:     s.SpanID,
+			ParentID:   s.ParentID,
+			Name:       s.Name,
+			Service:    s.Service,
+			Start:      s.Start,
+			End:        end,
+			DurationMS: float64(end.Sub(s.Start).Microseconds()) / 1000,
+			Attributes: s.Attributes(),
+			Error:      s.Err(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.file == nil {
+		f, err := os.OpenFile(e.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open trace file: %w", err)
+		}
+		e.file = f
+	}
+
+	_, err := e.file.Write(buf.Bytes())
+	return err
+}
+
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.file == nil {
+		return nil
+	}
+
+	return e.file.Close()
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector over OTLP/HTTP
+// with the JSON encoding
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewOTLPExporter sends to endpoint, the collector's base URL such as
+// http://localhost:4318 or the full /v1/traces URL
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+
+	return &OTLPExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, spans []*Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return fmt.Errorf("failed to marshal spans: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach collector: %w", err)
+	}
+	defer res.Body.Close()
+
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("collector returned %s", res.Status)
+	}
+
+	return nil
+}
+
+func (e *OTLPExporter) Close() error {
+	return nil
+}
+
+// otlpRequest builds an ExportTraceServiceRequest in its JSON mapping
+func otlpRequest(spans []*Span) map[string]any {
+	otlpSpans := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]any{
+			"traceId":           s.TraceID,
+			"spanId":            s.SpanID,
+			"name":              s.Name,
+			"kind":              int(s.Kind),
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.EndTime().UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes()),
+			// 1 is OK, 2 is ERROR
+			"status": map[string]any{"code": 1},
+		}
+
+		if s.ParentID != "" {
+			span["parentSpanId"] = s.ParentID
+		}
+
+		if err := s.Err(); err != "" {
+			span["status"] = map[string]any{"code": 2, "message": err}
+		}
+
+		otlpSpans = append(otlpSpans, span)
+	}
+
+	return map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": spans[0].Service}),
+			},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]any{"name": "keeper"},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]any) []map[string]any {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make([]map[string]any, 0, len(attrs))
+	for _, k := range keys {
+		var value map[string]any
+
+		switch v := attrs[k].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+
+		out = append(out, map[string]any{"key": k, "value": value})
+	}
+
+	return out
+}
@@ -0,0 +1,325 @@
+// Package tracing records spans around proxied requests and exports them in
+// batches. It speaks W3C trace context so keeper's spans join the traces of
+// the applications calling it.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "keeper/internal/logger"
+)
+
+const (
+	queueSize     = 1024
+	batchSize     = 256
+	flushInterval = 2 * time.Second
+)
+
+// SpanKind follows the OTLP numbering
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// Exporter ships finished spans somewhere
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+	Close() error
+}
+
+// Tracer creates spans and exports them in the background. A nil Tracer is
+// valid and records nothing.
+type Tracer struct {
+	service  string
+	exporter Exporter
+
+	queue chan *Span
+	done  chan struct{}
+	once  sync.Once
+
+	// mu guards closed, spans ending hold it for reading while they queue
+	// so Close never closes the queue under them
+	mu     sync.RWMutex
+	closed bool
+}
+
+func New(service string, exporter Exporter) *Tracer {
+	t := &Tracer{
+		service:  service,
+		exporter: exporter,
+		queue:    make(chan *Span, queueSize),
+		done:     make(chan struct{}),
+	}
+
+	go t.run()
+
+	return t
+}
+
+// Span is a timed operation within a trace
+type Span struct {
+	tracer *Tracer
+
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Name     string
+	Kind     SpanKind
+	Service  string
+	Start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]any
+	err        string
+	ended      bool
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// remoteParent is a span context received from a caller
+type remoteParent struct {
+	traceID string
+	spanID  string
+}
+
+// Extract returns ctx carrying the caller's span from a traceparent header,
+// so the next span started joins its trace. Invalid headers are ignored.
+func Extract(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return ctx
+	}
+
+	traceID, spanID := parts[1], parts[2]
+	if !validID(traceID, 32) || !validID(spanID, 16) {
+		return ctx
+	}
+
+	return context.WithValue(ctx, remoteKey{}, remoteParent{traceID: traceID, spanID: spanID})
+}
+
+func validID(id string, length int) bool {
+	if len(id) != length || strings.Trim(id, "0") == "" {
+		return false
+	}
+
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Start begins a span as a child of the span in ctx, of the remote parent
+// extracted into ctx, or as the root of a new trace.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:     t,
+		SpanID:     randomID(8),
+		Name:       name,
+		Kind:       kind,
+		Service:    t.service,
+		Start:      time.Now(),
+		attributes: map[string]any{},
+	}
+
+	switch parent := FromContext(ctx); {
+	case parent != nil:
+		span.TraceID, span.ParentID = parent.TraceID, parent.SpanID
+	default:
+		if remote, ok := ctx.Value(remoteKey{}).(remoteParent); ok {
+			span.TraceID, span.ParentID = remote.traceID, remote.spanID
+		} else {
+			span.TraceID = randomID(16)
+		}
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// FromContext returns the current span, nil when there is none
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SetAttr records an attribute on the span
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(format string, args ...any) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = fmt.Sprintf(format, args...)
+}
+
+// TraceParent is the header value that makes a callee a child of the span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// End finishes the span and queues it for export. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.enqueue(s)
+}
+
+// enqueue queues the span for export unless the tracer is closed
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		log.Debugf("Tracer is closed, dropping span %s", s.Name)
+		return
+	}
+
+	select {
+	case t.queue <- s:
+	default:
+		// never slow down requests for the sake of tracing
+		log.Debugf("Trace queue is full, dropping span %s", s.Name)
+	}
+}
+
+// EndTime is when the span ended
+func (s *Span) EndTime() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.end
+}
+
+// Attributes returns a copy of the span's attributes
+func (s *Span) Attributes() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attrs := make(map[string]any, len(s.attributes))
+	for k, v := range s.attributes {
+		attrs[k] = v
+	}
+
+	return attrs
+}
+
+// Err is the error the span ended with, empty when it succeeded
+func (s *Span) Err() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// Close exports the spans still queued and closes the exporter
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+
+	t.once.Do(func() {
+		t.mu.Lock()
+		t.closed = true
+		close(t.queue)
+		t.mu.Unlock()
+
+		<-t.done
+	})
+
+	return t.exporter.Close()
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := t.exporter.Export(ctx, batch); err != nil {
+			log.Errorf("failed to export %d spans: %v", len(batch), err)
+		}
+
+		batch = make([]*Span, 0, batchSize)
+	}
+
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func randomID(bytes int) string {
+	b := make([]byte, bytes)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,220 @@
+// Package bundle reads and writes the files `keeper export` creates: a
+// keeper.Bundle as JSON, encrypted with age to a passphrase or to the public
+// keys of its recipients.
+package bundle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"keeper/services/keeper"
+
+	"filippo.io/age"
+)
+
+const (
+	// ageHeader starts every age encrypted file
+	ageHeader = "age-encryption.org/v1\n"
+	// maxBundle bounds how much of a bundle is read
+	maxBundle = 16 << 20
+)
+
+// Encryption says who can open a bundle, nobody needs to when it is empty
+type Encryption struct {
+	// Passphrase encrypts with a passphrase, it can't be combined with
+	// recipients
+	Passphrase string
+	// Recipients are age public keys, age1...
+	Recipients []string
+}
+
+func (e Encryption) enabled() bool {
+	return e.Passphrase != "" || len(e.Recipients) > 0
+}
+
+// Decryption opens encrypted bundles
+type Decryption struct {
+	// Identities are age private keys, AGE-SECRET-KEY-1...
+	Identities []age.Identity
+	// Passphrase is asked for bundles encrypted with a passphrase
+	Passphrase func() (string, error)
+}
+
+// Write writes b to w, encrypted when enc says so
+func Write(w io.Writer, b *keeper.Bundle, enc Encryption) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode bundle: %w", err)
+	}
+	data = append(data, '\n')
+
+	if !enc.enabled() {
+		_, err := w.Write(data)
+		return err
+	}
+
+	recipients, err := enc.recipients()
+	if err != nil {
+		return err
+	}
+
+	aw, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt bundle: %w", err)
+	}
+
+	if _, err := aw.Write(data); err != nil {
+		return fmt.Errorf("failed to encrypt bundle: %w", err)
+	}
+
+	if err := aw.Close(); err != nil {
+		return fmt.Errorf("failed to encrypt bundle: %w", err)
+	}
+
+	return nil
+}
+
+func (e Encryption) recipients() ([]age.Recipient, error) {
+	if e.Passphrase != "" {
+		if len(e.Recipients) > 0 {
+			return nil, fmt.Errorf("a bundle is encrypted with a passphrase or to recipients, not both")
+		}
+
+		r, err := age.NewScryptRecipient(e.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		return []age.Recipient{r}, nil
+	}
+
+	recipients := make([]age.Recipient, 0, len(e.Recipients))
+	for _, s := range e.Recipients {
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", s, err)
+		}
+
+		recipients = append(recipients, r)
+	}
+
+	return recipients, nil
+}
+
+// ParseRecipientsFile reads age public keys from a file, one per line with
+// # comments, as age -R does
+func ParseRecipientsFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var recipients []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		recipients = append(recipients, line)
+	}
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients in %s", path)
+	}
+
+	return recipients, nil
+}
+
+// ParseIdentityFile reads age private keys from a file such as the one
+// age-keygen writes
+func ParseIdentityFile(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identities from %s: %w", path, err)
+	}
+
+	return identities, nil
+}
+
+// Read reads a bundle written by Write, decrypting it with dec if it is
+// encrypted
+func Read(r io.Reader, dec Decryption) (*keeper.Bundle, error) {
+	br := bufio.NewReader(io.LimitReader(r, maxBundle))
+
+	head, err := br.Peek(len(ageHeader))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+
+	var plain io.Reader = br
+	if string(head) == ageHeader {
+		if plain, err = decrypt(br, dec); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := io.ReadAll(plain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+
+	var b keeper.Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("not a keeper bundle: %w", err)
+	}
+
+	return &b, nil
+}
+
+func decrypt(br *bufio.Reader, dec Decryption) (io.Reader, error) {
+	// the header lists one stanza per recipient, a scrypt stanza means the
+	// bundle is encrypted with a passphrase
+	header, _ := br.Peek(br.Buffered())
+	identities := dec.Identities
+
+	if bytes.Contains(header, []byte("\n-> scrypt ")) {
+		if dec.Passphrase == nil {
+			return nil, fmt.Errorf("the bundle is encrypted with a passphrase")
+		}
+
+		passphrase, err := dec.Passphrase()
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = []age.Identity{id}
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("the bundle is encrypted to recipients, pass the private key with --identity")
+	}
+
+	plain, err := age.Decrypt(br, identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, fmt.Errorf("failed to decrypt bundle, wrong passphrase or identity")
+		}
+		return nil, fmt.Errorf("failed to decrypt bundle: %w", err)
+	}
+
+	return plain, nil
+}
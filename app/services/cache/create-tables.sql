@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS `responses` (
+    `key` text PRIMARY KEY NOT NULL,
+    `provider` text NOT NULL,
+    `path` text NOT NULL,
+    `status` integer NOT NULL,
+    `content_type` text,
+    `body` blob NOT NULL,
+    `hits` integer DEFAULT 0 NOT NULL,
+    `created_at` text DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    `expires_at` text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_responses_expires_at ON responses(expires_at);
@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"keeper/internal/logger"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//go:embed create-tables.sql
+var createTablesSQL string
+
+// timeFormat sorts lexically, so expiry can be compared in SQL
+const timeFormat = "2006-01-02 15:04:05.000"
+
+// SQLiteRepository stores upstream responses in their own database, apart
+// from the keeper database whose changes the proxy watches.
+type SQLiteRepository struct {
+	db *sql.DB
+
+	once    sync.Once
+	initErr error
+}
+
+// Entry is a cached response to a request identified by Key
+type Entry struct {
+	Key         string
+	Provider    string
+	Path        string
+	Status      int
+	ContentType string
+	Body        []byte
+	Hits        int64
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// Stats summarizes the cache contents
+type Stats struct {
+	Entries int64
+	Expired int64
+	Hits    int64
+	Bytes   int64
+}
+
+// DefaultPath is the cache database under the user's cache dir
+func DefaultPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate cache dir: %w", err)
+	}
+
+	return filepath.Join(dir, "keeper", "keeper-cache.db"), nil
+}
+
+func NewSQLite(db *sql.DB) (*SQLiteRepository, error) {
+	return &SQLiteRepository{db: db}, nil
+}
+
+// init creates the tables on first use, so commands that never touch the
+// cache don't create its file.
+func (r *SQLiteRepository) init(ctx context.Context) error {
+	r.once.Do(func() {
+		if _, err := r.db.ExecContext(ctx, createTablesSQL); err != nil {
+			r.initErr = logger.Errorf("failed to create cache tables: %w", err)
+		}
+	})
+
+	return r.initErr
+}
+
+// Get returns the unexpired entry stored under key and counts the hit, or
+// nil when there is none.
+func (r *SQLiteRepository) Get(ctx context.Context, key string) (*Entry, error) {
+	if err := r.init(ctx); err != nil {
+		return nil, err
+	}
+
+	var entry Entry
+	var contentType sql.NullString
+	var createdAt, expiresAt string
+
+	err := r.db.QueryRowContext(ctx, `
+        SELECT key, provider, path, status, content_type, body, hits, created_at, expires_at
+        FROM responses
+        WHERE key = $1 AND expires_at > $2
+    `, key, time.Now().UTC().Format(timeFormat)).
+		Scan(
+			&entry.Key, &entry.Provider, &entry.Path, &entry.Status, &contentType,
+			&entry.Body, &entry.Hits, &createdAt, &expiresAt,
+		)
+	if err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, nil
+		default:
+			return nil, logger.Errorf("failed to get cached response: %w", err)
+		}
+	}
+
+	if _, err := r.db.ExecContext(ctx, "UPDATE responses SET hits = hits + 1 WHERE key = $1", key); err != nil {
+		return nil, logger.Errorf("failed to count cache hit: %w", err)
+	}
+	entry.Hits++
+
+	entry.ContentType = contentType.String
+	entry.CreatedAt, _ = time.Parse(time.DateTime, createdAt)
+	entry.ExpiresAt, _ = time.Parse(timeFormat, expiresAt)
+
+	return &entry, nil
+}
+
+// Put stores entry, replacing whatever was cached under its key
+func (r *SQLiteRepository) Put(ctx context.Context, entry Entry) error {
+	if err := r.init(ctx); err != nil {
+		return err
+	}
+
+	if _, err := r.db.ExecContext(ctx, `
+        INSERT OR REPLACE INTO responses (key, provider, path, status, content_type, body, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `, entry.Key, entry.Provider, entry.Path, entry.Status, entry.ContentType, entry.Body,
+		entry.ExpiresAt.UTC().Format(timeFormat)); err != nil {
+		return logger.Errorf("failed to cache response: %w", err)
+	}
+
+	return nil
+}
+
+func (r *SQLiteRepository) Stats(ctx context.Context) (*Stats, error) {
+	if err := r.init(ctx); err != nil {
+		return nil, err
+	}
+
+	var stats Stats
+	if err := r.db.QueryRowContext(ctx, `
+        SELECT COUNT(*),
+               COALESCE(SUM(expires_at <= $1), 0),
+               COALESCE(SUM(hits), 0),
+               COALESCE(SUM(LENGTH(body)), 0)
+        FROM responses
+    `, time.Now().UTC().Format(timeFormat)).
+		Scan(&stats.Entries, &stats.Expired, &stats.Hits, &stats.Bytes); err != nil {
+		return nil, logger.Errorf("failed to get cache stats: %w", err)
+	}
+
+	return &stats, nil
+}
+
+// Clear removes every entry, or only the expired ones, and returns how many
+// were removed.
+func (r *SQLiteRepository) Clear(ctx context.Context, expiredOnly bool) (int64, error) {
+	if err := r.init(ctx); err != nil {
+		return 0, err
+	}
+
+	query, args := "DELETE FROM responses", []any{}
+	if expiredOnly {
+		query, args = "DELETE FROM responses WHERE expires_at <= $1", []any{time.Now().UTC().Format(timeFormat)}
+	}
+
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, logger.Errorf("failed to clear cache: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, logger.Errorf("failed to count cleared entries: %w", err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS `interactions` (
+    `id` integer PRIMARY KEY AUTOINCREMENT NOT NULL,
+    `provider` text NOT NULL,
+    `method` text NOT NULL,
+    `path` text NOT NULL,
+    `query` text NOT NULL,
+    `body_hash` text NOT NULL,
+    `request_body` blob,
+    `status` integer NOT NULL,
+    `header` text NOT NULL,
+    `created_at` text DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS `chunks` (
+    `interaction_id` integer NOT NULL,
+    `seq` integer NOT NULL,
+    `delay_ms` integer NOT NULL,
+    `data` blob NOT NULL,
+    PRIMARY KEY (`interaction_id`, `seq`),
+    FOREIGN KEY (`interaction_id`) REFERENCES `interactions`(`id`) ON UPDATE no action ON DELETE CASCADE
+);
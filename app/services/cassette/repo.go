@@ -0,0 +1,177 @@
+package cassette
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"keeper/internal/logger"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//go:embed create-tables.sql
+var createTablesSQL string
+
+// SQLiteRepository stores recorded request/response pairs in a cassette file
+type SQLiteRepository struct {
+	db *sql.DB
+
+	once    sync.Once
+	initErr error
+}
+
+// Interaction is one recorded request and the response it got
+type Interaction struct {
+	ID          int64
+	Provider    string
+	Method      string
+	Path        string
+	Query       string
+	BodyHash    string
+	RequestBody []byte
+	Status      int
+	Header      http.Header
+	Chunks      []Chunk
+}
+
+// Chunk is a piece of a response body as it was written upstream, with the
+// time that passed since the previous one (or since the request for the
+// first), so streams replay at their original pace.
+type Chunk struct {
+	Delay time.Duration
+	Data  []byte
+}
+
+func NewSQLite(db *sql.DB) (*SQLiteRepository, error) {
+	return &SQLiteRepository{db: db}, nil
+}
+
+func (r *SQLiteRepository) init(ctx context.Context) error {
+	r.once.Do(func() {
+		if _, err := r.db.ExecContext(ctx, createTablesSQL); err != nil {
+			r.initErr = logger.Errorf("failed to create cassette tables: %w", err)
+		}
+	})
+
+	return r.initErr
+}
+
+// Save records an interaction with its chunks
+func (r *SQLiteRepository) Save(ctx context.Context, in Interaction) error {
+	if err := r.init(ctx); err != nil {
+		return err
+	}
+
+	header, err := json.Marshal(in.Header)
+	if err != nil {
+		return logger.Errorf("failed to marshal response header: %w", err)
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return logger.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+        INSERT INTO interactions (provider, method, path, query, body_hash, request_body, status, header)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+    `, in.Provider, in.Method, in.Path, in.Query, in.BodyHash, in.RequestBody, in.Status, string(header))
+	if err != nil {
+		return logger.Errorf("failed to record interaction: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return logger.Errorf("failed to get last insert ID: %w", err)
+	}
+
+	for i, c := range in.Chunks {
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO chunks (interaction_id, seq, delay_ms, data) VALUES ($1, $2, $3, $4)
+        `, id, i, c.Delay.Milliseconds(), c.Data); err != nil {
+			return logger.Errorf("failed to record response chunk: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return logger.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// List returns every recorded interaction in recording order, without
+// their chunks.
+func (r *SQLiteRepository) List(ctx context.Context) ([]Interaction, error) {
+	if err := r.init(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+        SELECT id, provider, method, path, query, body_hash, status, header
+        FROM interactions
+        ORDER BY id`)
+	if err != nil {
+		return nil, logger.Errorf("failed to list interactions: %w", err)
+	}
+
+	defer rows.Close()
+
+	var interactions []Interaction
+	for rows.Next() {
+		var in Interaction
+		var header string
+		if err := rows.Scan(&in.ID, &in.Provider, &in.Method, &in.Path, &in.Query, &in.BodyHash, &in.Status, &header); err != nil {
+			return nil, logger.Errorf("failed to scan interaction: %w", err)
+		}
+
+		if err := json.Unmarshal([]byte(header), &in.Header); err != nil {
+			return nil, logger.Errorf("invalid header of interaction %d: %w", in.ID, err)
+		}
+
+		interactions = append(interactions, in)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, logger.Errorf("failed to list interactions: %w", err)
+	}
+
+	return interactions, nil
+}
+
+// Chunks returns the response body of an interaction as it was recorded
+func (r *SQLiteRepository) Chunks(ctx context.Context, interactionID int64) ([]Chunk, error) {
+	rows, err := r.db.QueryContext(ctx, `
+        SELECT delay_ms, data FROM chunks
+        WHERE interaction_id = $1
+        ORDER BY seq`, interactionID)
+	if err != nil {
+		return nil, logger.Errorf("failed to load response chunks: %w", err)
+	}
+
+	defer rows.Close()
+
+	var chunks []Chunk
+	for rows.Next() {
+		var c Chunk
+		var delay int64
+		if err := rows.Scan(&delay, &c.Data); err != nil {
+			return nil, logger.Errorf("failed to scan response chunk: %w", err)
+		}
+
+		c.Delay = time.Duration(delay) * time.Millisecond
+		chunks = append(chunks, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, logger.Errorf("failed to load response chunks: %w", err)
+	}
+
+	return chunks, nil
+}
@@ -0,0 +1,618 @@
+package keeper
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"keeper/internal/logger"
+	"strings"
+	"time"
+)
+
+// BundleVersion is the version of the bundles Export creates, Import reads
+// bundles up to it
+const BundleVersion = 1
+
+// Bundle is a portable copy of the shared setup: provider overrides,
+// profiles with their settings and aliases, and optionally keys. Rows refer
+// to each other by name, IDs differ between databases.
+type Bundle struct {
+	Version   int              `json:"version"`
+	CreatedAt string           `json:"created_at"`
+	Providers []BundleProvider `json:"providers"`
+	Profiles  []BundleProfile  `json:"profiles"`
+	Keys      []BundleKey      `json:"keys,omitempty"`
+}
+
+type BundleProvider struct {
+	Name    string `json:"name"`
+	BaseURL string `json:"base_url"`
+	Model   string `json:"model"`
+}
+
+type BundleProfile struct {
+	Name         string `json:"name"`
+	CacheEnabled bool   `json:"cache_enabled,omitempty"`
+	// Provider is the selected provider and Key the name of its key the
+	// profile uses, the provider's most recent key when empty
+	Provider string            `json:"provider,omitempty"`
+	Key      string            `json:"key,omitempty"`
+	Aliases  map[string]string `json:"aliases,omitempty"`
+}
+
+type BundleKey struct {
+	Provider string `json:"provider"`
+	Name     string `json:"name"`
+	// Secret is the key, or a reference such as env:OPENAI_KEY when
+	// Reference is set
+	Secret      string `json:"secret"`
+	Reference   bool   `json:"reference,omitempty"`
+	IsActive    bool   `json:"is_active"`
+	ExpiresAt   string `json:"expires_at,omitempty"`
+	RotateAfter string `json:"rotate_after,omitempty"`
+}
+
+// runsOnImporter reports whether the key is a reference that runs a
+// command, exec:, or reads a file, file:, on the machine that uses it
+func (k BundleKey) runsOnImporter() bool {
+	scheme, _, _ := strings.Cut(k.Secret, ":")
+	return k.Reference && (scheme == "exec" || scheme == "file")
+}
+
+// ConflictStrategy decides what Import does with a profile or key whose
+// name is already taken
+type ConflictStrategy string
+
+const (
+	// ConflictSkip keeps what is stored
+	ConflictSkip ConflictStrategy = "skip"
+	// ConflictOverwrite replaces it with the bundle's
+	ConflictOverwrite ConflictStrategy = "overwrite"
+	// ConflictRename imports the bundle's under a new name, providers are
+	// matched by name and skipped instead
+	ConflictRename ConflictStrategy = "rename"
+)
+
+// Valid reports whether s is one of the known strategies
+func (s ConflictStrategy) Valid() bool {
+	return s == ConflictSkip || s == ConflictOverwrite || s == ConflictRename
+}
+
+// ImportOptions configures Import
+type ImportOptions struct {
+	OnConflict ConflictStrategy
+	// DryRun reports the changes without making them
+	DryRun bool
+	// AllowReferences imports exec: and file: references, whoever wrote
+	// the bundle then runs commands and reads files as the importing user
+	AllowReferences bool
+}
+
+// ImportChange is what Import did with one row of the bundle
+type ImportChange struct {
+	// Kind is provider, key or profile
+	Kind string
+	Name string
+	// Action is created, updated, renamed or skipped
+	Action string
+	Detail string
+	// Reference is what an imported key stored as a reference refers to
+	Reference string
+}
+
+func newBundle() *Bundle {
+	return &Bundle{
+		Version:   BundleVersion,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// Export copies the setup into a bundle, keys only when withKeys is set
+func (r *SQLiteRepository) Export(ctx context.Context, withKeys bool) (*Bundle, error) {
+	b := newBundle()
+
+	rows, err := r.db.QueryContext(ctx, "SELECT name, base_url, model FROM providers ORDER BY id")
+	if err != nil {
+		return nil, logger.Errorf("failed to list providers: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var p BundleProvider
+		if err := rows.Scan(&p.Name, &p.BaseURL, &p.Model); err != nil {
+			return nil, logger.Errorf("failed to scan provider: %w", err)
+		}
+
+		b.Providers = append(b.Providers, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, logger.Errorf("failed to list providers: %w", err)
+	}
+
+	aliases, err := r.ListModelAliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	profileRows, err := r.db.QueryContext(ctx, `
+        SELECT p.name, p.cache_enabled, COALESCE(pr.name, ''), COALESCE(k.name, '')
+        FROM profiles p
+        LEFT JOIN profile_settings ps ON ps.profile_id = p.id
+        LEFT JOIN providers pr ON ps.provider_id = pr.id
+        LEFT JOIN provider_keys k ON ps.provider_key_id = k.id
+        ORDER BY p.id`)
+	if err != nil {
+		return nil, logger.Errorf("failed to list profiles: %w", err)
+	}
+
+	defer profileRows.Close()
+
+	for profileRows.Next() {
+		var p BundleProfile
+		if err := profileRows.Scan(&p.Name, &p.CacheEnabled, &p.Provider, &p.Key); err != nil {
+			return nil, logger.Errorf("failed to scan profile: %w", err)
+		}
+
+		for _, a := range aliases {
+			if a.ProfileName != p.Name {
+				continue
+			}
+
+			if p.Aliases == nil {
+				p.Aliases = map[string]string{}
+			}
+			p.Aliases[a.Alias] = a.Model
+		}
+
+		b.Profiles = append(b.Profiles, p)
+	}
+
+	if err := profileRows.Err(); err != nil {
+		return nil, logger.Errorf("failed to list profiles: %w", err)
+	}
+
+	if !withKeys {
+		return b, nil
+	}
+
+	keyRows, err := r.db.QueryContext(ctx, `
+        SELECT p.name, COALESCE(k.name, ''), k.secret, k.is_reference, k.is_active,
+            COALESCE(k.expires_at, ''), COALESCE(k.rotate_after, '')
+        FROM provider_keys k
+        JOIN providers p ON k.provider_id = p.id
+        ORDER BY k.id`)
+	if err != nil {
+		return nil, logger.Errorf("failed to list keys: %w", err)
+	}
+
+	defer keyRows.Close()
+
+	for keyRows.Next() {
+		var k BundleKey
+		if err := keyRows.Scan(&k.Provider, &k.Name, &k.Secret, &k.Reference, &k.IsActive, &k.ExpiresAt, &k.RotateAfter); err != nil {
+			return nil, logger.Errorf("failed to scan key: %w", err)
+		}
+
+		b.Keys = append(b.Keys, k)
+	}
+
+	if err := keyRows.Err(); err != nil {
+		return nil, logger.Errorf("failed to list keys: %w", err)
+	}
+
+	return b, nil
+}
+
+// Import adds a bundle to the setup in one transaction. The active profile
+// stays as it is.
+func (r *SQLiteRepository) Import(ctx context.Context, b *Bundle, opts ImportOptions) ([]ImportChange, error) {
+	opts, err := checkImport(b, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, logger.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	imp := &importer{tx: tx, opts: opts, keys: map[string]int64{}}
+
+	if err := imp.providers(ctx, b.Providers); err != nil {
+		return nil, logger.Errorf("failed to import providers: %w", err)
+	}
+
+	if err := imp.importKeys(ctx, b.Keys); err != nil {
+		return nil, logger.Errorf("failed to import keys: %w", err)
+	}
+
+	if err := imp.profiles(ctx, b.Profiles); err != nil {
+		return nil, logger.Errorf("failed to import profiles: %w", err)
+	}
+
+	if opts.DryRun {
+		return imp.changes, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, logger.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return imp.changes, nil
+}
+
+// checkImport validates the bundle version and the options, filling in
+// the default strategy
+func checkImport(b *Bundle, opts ImportOptions) (ImportOptions, error) {
+	if b.Version < 1 || b.Version > BundleVersion {
+		return opts, logger.Errorf("unsupported bundle version %d, this keeper reads up to %d", b.Version, BundleVersion)
+	}
+
+	if opts.OnConflict == "" {
+		opts.OnConflict = ConflictSkip
+	}
+
+	if !opts.OnConflict.Valid() {
+		return opts, logger.Errorf("unknown conflict strategy %q, expected skip, overwrite or rename", opts.OnConflict)
+	}
+
+	var untrusted []string
+	for _, k := range b.Keys {
+		if k.runsOnImporter() {
+			untrusted = append(untrusted, fmt.Sprintf("%s/%s (%s)", k.Provider, k.Name, k.Secret))
+		}
+	}
+
+	if len(untrusted) > 0 && !opts.AllowReferences {
+		return opts, logger.Errorf("the bundle has keys that run commands or read files whenever they are used: %s; import with --allow-references only if you trust the bundle", strings.Join(untrusted, ", "))
+	}
+
+	return opts, nil
+}
+
+// importLog collects what an Import did
+type importLog struct {
+	changes []ImportChange
+}
+
+func (l *importLog) record(kind, name, action, detail string) {
+	l.changes = append(l.changes, ImportChange{Kind: kind, Name: name, Action: action, Detail: detail})
+}
+
+// recordKey records a key that was stored, with the reference it is
+func (l *importLog) recordKey(name, action, detail string, k BundleKey) {
+	l.record("key", name, action, detail)
+
+	if k.Reference {
+		l.changes[len(l.changes)-1].Reference = k.Secret
+	}
+}
+
+// importer holds the state of one Import
+type importer struct {
+	importLog
+
+	tx   *sql.Tx
+	opts ImportOptions
+	// keys maps provider/name of the bundle's keys to the stored key they
+	// ended up as, renamed ones included
+	keys map[string]int64
+}
+
+func (imp *importer) providers(ctx context.Context, providers []BundleProvider) error {
+	for _, p := range providers {
+		if p.Name == "" || p.BaseURL == "" || p.Model == "" {
+			return fmt.Errorf("provider name, base URL, and model cannot be empty")
+		}
+
+		var id int64
+		var baseURL, model string
+		err := imp.tx.QueryRowContext(ctx, "SELECT id, base_url, model FROM providers WHERE name = $1", p.Name).
+			Scan(&id, &baseURL, &model)
+
+		switch {
+		case err == sql.ErrNoRows:
+			if _, err := imp.tx.ExecContext(ctx, "INSERT INTO providers (name, base_url, model) VALUES ($1, $2, $3)", p.Name, p.BaseURL, p.Model); err != nil {
+				return err
+			}
+			imp.record("provider", p.Name, "created", "")
+
+		case err != nil:
+			return err
+
+		case baseURL == p.BaseURL && model == p.Model:
+
+		case imp.opts.OnConflict == ConflictOverwrite:
+			if _, err := imp.tx.ExecContext(ctx, `
+                UPDATE providers
+                SET base_url = $1, model = $2, updated_at = CURRENT_TIMESTAMP
+                WHERE id = $3
+            `, p.BaseURL, p.Model, id); err != nil {
+				return err
+			}
+			imp.record("provider", p.Name, "updated", fmt.Sprintf("%s, %s", p.BaseURL, p.Model))
+
+		default:
+			imp.record("provider", p.Name, "skipped", fmt.Sprintf("keeping %s, %s", baseURL, model))
+		}
+	}
+
+	return nil
+}
+
+func (imp *importer) providerID(ctx context.Context, name string) (int64, bool, error) {
+	var id int64
+	err := imp.tx.QueryRowContext(ctx, "SELECT id FROM providers WHERE name = $1", name).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, false, nil
+	case err != nil:
+		return 0, false, err
+	}
+
+	return id, true, nil
+}
+
+func (imp *importer) importKeys(ctx context.Context, keys []BundleKey) error {
+	for _, k := range keys {
+		label := k.Provider + "/" + k.Name
+
+		if k.Secret == "" {
+			return fmt.Errorf("key %s has no secret", label)
+		}
+
+		providerID, ok, err := imp.providerID(ctx, k.Provider)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			imp.record("key", label, "skipped", "unknown provider "+k.Provider)
+			continue
+		}
+
+		var id int64
+		var secret string
+		var isReference bool
+		err = imp.tx.QueryRowContext(ctx, `
+            SELECT id, secret, is_reference FROM provider_keys
+            WHERE provider_id = $1 AND name = $2
+            ORDER BY id DESC LIMIT 1
+        `, providerID, k.Name).Scan(&id, &secret, &isReference)
+
+		switch {
+		case err == sql.ErrNoRows:
+			if id, err = imp.insertKey(ctx, providerID, k.Name, k); err != nil {
+				return err
+			}
+			imp.recordKey(label, "created", "", k)
+
+		case err != nil:
+			return err
+
+		// the same key imported again
+		case secret == k.Secret && isReference == k.Reference:
+
+		case imp.opts.OnConflict == ConflictOverwrite:
+			// the new secret was never checked, nor did it cool down
+			if _, err := imp.tx.ExecContext(ctx, `
+                UPDATE provider_keys
+                SET secret = $1, is_reference = $2, is_active = $3, expires_at = $4, rotate_after = $5,
+                    status = 'unknown', last_checked_at = NULL, cooldown_until = NULL,
+                    updated_at = CURRENT_TIMESTAMP
+                WHERE id = $6
+            `, k.Secret, k.Reference, k.IsActive, nullString(k.ExpiresAt), nullString(k.RotateAfter), id); err != nil {
+				return err
+			}
+			imp.recordKey(label, "updated", "", k)
+
+		case imp.opts.OnConflict == ConflictRename:
+			name, err := imp.uniqueName(ctx, k.Name, "SELECT COUNT(*) FROM provider_keys WHERE provider_id = $1 AND name = $2", providerID)
+			if err != nil {
+				return err
+			}
+
+			if id, err = imp.insertKey(ctx, providerID, name, k); err != nil {
+				return err
+			}
+			imp.recordKey(label, "renamed", k.Provider+"/"+name, k)
+
+		default:
+			imp.record("key", label, "skipped", "a different key has this name")
+		}
+
+		imp.keys[label] = id
+	}
+
+	return nil
+}
+
+func (imp *importer) insertKey(ctx context.Context, providerID int64, name string, k BundleKey) (int64, error) {
+	result, err := imp.tx.ExecContext(ctx, `
+        INSERT INTO provider_keys (provider_id, name, secret, is_reference, is_active, expires_at, rotate_after)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `, providerID, name, k.Secret, k.Reference, k.IsActive, nullString(k.ExpiresAt), nullString(k.RotateAfter))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+func (imp *importer) profiles(ctx context.Context, profiles []BundleProfile) error {
+	for _, p := range profiles {
+		if p.Name == "" {
+			return fmt.Errorf("profile name cannot be empty")
+		}
+
+		var id int64
+		var action string
+		var notes []string
+
+		err := imp.tx.QueryRowContext(ctx, "SELECT id FROM profiles WHERE name = $1", p.Name).Scan(&id)
+
+		switch {
+		case err == sql.ErrNoRows:
+			if id, err = imp.insertProfile(ctx, p.Name); err != nil {
+				return err
+			}
+			action = "created"
+
+		case err != nil:
+			return err
+
+		case imp.opts.OnConflict == ConflictOverwrite:
+			action = "updated"
+
+		case imp.opts.OnConflict == ConflictRename:
+			name, err := imp.uniqueName(ctx, p.Name, "SELECT COUNT(*) FROM profiles WHERE name = $1")
+			if err != nil {
+				return err
+			}
+
+			if id, err = imp.insertProfile(ctx, name); err != nil {
+				return err
+			}
+			action, notes = "renamed", []string{name}
+
+		default:
+			imp.record("profile", p.Name, "skipped", "a profile has this name")
+			continue
+		}
+
+		note, err := imp.applyProfile(ctx, id, p)
+		if err != nil {
+			return fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+
+		if note != "" {
+			notes = append(notes, note)
+		}
+
+		imp.record("profile", p.Name, action, strings.Join(notes, ", "))
+	}
+
+	return nil
+}
+
+func (imp *importer) insertProfile(ctx context.Context, name string) (int64, error) {
+	result, err := imp.tx.ExecContext(ctx, "INSERT INTO profiles (name) VALUES ($1)", name)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// applyProfile replaces the settings and aliases of the stored profile id
+// with the bundle's, the note says what could not be applied
+func (imp *importer) applyProfile(ctx context.Context, id int64, p BundleProfile) (note string, err error) {
+	if _, err := imp.tx.ExecContext(ctx, `
+        UPDATE profiles
+        SET cache_enabled = $1, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $2
+    `, p.CacheEnabled, id); err != nil {
+		return "", err
+	}
+
+	var providerID, keyID sql.NullInt64
+
+	if p.Provider != "" {
+		pid, ok, err := imp.providerID(ctx, p.Provider)
+		if err != nil {
+			return "", err
+		}
+
+		if ok {
+			providerID = sql.NullInt64{Int64: pid, Valid: true}
+		} else {
+			note = "unknown provider " + p.Provider + ", none selected"
+		}
+	}
+
+	if providerID.Valid && p.Key != "" {
+		label := p.Provider + "/" + p.Key
+
+		if kid, ok := imp.keys[label]; ok {
+			keyID = sql.NullInt64{Int64: kid, Valid: true}
+		} else {
+			// a key of that name the importing user already has
+			err := imp.tx.QueryRowContext(ctx, `
+                SELECT id FROM provider_keys
+                WHERE provider_id = $1 AND name = $2
+                ORDER BY id DESC LIMIT 1
+            `, providerID.Int64, p.Key).Scan(&keyID)
+
+			switch {
+			case err == sql.ErrNoRows:
+				note = "no key " + label + ", using the provider's most recent key"
+			case err != nil:
+				return "", err
+			}
+		}
+	}
+
+	result, err := imp.tx.ExecContext(ctx, `
+        UPDATE profile_settings
+        SET provider_id = $1, provider_key_id = $2, updated_at = CURRENT_TIMESTAMP
+        WHERE profile_id = $3
+    `, providerID, keyID, id)
+	if err != nil {
+		return "", err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		if _, err := imp.tx.ExecContext(ctx, "INSERT INTO profile_settings (profile_id, provider_id, provider_key_id) VALUES ($1, $2, $3)", id, providerID, keyID); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := imp.tx.ExecContext(ctx, "DELETE FROM model_aliases WHERE profile_id = $1", id); err != nil {
+		return "", err
+	}
+
+	for alias, model := range p.Aliases {
+		if _, err := imp.tx.ExecContext(ctx, "INSERT INTO model_aliases (profile_id, alias, model) VALUES ($1, $2, $3)", id, alias, model); err != nil {
+			return "", err
+		}
+	}
+
+	return note, nil
+}
+
+// uniqueName returns name with an -imported suffix, numbered until the
+// count query, given args and then the name, finds no row
+func (imp *importer) uniqueName(ctx context.Context, name, countQuery string, args ...any) (string, error) {
+	for i := 1; ; i++ {
+		candidate := importedName(name, i)
+
+		var count int
+		if err := imp.tx.QueryRowContext(ctx, countQuery, append(args, candidate)...).Scan(&count); err != nil {
+			return "", err
+		}
+
+		if count == 0 {
+			return candidate, nil
+		}
+	}
+}
+
+// importedName is the i-th name tried for a renamed profile or key
+func importedName(name string, i int) string {
+	if i > 1 {
+		return fmt.Sprintf("%s-imported-%d", name, i)
+	}
+
+	return name + "-imported"
+}
+
+// nullString stores an empty string as NULL
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
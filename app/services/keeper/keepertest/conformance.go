@@ -0,0 +1,850 @@
+package keepertest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"keeper/services/keeper"
+)
+
+// Opener returns a new repository seeded as NewDatabase and NewMemory seed
+// theirs: the active default profile selecting a provider of the registry
+type Opener func(t *testing.T) keeper.Repository
+
+// Conformance checks that the repositories open returns behave as every
+// keeper.Repository must, each subtest opens its own
+func Conformance(t *testing.T, open Opener) {
+	t.Helper()
+
+	suite := []struct {
+		name string
+		run  func(t *testing.T, open Opener)
+	}{
+		{"Profiles", conformProfiles},
+		{"Providers", conformProviders},
+		{"Keys", conformKeys},
+		{"KeyUsability", conformKeyUsability},
+		{"Aliases", conformAliases},
+		{"Settings", conformSettings},
+		{"Watch", conformWatch},
+		{"Bundle", conformBundle},
+		{"BundleConflicts", conformBundleConflicts},
+	}
+
+	for _, s := range suite {
+		t.Run(s.name, func(t *testing.T) { s.run(t, open) })
+	}
+}
+
+// check fails the test when err is set
+func check(t *testing.T, err error, what string) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("failed to %s: %v", what, err)
+	}
+}
+
+// fails fails the test unless err is set
+func fails(t *testing.T, err error, what string) {
+	t.Helper()
+
+	if err == nil {
+		t.Errorf("%s did not fail", what)
+	}
+}
+
+// selectedProvider is the provider the active profile selects
+func selectedProvider(t *testing.T, repo keeper.Repository) *keeper.Provider {
+	t.Helper()
+
+	settings, err := repo.GetActiveProfileSettingsWithKey(context.Background())
+	check(t, err, "get active profile settings")
+
+	provider, err := repo.GetProviderByName(context.Background(), settings.Provider.Name)
+	check(t, err, "get selected provider")
+
+	return provider
+}
+
+// keyInfo is the listed key with the given ID
+func keyInfo(t *testing.T, repo keeper.Repository, id int64) keeper.ProviderKeyInfo {
+	t.Helper()
+
+	keys, err := repo.ListProviderKeys(context.Background())
+	check(t, err, "list keys")
+
+	for _, k := range keys {
+		if k.ID == id {
+			return k
+		}
+	}
+
+	t.Fatalf("key %d is not listed", id)
+	return keeper.ProviderKeyInfo{}
+}
+
+// activeKeyIDs are the IDs ListActiveKeys returns for the provider, in
+// order
+func activeKeyIDs(t *testing.T, repo keeper.Repository, providerID int64) []int64 {
+	t.Helper()
+
+	keys, err := repo.ListActiveKeys(context.Background())
+	check(t, err, "list active keys")
+
+	var ids []int64
+	for _, k := range keys {
+		if k.ID == providerID {
+			ids = append(ids, k.ProviderKey.ID)
+		}
+	}
+
+	return ids
+}
+
+// settingsKeyID is the ID of the key the active profile uses, zero when none
+func settingsKeyID(t *testing.T, repo keeper.Repository) int64 {
+	t.Helper()
+
+	settings, err := repo.GetActiveProfileSettingsWithKey(context.Background())
+	check(t, err, "get active profile settings")
+
+	return settings.Provider.ProviderKey.ID
+}
+
+func conformProfiles(t *testing.T, open Opener) {
+	ctx := context.Background()
+	repo := open(t)
+
+	profiles, err := repo.ListProfiles(ctx)
+	check(t, err, "list profiles")
+
+	if len(profiles) != 1 || profiles[0].Name != "default" || !profiles[0].IsActive || !profiles[0].IsDefault {
+		t.Fatalf("seeded profiles are %+v, want the active default profile", profiles)
+	}
+
+	id, err := repo.CreateProfile(ctx, keeper.CreateProfileReq{Name: "work"})
+	check(t, err, "create profile")
+
+	_, err = repo.CreateProfile(ctx, keeper.CreateProfileReq{Name: "work"})
+	fails(t, err, "creating a second profile named work")
+
+	check(t, repo.SetActiveProfile(ctx, "work"), "activate profile")
+
+	active, err := repo.GetActiveProfile(ctx)
+	check(t, err, "get active profile")
+
+	if active.ID != id || active.Name != "work" {
+		t.Errorf("active profile is %+v, want work", active)
+	}
+
+	fails(t, repo.SetActiveProfile(ctx, "missing"), "activating a missing profile")
+	fails(t, repo.SetActiveProfile(ctx, ""), "activating a profile without a name")
+
+	check(t, repo.SetProfileCache(ctx, "work", true), "enable cache")
+	fails(t, repo.SetProfileCache(ctx, "missing", true), "enabling the cache of a missing profile")
+
+	profiles, err = repo.ListProfiles(ctx)
+	check(t, err, "list profiles")
+
+	var names []string
+	for _, p := range profiles {
+		names = append(names, p.Name)
+
+		if p.IsActive != (p.Name == "work") {
+			t.Errorf("profile %s is active: %v", p.Name, p.IsActive)
+		}
+
+		if p.CacheEnabled != (p.Name == "work") {
+			t.Errorf("profile %s caches: %v", p.Name, p.CacheEnabled)
+		}
+	}
+
+	if !reflect.DeepEqual(names, []string{"default", "work"}) {
+		t.Errorf("profiles are listed as %v, want default, work", names)
+	}
+}
+
+func conformProviders(t *testing.T, open Opener) {
+	ctx := context.Background()
+	repo := open(t)
+
+	providers, err := repo.ListProvidersWithKey(ctx)
+	check(t, err, "list providers")
+
+	if len(providers) == 0 {
+		t.Fatalf("no providers were seeded")
+	}
+
+	for i, p := range providers {
+		if p.SelectedKeyID != nil {
+			t.Errorf("provider %s has key %s before any was added", p.Name, *p.SelectedKeyID)
+		}
+
+		if i > 0 && p.ID <= providers[i-1].ID {
+			t.Errorf("providers are not listed by ID")
+		}
+	}
+
+	provider, err := repo.GetProviderByName(ctx, providers[0].Name)
+	check(t, err, "get provider")
+
+	if provider.ID != providers[0].ID || provider.BaseURL != providers[0].BaseURL || provider.Model != providers[0].Model {
+		t.Errorf("got provider %+v, want %+v", provider, providers[0])
+	}
+
+	_, err = repo.GetProviderByName(ctx, "missing")
+	fails(t, err, "getting a missing provider")
+
+	_, err = repo.GetProviderByName(ctx, "")
+	fails(t, err, "getting a provider without a name")
+
+	_, err = repo.GetProviderByNameWithKey(ctx, "missing")
+	fails(t, err, "getting a missing provider with its key")
+
+	// a batch is stored whole or not at all
+	_, err = repo.CreateProviders(ctx,
+		keeper.Provider{Name: "conformance-a", BaseURL: "https://a.example", Model: "a"},
+		keeper.Provider{Name: "conformance-b", BaseURL: "https://b.example"},
+	)
+	fails(t, err, "creating a provider without a model")
+
+	_, err = repo.CreateProviders(ctx,
+		keeper.Provider{Name: "conformance-a", BaseURL: "https://a.example", Model: "a"},
+		keeper.Provider{Name: providers[0].Name, BaseURL: "https://b.example", Model: "b"},
+	)
+	fails(t, err, "creating a provider whose name is taken")
+
+	if _, err := repo.GetProviderByName(ctx, "conformance-a"); err == nil {
+		t.Errorf("a failed batch stored a provider")
+	}
+
+	ids, err := repo.CreateProviders(ctx, keeper.Provider{Name: "conformance-a", BaseURL: "https://a.example", Model: "a"})
+	check(t, err, "create provider")
+
+	created, err := repo.GetProviderByName(ctx, "conformance-a")
+	check(t, err, "get created provider")
+
+	if len(ids) != 1 || ids[0] != created.ID {
+		t.Errorf("created provider %d, stored as %d", ids, created.ID)
+	}
+
+	for i := 0; i < 2; i++ {
+		check(t, repo.CreateMissingProviders(ctx,
+			keeper.Provider{Name: providers[0].Name, BaseURL: "https://changed.example", Model: "changed"},
+			keeper.Provider{Name: "conformance-b", BaseURL: "https://b.example", Model: "b"},
+		), "create missing providers")
+	}
+
+	all, err := repo.ListProvidersWithKey(ctx)
+	check(t, err, "list providers")
+
+	if len(all) != len(providers)+2 {
+		t.Errorf("%d providers after adding two to %d", len(all), len(providers))
+	}
+
+	if all[0].BaseURL != providers[0].BaseURL {
+		t.Errorf("CreateMissingProviders changed %s", all[0].Name)
+	}
+}
+
+func conformKeys(t *testing.T, open Opener) {
+	ctx := context.Background()
+	repo := open(t)
+	provider := selectedProvider(t, repo)
+
+	first, err := repo.CreateProviderKey(ctx, *provider, "sk-first", keeper.ProviderKeyOptions{Name: "first"})
+	check(t, err, "create key")
+
+	if got := settingsKeyID(t, repo); got != first {
+		t.Errorf("the active profile uses key %d, want its first key %d", got, first)
+	}
+
+	second, err := repo.CreateProviderKey(ctx, *provider, "sk-second", keeper.ProviderKeyOptions{})
+	check(t, err, "create key")
+
+	if got := settingsKeyID(t, repo); got != first {
+		t.Errorf("the active profile switched to key %d, want it to keep %d", got, first)
+	}
+
+	_, err = repo.CreateProviderKey(ctx, keeper.Provider{ID: -1, Name: "missing"}, "sk-orphan", keeper.ProviderKeyOptions{})
+	fails(t, err, "creating a key of a missing provider")
+
+	info := keyInfo(t, repo, second)
+	if info.Name != provider.Name || info.ProviderID != provider.ID || info.ProviderName != provider.Name {
+		t.Errorf("key %d is listed as %+v, want it named after provider %s", second, info, provider.Name)
+	}
+
+	if !info.IsActive || info.Status != keeper.KeyStatusUnknown || info.CreatedAt == "" || info.LastCheckedAt != "" {
+		t.Errorf("new key is listed as %+v, want it active, unchecked and with its creation time", info)
+	}
+
+	withKey, err := repo.GetProviderByNameWithKey(ctx, provider.Name)
+	check(t, err, "get provider with key")
+
+	if withKey.ProviderKey.ID != second || withKey.Secret != "sk-second" || withKey.SelectedKeyID == nil || *withKey.SelectedKeyID != fmt.Sprint(second) {
+		t.Errorf("provider comes with key %+v, want the newest %d", withKey.ProviderKey, second)
+	}
+
+	if ids := activeKeyIDs(t, repo, provider.ID); !reflect.DeepEqual(ids, []int64{second, first}) {
+		t.Errorf("active keys are %v, want %v", ids, []int64{second, first})
+	}
+
+	key, err := repo.GetProviderKey(ctx, first)
+	check(t, err, "get key")
+
+	if key.ID != provider.ID || key.ProviderKey.ID != first || key.Name != provider.Name || key.ProviderKey.Name != "first" || key.Secret != "sk-first" {
+		t.Errorf("got key %+v, want %d of %s", key, first, provider.Name)
+	}
+
+	_, err = repo.GetProviderKey(ctx, second+1000)
+	fails(t, err, "getting a missing key")
+
+	check(t, repo.SetProviderKeyStatus(ctx, second, keeper.KeyStatusValid), "set key status")
+
+	if info := keyInfo(t, repo, second); info.Status != keeper.KeyStatusValid || info.LastCheckedAt == "" {
+		t.Errorf("checked key is listed as %+v", info)
+	}
+
+	check(t, repo.SetProviderKeyStatus(ctx, second, keeper.KeyStatusInvalid), "set key status")
+
+	if ids := activeKeyIDs(t, repo, provider.ID); !reflect.DeepEqual(ids, []int64{first}) {
+		t.Errorf("active keys are %v after the newest was found invalid, want %v", ids, []int64{first})
+	}
+
+	check(t, repo.SetProviderKeyStatus(ctx, second, keeper.KeyStatusValid), "set key status")
+	check(t, repo.SetProviderKeyStatus(ctx, second, keeper.KeyStatusRevoked), "set key status")
+
+	// a rejected key is deactivated, but still checked so it comes back
+	if info := keyInfo(t, repo, second); info.IsActive || !info.Checked() || info.Status != keeper.KeyStatusRevoked {
+		t.Errorf("revoked key is listed as %+v", info)
+	}
+
+	withKey, err = repo.GetProviderByNameWithKey(ctx, provider.Name)
+	check(t, err, "get provider with key")
+
+	if withKey.ProviderKey.ID != first {
+		t.Errorf("provider comes with key %d after %d was revoked, want %d", withKey.ProviderKey.ID, second, first)
+	}
+
+	if _, err := repo.GetProviderKey(ctx, second); err != nil {
+		t.Errorf("a revoked key can't be read: %v", err)
+	}
+
+	check(t, repo.SetProviderKeyStatus(ctx, second, keeper.KeyStatusValid), "set key status")
+
+	if info := keyInfo(t, repo, second); !info.IsActive {
+		t.Errorf("revoked key found valid is listed as %+v", info)
+	}
+
+	if ids := activeKeyIDs(t, repo, provider.ID); !reflect.DeepEqual(ids, []int64{second, first}) {
+		t.Errorf("active keys are %v after the revoked key was found valid, want %v", ids, []int64{second, first})
+	}
+
+	check(t, repo.SetProviderKeyStatus(ctx, second, keeper.KeyStatusRevoked), "set key status")
+
+	// only keys stored as references are resolved
+	ref, err := repo.CreateProviderKey(ctx, *provider, "env:CONFORMANCE_KEY", keeper.ProviderKeyOptions{Name: "ref", Reference: true})
+	check(t, err, "create reference")
+
+	withKey, err = repo.GetProviderByNameWithKey(ctx, provider.Name)
+	check(t, err, "get provider with key")
+
+	if withKey.ProviderKey.ID != ref || !withKey.IsReference {
+		t.Errorf("provider comes with key %+v, want reference %d", withKey.ProviderKey, ref)
+	}
+
+	if key, err := repo.GetProviderKey(ctx, first); err != nil || key.IsReference {
+		t.Errorf("key %d stored as it is reads as %+v, %v", first, key, err)
+	}
+
+	// a key deactivated for another reason stays so, checks leave it alone
+	_, err = repo.Import(ctx, &keeper.Bundle{
+		Version: keeper.BundleVersion,
+		Keys:    []keeper.BundleKey{{Provider: provider.Name, Name: "inactive", Secret: "sk-inactive"}},
+	}, keeper.ImportOptions{})
+	check(t, err, "import inactive key")
+
+	keys, err := repo.ListProviderKeys(ctx)
+	check(t, err, "list keys")
+
+	inactive := slices.IndexFunc(keys, func(k keeper.ProviderKeyInfo) bool { return k.Name == "inactive" })
+	if inactive < 0 {
+		t.Fatalf("imported key is not listed in %+v", keys)
+	}
+
+	check(t, repo.SetProviderKeyStatus(ctx, keys[inactive].ID, keeper.KeyStatusValid), "set key status")
+
+	if info := keyInfo(t, repo, keys[inactive].ID); info.IsActive || info.Checked() {
+		t.Errorf("inactive key found valid is listed as %+v", info)
+	}
+
+	fails(t, repo.SetProviderKeyStatus(ctx, second+1000, keeper.KeyStatusValid), "checking a missing key")
+	fails(t, repo.SetProviderKeyCooldown(ctx, second+1000, time.Time{}), "cooling down a missing key")
+}
+
+func conformKeyUsability(t *testing.T, open Opener) {
+	ctx := context.Background()
+	repo := open(t)
+	provider := selectedProvider(t, repo)
+
+	next, err := repo.NextKeyExpiry(ctx)
+	check(t, err, "get next key expiry")
+
+	if !next.IsZero() {
+		t.Errorf("next key expiry is %v without keys", next)
+	}
+
+	id, err := repo.CreateProviderKey(ctx, *provider, "sk-cooling", keeper.ProviderKeyOptions{Name: "cooling"})
+	check(t, err, "create key")
+
+	check(t, repo.SetProviderKeyCooldown(ctx, id, time.Now().Add(time.Hour)), "set cooldown")
+
+	if info := keyInfo(t, repo, id); info.CooldownUntil == "" {
+		t.Errorf("cooling down key is listed as %+v", info)
+	}
+
+	if ids := activeKeyIDs(t, repo, provider.ID); len(ids) != 0 {
+		t.Errorf("active keys are %v while the only key cools down", ids)
+	}
+
+	if got := settingsKeyID(t, repo); got != 0 {
+		t.Errorf("the active profile uses key %d while it cools down", got)
+	}
+
+	check(t, repo.SetProviderKeyCooldown(ctx, id, time.Time{}), "clear cooldown")
+
+	if got := settingsKeyID(t, repo); got != id {
+		t.Errorf("the active profile uses key %d after the cooldown, want %d", got, id)
+	}
+
+	check(t, repo.SetProviderKeyCooldown(ctx, id, time.Now().Add(-time.Hour)), "set past cooldown")
+
+	if ids := activeKeyIDs(t, repo, provider.ID); !reflect.DeepEqual(ids, []int64{id}) {
+		t.Errorf("active keys are %v once the cooldown passed, want %v", ids, []int64{id})
+	}
+
+	expired, err := repo.CreateProviderKey(ctx, *provider, "sk-expired", keeper.ProviderKeyOptions{
+		Name:      "expired",
+		ExpiresAt: time.Now().Add(-time.Hour),
+	})
+	check(t, err, "create expired key")
+
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	rotation := expiry.Add(-30 * time.Minute)
+
+	expiring, err := repo.CreateProviderKey(ctx, *provider, "sk-expiring", keeper.ProviderKeyOptions{
+		Name:        "expiring",
+		ExpiresAt:   expiry,
+		RotateAfter: rotation,
+	})
+	check(t, err, "create expiring key")
+
+	if ids := activeKeyIDs(t, repo, provider.ID); !reflect.DeepEqual(ids, []int64{expiring, id}) {
+		t.Errorf("active keys are %v, want %v without the expired key %d", ids, []int64{expiring, id}, expired)
+	}
+
+	info := keyInfo(t, repo, expiring)
+	if info.ExpiresAt != expiry.Format(time.DateTime) || info.RotateAfter != rotation.Format(time.DateTime) {
+		t.Errorf("expiring key is listed as %+v", info)
+	}
+
+	next, err = repo.NextKeyExpiry(ctx)
+	check(t, err, "get next key expiry")
+
+	if !next.Equal(expiry) {
+		t.Errorf("next key expiry is %v, want %v", next, expiry)
+	}
+}
+
+func conformAliases(t *testing.T, open Opener) {
+	ctx := context.Background()
+	repo := open(t)
+
+	check(t, repo.SetModelAlias(ctx, "default", "fast", "model-1"), "set alias")
+	check(t, repo.SetModelAlias(ctx, "default", "fast", "model-2"), "replace alias")
+	check(t, repo.SetModelAlias(ctx, "default", "big", "model-3"), "set alias")
+
+	_, err := repo.CreateProfile(ctx, keeper.CreateProfileReq{Name: "alpha"})
+	check(t, err, "create profile")
+	check(t, repo.SetModelAlias(ctx, "alpha", "zoom", "model-4"), "set alias")
+
+	fails(t, repo.SetModelAlias(ctx, "missing", "fast", "model"), "aliasing in a missing profile")
+	fails(t, repo.SetModelAlias(ctx, "default", "", "model"), "setting an alias without a name")
+
+	aliases, err := repo.ListModelAliases(ctx)
+	check(t, err, "list aliases")
+
+	var got []string
+	for _, a := range aliases {
+		got = append(got, a.ProfileName+"/"+a.Alias+"="+a.Model)
+	}
+
+	want := []string{"alpha/zoom=model-4", "default/big=model-3", "default/fast=model-2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("aliases are %v, want %v", got, want)
+	}
+
+	check(t, repo.DeleteModelAlias(ctx, "default", "fast"), "delete alias")
+	fails(t, repo.DeleteModelAlias(ctx, "default", "fast"), "deleting a deleted alias")
+	fails(t, repo.DeleteModelAlias(ctx, "missing", "big"), "deleting an alias of a missing profile")
+
+	aliases, err = repo.ListModelAliases(ctx)
+	check(t, err, "list aliases")
+
+	if len(aliases) != 2 {
+		t.Errorf("%d aliases left, want 2", len(aliases))
+	}
+}
+
+func conformSettings(t *testing.T, open Opener) {
+	ctx := context.Background()
+	repo := open(t)
+
+	active, err := repo.GetActiveProfileSettingsWithKey(ctx)
+	check(t, err, "get active profile settings")
+
+	named, err := repo.GetProfileSettingsWithKey(ctx, "default")
+	check(t, err, "get profile settings")
+
+	if !reflect.DeepEqual(active, named) {
+		t.Errorf("settings of the active profile %+v differ from those of default %+v", active, named)
+	}
+
+	if active.ProviderID == 0 || active.ProviderID != active.Provider.ID || active.Provider.Name == "" || active.Provider.BaseURL == "" {
+		t.Errorf("seeded settings are %+v, want a provider selected", active)
+	}
+
+	_, err = repo.GetProfileSettingsWithKey(ctx, "")
+	fails(t, err, "getting settings of a profile without a name")
+
+	_, err = repo.GetProfileSettingsWithKey(ctx, "missing")
+	fails(t, err, "getting settings of a missing profile")
+
+	id, err := repo.CreateProfile(ctx, keeper.CreateProfileReq{Name: "bare"})
+	check(t, err, "create profile")
+
+	_, err = repo.GetProfileSettingsWithKey(ctx, "bare")
+	fails(t, err, "getting settings of a profile that has none")
+
+	_, err = repo.CreateProfileSettings(ctx, keeper.ProfileSettings{ProfileID: id})
+	fails(t, err, "creating settings without a provider")
+
+	_, err = repo.CreateProfileSettings(ctx, keeper.ProfileSettings{ProfileID: id + 1000, ProviderID: active.ProviderID})
+	fails(t, err, "creating settings of a missing profile")
+
+	_, err = repo.CreateProfileSettings(ctx, keeper.ProfileSettings{ProfileID: id, ProviderID: active.ProviderID})
+	check(t, err, "create profile settings")
+
+	settings, err := repo.GetProfileSettingsWithKey(ctx, "bare")
+	check(t, err, "get profile settings")
+
+	if settings.ProfileID != id || settings.ProviderID != active.ProviderID || settings.Provider.ProviderKey.ID != 0 {
+		t.Errorf("new settings are %+v, want provider %d without a key", settings, active.ProviderID)
+	}
+
+	// a key is picked for the active profile only
+	provider := selectedProvider(t, repo)
+	_, err = repo.CreateProviderKey(ctx, *provider, "sk-default", keeper.ProviderKeyOptions{})
+	check(t, err, "create key")
+
+	settings, err = repo.GetProfileSettingsWithKey(ctx, "bare")
+	check(t, err, "get profile settings")
+
+	if settings.Provider.ProviderKey.ID != 0 {
+		t.Errorf("an inactive profile was given key %d", settings.Provider.ProviderKey.ID)
+	}
+}
+
+func conformWatch(t *testing.T, open Opener) {
+	repo := open(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes, err := repo.Watch(ctx, 10*time.Millisecond)
+	check(t, err, "watch")
+
+	check(t, repo.SetModelAlias(context.Background(), "default", "fast", "model"), "set alias")
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Watch did not signal a change")
+	}
+
+	cancel()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Watch did not close its channel once the context was done")
+		}
+	}
+}
+
+// setupToExport adds a profile, a provider, keys and aliases worth exporting
+func setupToExport(t *testing.T, repo keeper.Repository) {
+	t.Helper()
+
+	ctx := context.Background()
+	provider := selectedProvider(t, repo)
+
+	_, err := repo.CreateProviderKey(ctx, *provider, "sk-shared", keeper.ProviderKeyOptions{
+		Name:      "shared",
+		ExpiresAt: time.Now().Add(24 * time.Hour),
+	})
+	check(t, err, "create key")
+
+	_, err = repo.CreateProviderKey(ctx, *provider, "env:CONFORMANCE_KEY", keeper.ProviderKeyOptions{Name: "shared-ref", Reference: true})
+	check(t, err, "create reference")
+
+	_, err = repo.CreateProviders(ctx, keeper.Provider{Name: "conformance", BaseURL: "https://conformance.example", Model: "c"})
+	check(t, err, "create provider")
+
+	id, err := repo.CreateProfile(ctx, keeper.CreateProfileReq{Name: "team"})
+	check(t, err, "create profile")
+
+	_, err = repo.CreateProfileSettings(ctx, keeper.ProfileSettings{ProfileID: id, ProviderID: provider.ID})
+	check(t, err, "create profile settings")
+
+	check(t, repo.SetProfileCache(ctx, "team", true), "enable cache")
+	check(t, repo.SetModelAlias(ctx, "team", "fast", "model-fast"), "set alias")
+	check(t, repo.SetModelAlias(ctx, "default", "big", "model-big"), "set alias")
+}
+
+func export(t *testing.T, repo keeper.Repository) *keeper.Bundle {
+	t.Helper()
+
+	b, err := repo.Export(context.Background(), true)
+	check(t, err, "export")
+
+	b.CreatedAt = ""
+	return b
+}
+
+func conformBundle(t *testing.T, open Opener) {
+	ctx := context.Background()
+
+	src := open(t)
+	setupToExport(t, src)
+
+	b := export(t, src)
+	if len(b.Keys) != 2 || b.Keys[0].Secret != "sk-shared" || b.Keys[0].ExpiresAt == "" || b.Keys[0].Reference || !b.Keys[1].Reference {
+		t.Fatalf("exported keys are %+v, want the shared key and reference", b.Keys)
+	}
+
+	withoutKeys, err := src.Export(ctx, false)
+	check(t, err, "export")
+
+	if len(withoutKeys.Keys) != 0 || withoutKeys.Version != keeper.BundleVersion || withoutKeys.CreatedAt == "" {
+		t.Errorf("export without keys is %+v", withoutKeys)
+	}
+
+	dryRun := open(t)
+	before := export(t, dryRun)
+
+	changes, err := dryRun.Import(ctx, b, keeper.ImportOptions{DryRun: true})
+	check(t, err, "import")
+
+	if len(changes) == 0 {
+		t.Errorf("a dry run reported no changes")
+	}
+
+	if after := export(t, dryRun); !reflect.DeepEqual(before, after) {
+		t.Errorf("a dry run changed the setup")
+	}
+
+	dst := open(t)
+
+	changes, err = dst.Import(ctx, b, keeper.ImportOptions{OnConflict: keeper.ConflictOverwrite})
+	check(t, err, "import")
+
+	var references []string
+	for _, c := range changes {
+		if c.Reference != "" {
+			references = append(references, c.Name+"="+c.Reference)
+		}
+	}
+
+	if want := []string{b.Keys[1].Provider + "/shared-ref=env:CONFORMANCE_KEY"}; !reflect.DeepEqual(references, want) {
+		t.Errorf("import lists references %v, want %v", references, want)
+	}
+
+	if got := export(t, dst); !reflect.DeepEqual(got, b) {
+		t.Errorf("imported setup exports as\n%+v\nwant\n%+v", got, b)
+	}
+
+	active, err := dst.GetActiveProfile(ctx)
+	check(t, err, "get active profile")
+
+	if active.Name != "default" {
+		t.Errorf("import activated profile %s", active.Name)
+	}
+
+	// importing again changes nothing
+	changes, err = dst.Import(ctx, b, keeper.ImportOptions{})
+	check(t, err, "import")
+
+	for _, c := range changes {
+		if c.Action != "skipped" {
+			t.Errorf("importing again made change %+v", c)
+		}
+	}
+
+	// a bundle is imported whole or not at all
+	broken := export(t, src)
+	broken.Providers = append(broken.Providers, keeper.BundleProvider{Name: "conformance-new", BaseURL: "https://new.example", Model: "n"})
+	broken.Keys = append(broken.Keys, keeper.BundleKey{Provider: "conformance-new", Name: "empty"})
+
+	_, err = dst.Import(ctx, broken, keeper.ImportOptions{})
+	fails(t, err, "importing a key without a secret")
+
+	if _, err := dst.GetProviderByName(ctx, "conformance-new"); err == nil {
+		t.Errorf("a failed import stored a provider")
+	}
+
+	// a reference that runs a command or reads a file where the bundle is
+	// imported needs to be allowed
+	untrusted := &keeper.Bundle{
+		Version: keeper.BundleVersion,
+		Keys: []keeper.BundleKey{
+			{Provider: b.Keys[0].Provider, Name: "untrusted", Secret: "exec:pass show team/openai", Reference: true, IsActive: true},
+		},
+	}
+
+	_, err = dst.Import(ctx, untrusted, keeper.ImportOptions{DryRun: true})
+	fails(t, err, "importing an exec: reference")
+
+	changes, err = dst.Import(ctx, untrusted, keeper.ImportOptions{AllowReferences: true})
+	check(t, err, "import allowed reference")
+
+	if len(changes) != 1 || changes[0].Action != "created" || changes[0].Reference != "exec:pass show team/openai" {
+		t.Errorf("allowed reference was imported as %+v", changes)
+	}
+
+	// a key that merely looks like a reference is imported as it is
+	_, err = dst.Import(ctx, &keeper.Bundle{
+		Version: keeper.BundleVersion,
+		Keys: []keeper.BundleKey{
+			{Provider: b.Keys[0].Provider, Name: "lookalike", Secret: "exec:sk-lookalike", IsActive: true},
+		},
+	}, keeper.ImportOptions{})
+	check(t, err, "import key")
+
+	_, err = dst.Import(ctx, &keeper.Bundle{Version: keeper.BundleVersion + 1}, keeper.ImportOptions{})
+	fails(t, err, "importing a newer bundle")
+
+	_, err = dst.Import(ctx, b, keeper.ImportOptions{OnConflict: "merge"})
+	fails(t, err, "importing with an unknown strategy")
+}
+
+func conformBundleConflicts(t *testing.T, open Opener) {
+	ctx := context.Background()
+
+	src := open(t)
+	setupToExport(t, src)
+	b := export(t, src)
+
+	dst := open(t)
+	_, err := dst.Import(ctx, b, keeper.ImportOptions{})
+	check(t, err, "import")
+
+	// the bundle's key and profile change under the same names
+	b.Keys[0].Secret = "sk-rotated"
+	for i := range b.Profiles {
+		if b.Profiles[i].Name == "team" {
+			b.Profiles[i].Aliases = map[string]string{"fast": "model-faster"}
+		}
+	}
+
+	actions := func(changes []keeper.ImportChange) map[string]string {
+		got := map[string]string{}
+		for _, c := range changes {
+			got[c.Kind+" "+c.Name] = c.Action
+			if c.Action == "renamed" {
+				got[c.Kind+" "+c.Name] += " " + c.Detail
+			}
+		}
+		return got
+	}
+
+	keyName := "key " + b.Keys[0].Provider + "/shared"
+
+	changes, err := dst.Import(ctx, b, keeper.ImportOptions{OnConflict: keeper.ConflictSkip})
+	check(t, err, "import")
+
+	if got := actions(changes); got[keyName] != "skipped" || got["profile team"] != "skipped" {
+		t.Errorf("skip made changes %v", got)
+	}
+
+	changes, err = dst.Import(ctx, b, keeper.ImportOptions{OnConflict: keeper.ConflictRename})
+	check(t, err, "import")
+
+	got := actions(changes)
+	if got[keyName] != "renamed "+b.Keys[0].Provider+"/shared-imported" || got["profile team"] != "renamed team-imported" {
+		t.Errorf("rename made changes %v", got)
+	}
+
+	changes, err = dst.Import(ctx, b, keeper.ImportOptions{OnConflict: keeper.ConflictRename})
+	check(t, err, "import")
+
+	if got := actions(changes); got["profile team"] != "renamed team-imported-2" {
+		t.Errorf("renaming again made changes %v", got)
+	}
+
+	renamed, err := dst.GetProfileSettingsWithKey(ctx, "team-imported")
+	check(t, err, "get renamed profile settings")
+
+	if renamed.Provider.Name != b.Keys[0].Provider {
+		t.Errorf("renamed profile selects %q, want %q", renamed.Provider.Name, b.Keys[0].Provider)
+	}
+
+	keys, err := dst.ListProviderKeys(ctx)
+	check(t, err, "list keys")
+
+	var sharedID int64
+	for _, k := range keys {
+		if k.Name == "shared" {
+			sharedID = k.ID
+		}
+	}
+
+	check(t, dst.SetProviderKeyStatus(ctx, sharedID, keeper.KeyStatusInvalid), "set key status")
+
+	changes, err = dst.Import(ctx, b, keeper.ImportOptions{OnConflict: keeper.ConflictOverwrite})
+	check(t, err, "import")
+
+	if got := actions(changes); got[keyName] != "updated" || got["profile team"] != "updated" {
+		t.Errorf("overwrite made changes %v", got)
+	}
+
+	key, err := dst.GetProviderKey(ctx, sharedID)
+	check(t, err, "get key")
+
+	if key.Secret != "sk-rotated" {
+		t.Errorf("overwritten key has secret %q", key.Secret)
+	}
+
+	if info := keyInfo(t, dst, sharedID); info.Status != keeper.KeyStatusUnknown || info.LastCheckedAt != "" {
+		t.Errorf("overwritten key keeps the checks of the old secret: %+v", info)
+	}
+
+	aliases, err := dst.ListModelAliases(ctx)
+	check(t, err, "list aliases")
+
+	for _, a := range aliases {
+		if a.ProfileName == "team" && a.Model != "model-faster" {
+			t.Errorf("overwritten profile aliases %s to %s", a.Alias, a.Model)
+		}
+	}
+}
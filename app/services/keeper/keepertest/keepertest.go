@@ -0,0 +1,408 @@
+// Package keepertest checks keeper repositories from go test: that every
+// keeper.Repository behaves the same, and that a keeper database holds up
+// when the server and several CLI invocations use it at once. Worker
+// processes are the test binary started again:
+//
+//	func TestMain(m *testing.M) {
+//		keepertest.WorkerMain()
+//		os.Exit(m.Run())
+//	}
+//
+//	func TestConcurrentAccess(t *testing.T) {
+//		keepertest.Concurrency(t, keepertest.Options{})
+//	}
+//
+//	func TestMemoryRepository(t *testing.T) {
+//		keepertest.Conformance(t, func(t *testing.T) keeper.Repository {
+//			return keepertest.NewMemory(t)
+//		})
+//	}
+package keepertest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"keeper/internal/database"
+	provider_registry "keeper/internal/provider-registry"
+	"keeper/services/keeper"
+)
+
+const (
+	// workerDBEnv holds the database a worker process writes to, workers
+	// are started with it set
+	workerDBEnv         = "KEEPERTEST_WORKER_DB"
+	workerNameEnv       = "KEEPERTEST_WORKER_NAME"
+	workerIterationsEnv = "KEEPERTEST_WORKER_ITERATIONS"
+
+	// workerProvider is the provider workers add keys to
+	workerProvider = "openai"
+)
+
+// Options configures Concurrency, zero fields take their defaults
+type Options struct {
+	// Goroutines write from this process, 16 by default
+	Goroutines int
+	// Processes write from worker processes, 6 by default, none when
+	// negative
+	Processes int
+	// Iterations is how many rounds of writes each worker makes, 50 by
+	// default
+	Iterations int
+}
+
+func (o Options) withDefaults() Options {
+	if o.Goroutines <= 0 {
+		o.Goroutines = 16
+	}
+	if o.Processes == 0 {
+		o.Processes = 6
+	}
+	if o.Iterations <= 0 {
+		o.Iterations = 50
+	}
+
+	return o
+}
+
+// NewDatabase creates a seeded and migrated keeper database in a temporary
+// directory removed when the test ends
+func NewDatabase(tb testing.TB) (*sql.DB, *keeper.SQLiteRepository, string) {
+	tb.Helper()
+
+	path := filepath.Join(tb.TempDir(), "keeper.db")
+
+	db, repo, err := open(context.Background(), path)
+	if err != nil {
+		tb.Fatalf("failed to create database: %v", err)
+	}
+
+	tb.Cleanup(func() { db.Close() })
+
+	return db, repo, path
+}
+
+// NewMemory creates a keeper.MemoryRepository seeded as NewDatabase seeds a
+// database
+func NewMemory(tb testing.TB) *keeper.MemoryRepository {
+	tb.Helper()
+
+	reg, err := provider_registry.New()
+	if err != nil {
+		tb.Fatalf("failed to load providers: %v", err)
+	}
+
+	repo := keeper.NewMemory()
+	if err := keeper.Seed(context.Background(), repo, database.RegistryProviders(reg)...); err != nil {
+		tb.Fatalf("failed to seed repository: %v", err)
+	}
+
+	return repo
+}
+
+func open(ctx context.Context, path string) (*sql.DB, *keeper.SQLiteRepository, error) {
+	reg, err := provider_registry.New()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := database.NewSQLite(database.Options{Database: path})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	repo, err := keeper.NewSQLite(db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	if err := database.Seed(ctx, db, repo, reg); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	if err := database.Migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return db, repo, nil
+}
+
+// Concurrency writes to one database from opts.Goroutines goroutines and
+// opts.Processes processes at once. It fails the test when a write fails,
+// e.g. with "database is locked", when a write is lost, or when the
+// database fails its integrity and foreign key checks afterwards.
+func Concurrency(tb testing.TB, opts Options) {
+	tb.Helper()
+
+	opts = opts.withDefaults()
+	db, repo, path := NewDatabase(tb)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		Goroutines(tb, repo, opts.Goroutines, opts.Iterations)
+	}()
+
+	if opts.Processes > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Processes(tb, path, opts.Processes, opts.Iterations)
+		}()
+	}
+
+	wg.Wait()
+
+	workers := opts.Goroutines + max(opts.Processes, 0)
+	CountKeys(tb, repo, workers*opts.Iterations)
+	CheckDatabase(tb, db)
+}
+
+// Goroutines runs n workers in this process, each making iterations rounds
+// of writes and reads through repo
+func Goroutines(tb testing.TB, repo keeper.Repository, n, iterations int) {
+	tb.Helper()
+
+	errs := make(chan error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			errs <- work(context.Background(), repo, name, iterations)
+		}(fmt.Sprintf("goroutine%d", i))
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			tb.Error(err)
+		}
+	}
+}
+
+// Processes runs n worker processes against the database at path, each
+// making iterations rounds of writes and reads. They are the running test
+// binary, which must call WorkerMain from TestMain.
+func Processes(tb testing.TB, path string, n, iterations int) {
+	tb.Helper()
+
+	errs := make(chan error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+
+			// no tests run should the binary not call WorkerMain, CountKeys
+			// then reports the missing writes
+			cmd := exec.Command(os.Args[0], "-test.run=^$")
+			cmd.Env = append(os.Environ(),
+				workerDBEnv+"="+path,
+				workerNameEnv+"="+name,
+				workerIterationsEnv+"="+strconv.Itoa(iterations),
+			)
+
+			if out, err := cmd.CombinedOutput(); err != nil {
+				errs <- fmt.Errorf("worker %s failed: %v: %s", name, err, strings.TrimSpace(string(out)))
+				return
+			}
+
+			errs <- nil
+		}(fmt.Sprintf("process%d", i))
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			tb.Error(err)
+		}
+	}
+}
+
+// WorkerMain makes the work of a process started by Processes and exits,
+// it returns right away in any other process
+func WorkerMain() {
+	path := os.Getenv(workerDBEnv)
+	if path == "" {
+		return
+	}
+
+	iterations, err := strconv.Atoi(os.Getenv(workerIterationsEnv))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid %s: %v\n", workerIterationsEnv, err)
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	db, repo, err := open(ctx, path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open database: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = work(ctx, repo, os.Getenv(workerNameEnv), iterations)
+	db.Close()
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+// work makes iterations rounds of the writes the server and CLI make, each
+// round adds one key named after the worker
+func work(ctx context.Context, repo keeper.Repository, name string, iterations int) error {
+	provider, err := repo.GetProviderByName(ctx, workerProvider)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	for i := 0; i < iterations; i++ {
+		key := fmt.Sprintf("%s-%d", name, i)
+
+		// the CLI adding a key
+		id, err := repo.CreateProviderKey(ctx, *provider, "sk-"+key, keeper.ProviderKeyOptions{Name: key})
+		if err != nil {
+			return fmt.Errorf("%s: create key: %w", key, err)
+		}
+
+		// the server's key monitor
+		if err := repo.SetProviderKeyStatus(ctx, id, keeper.KeyStatusValid); err != nil {
+			return fmt.Errorf("%s: set status: %w", key, err)
+		}
+
+		if err := repo.SetProviderKeyCooldown(ctx, id, time.Now().Add(time.Minute)); err != nil {
+			return fmt.Errorf("%s: set cooldown: %w", key, err)
+		}
+
+		if err := repo.SetProviderKeyCooldown(ctx, id, time.Time{}); err != nil {
+			return fmt.Errorf("%s: clear cooldown: %w", key, err)
+		}
+
+		// `keeper use`, a transaction that reads before it writes
+		if err := repo.SetActiveProfile(ctx, "default"); err != nil {
+			return fmt.Errorf("%s: switch profile: %w", key, err)
+		}
+
+		if err := repo.SetModelAlias(ctx, "default", name, "model-"+strconv.Itoa(i)); err != nil {
+			return fmt.Errorf("%s: set alias: %w", key, err)
+		}
+
+		// the server reloading its snapshot
+		if _, err := repo.ListActiveKeys(ctx); err != nil {
+			return fmt.Errorf("%s: list keys: %w", key, err)
+		}
+
+		if _, err := repo.GetActiveProfileSettingsWithKey(ctx); err != nil {
+			return fmt.Errorf("%s: load settings: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// CountKeys fails the test unless the workers added want keys in total
+func CountKeys(tb testing.TB, repo keeper.Repository, want int) {
+	tb.Helper()
+
+	keys, err := repo.ListProviderKeys(context.Background())
+	if err != nil {
+		tb.Fatalf("failed to list keys: %v", err)
+	}
+
+	got := 0
+	for _, k := range keys {
+		if strings.HasPrefix(k.Name, "goroutine") || strings.HasPrefix(k.Name, "process") {
+			got++
+		}
+	}
+
+	if got != want {
+		tb.Errorf("workers added %d keys, want %d; worker processes only write when TestMain calls keepertest.WorkerMain", got, want)
+	}
+}
+
+// CheckDatabase fails the test when db fails its integrity or foreign key
+// checks
+func CheckDatabase(tb testing.TB, db *sql.DB) {
+	tb.Helper()
+
+	problems, err := database.Check(context.Background(), db)
+	if err != nil {
+		tb.Fatalf("failed to check database: %v", err)
+	}
+
+	for _, p := range problems {
+		tb.Errorf("database check: %s", p)
+	}
+}
+
+// ForeignKeys fails the test unless db enforces the schema's foreign keys:
+// a key of a missing provider is refused and deleting a profile removes its
+// settings and aliases
+func ForeignKeys(tb testing.TB, db *sql.DB, repo keeper.Repository) {
+	tb.Helper()
+
+	ctx := context.Background()
+
+	if _, err := db.ExecContext(ctx, "INSERT INTO provider_keys (provider_id, name, secret) VALUES ($1, $2, $3)", -1, "orphan", "sk-orphan"); err == nil {
+		tb.Errorf("a key of a missing provider was stored")
+	}
+
+	provider, err := repo.GetProviderByName(ctx, workerProvider)
+	if err != nil {
+		tb.Fatalf("failed to get provider: %v", err)
+	}
+
+	id, err := repo.CreateProfile(ctx, keeper.CreateProfileReq{Name: "keepertest-cascade"})
+	if err != nil {
+		tb.Fatalf("failed to create profile: %v", err)
+	}
+
+	if _, err := repo.CreateProfileSettings(ctx, keeper.ProfileSettings{ProfileID: id, ProviderID: provider.ID}); err != nil {
+		tb.Fatalf("failed to create profile settings: %v", err)
+	}
+
+	if err := repo.SetModelAlias(ctx, "keepertest-cascade", "fast", "model"); err != nil {
+		tb.Fatalf("failed to set alias: %v", err)
+	}
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM profiles WHERE id = $1", id); err != nil {
+		tb.Fatalf("failed to delete profile: %v", err)
+	}
+
+	for _, table := range []string{"profile_settings", "model_aliases"} {
+		var count int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE profile_id = $1", id).Scan(&count); err != nil {
+			tb.Fatalf("failed to count %s: %v", table, err)
+		}
+
+		if count != 0 {
+			tb.Errorf("deleting a profile left %d rows in %s", count, table)
+		}
+	}
+}
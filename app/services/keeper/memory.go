@@ -0,0 +1,800 @@
+package keeper
+
+import (
+	"context"
+	"fmt"
+	"keeper/internal/logger"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryRepository keeps the setup in memory, e.g. to embed keeper without
+// a database file. It behaves as SQLiteRepository does, down to the errors
+// and the order rows are listed in, and is safe for concurrent use.
+type MemoryRepository struct {
+	mu    sync.RWMutex
+	state *memoryState
+	// version counts the writes, as PRAGMA data_version does for Watch
+	version int64
+}
+
+// memoryState holds the rows of every table, each slice ordered by ID
+type memoryState struct {
+	// the last IDs handed out, IDs are not reused as with AUTOINCREMENT
+	lastProfileID, lastProviderID, lastKeyID, lastSettingsID int64
+
+	profiles  []Profile
+	providers []memoryProvider
+	keys      []memoryKey
+	settings  []memorySettings
+	// aliases leave ProfileName empty, it is filled in when listed
+	aliases []ModelAlias
+}
+
+type memoryProvider struct {
+	ID      int64
+	Name    string
+	BaseURL string
+	Model   string
+}
+
+// memoryKey leaves ProviderName empty, it is filled in when listed
+type memoryKey struct {
+	ProviderKeyInfo
+
+	Secret      string
+	IsReference bool
+}
+
+// memorySettings are profile_settings rows, zero IDs stand for NULL
+type memorySettings struct {
+	ID         int64
+	ProfileID  int64
+	ProviderID int64
+	KeyID      int64
+}
+
+func NewMemory() *MemoryRepository {
+	return &MemoryRepository{state: &memoryState{}}
+}
+
+// memoryNow is the current time in the format of CURRENT_TIMESTAMP, the
+// stored times compare with it as text as they do in SQLite
+func memoryNow() string {
+	return time.Now().UTC().Format(time.DateTime)
+}
+
+// memoryTime formats t as dbTime does, empty for the zero time
+func memoryTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.DateTime)
+}
+
+// usable is usableKey for a stored key
+func (k *memoryKey) usable(now string) bool {
+	return k.Status.Usable() &&
+		(k.CooldownUntil == "" || k.CooldownUntil <= now) &&
+		(k.ExpiresAt == "" || k.ExpiresAt > now)
+}
+
+// clone copies the state, the rows hold no pointers
+func (s *memoryState) clone() *memoryState {
+	c := *s
+	c.profiles = append([]Profile(nil), s.profiles...)
+	c.providers = append([]memoryProvider(nil), s.providers...)
+	c.keys = append([]memoryKey(nil), s.keys...)
+	c.settings = append([]memorySettings(nil), s.settings...)
+	c.aliases = append([]ModelAlias(nil), s.aliases...)
+
+	return &c
+}
+
+func (s *memoryState) profileByName(name string) *Profile {
+	for i := range s.profiles {
+		if s.profiles[i].Name == name {
+			return &s.profiles[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryState) profileByID(id int64) *Profile {
+	for i := range s.profiles {
+		if s.profiles[i].ID == id {
+			return &s.profiles[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryState) activeProfile() *Profile {
+	for i := range s.profiles {
+		if s.profiles[i].IsActive {
+			return &s.profiles[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryState) providerByName(name string) *memoryProvider {
+	for i := range s.providers {
+		if s.providers[i].Name == name {
+			return &s.providers[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryState) providerByID(id int64) *memoryProvider {
+	for i := range s.providers {
+		if s.providers[i].ID == id {
+			return &s.providers[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryState) key(id int64) *memoryKey {
+	for i := range s.keys {
+		if s.keys[i].ID == id {
+			return &s.keys[i]
+		}
+	}
+
+	return nil
+}
+
+// namedKey is the newest key of the provider with the given name
+func (s *memoryState) namedKey(providerID int64, name string) *memoryKey {
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		if s.keys[i].ProviderID == providerID && s.keys[i].Name == name {
+			return &s.keys[i]
+		}
+	}
+
+	return nil
+}
+
+// selectableKey is the newest active and usable key of the provider, the
+// one the LEFT JOINs of SQLiteRepository pick
+func (s *memoryState) selectableKey(providerID int64, now string) *memoryKey {
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		k := &s.keys[i]
+		if k.ProviderID == providerID && k.IsActive && k.usable(now) {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// settingsOf is the first settings row of the profile
+func (s *memoryState) settingsOf(profileID int64) *memorySettings {
+	for i := range s.settings {
+		if s.settings[i].ProfileID == profileID {
+			return &s.settings[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryState) insertProfile(p Profile) int64 {
+	s.lastProfileID++
+	p.ID = s.lastProfileID
+	s.profiles = append(s.profiles, p)
+
+	return p.ID
+}
+
+func (s *memoryState) insertProvider(p memoryProvider) int64 {
+	s.lastProviderID++
+	p.ID = s.lastProviderID
+	s.providers = append(s.providers, p)
+
+	return p.ID
+}
+
+func (s *memoryState) insertKey(k memoryKey) int64 {
+	s.lastKeyID++
+	k.ID = s.lastKeyID
+	k.CreatedAt = memoryNow()
+	if k.Status == "" {
+		k.Status = KeyStatusUnknown
+	}
+	s.keys = append(s.keys, k)
+
+	return k.ID
+}
+
+func (s *memoryState) insertSettings(ps memorySettings) int64 {
+	s.lastSettingsID++
+	ps.ID = s.lastSettingsID
+	s.settings = append(s.settings, ps)
+
+	return ps.ID
+}
+
+// withKey builds the Provider the queries of SQLiteRepository return, with
+// the key selected when there is one
+func (p *memoryProvider) withKey(k *memoryKey) Provider {
+	provider := Provider{
+		ID:      p.ID,
+		Name:    p.Name,
+		BaseURL: p.BaseURL,
+		Model:   p.Model,
+	}
+
+	if k != nil {
+		provider.SelectedKeyID = new(string)
+		*provider.SelectedKeyID = fmt.Sprintf("%d", k.ID)
+		provider.ProviderKey = ProviderKey{
+			ID:          k.ID,
+			Name:        k.Name,
+			Secret:      k.Secret,
+			IsReference: k.IsReference,
+		}
+	}
+
+	return provider
+}
+
+// changed records a write for Watch, the caller holds the write lock
+func (r *MemoryRepository) changed() {
+	r.version++
+}
+
+func (r *MemoryRepository) CreateProfile(ctx context.Context, req CreateProfileReq) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state.profileByName(req.Name) != nil {
+		return 0, logger.Errorf("failed to create profile: profile %q already exists", req.Name)
+	}
+
+	id := r.state.insertProfile(Profile{Name: req.Name, IsActive: req.IsActive, IsDefault: req.IsDefault})
+	r.changed()
+
+	return id, nil
+}
+
+func (r *MemoryRepository) ListProfiles(ctx context.Context) ([]Profile, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var profiles []Profile
+	profiles = append(profiles, r.state.profiles...)
+
+	return profiles, nil
+}
+
+func (r *MemoryRepository) GetActiveProfile(ctx context.Context) (*Profile, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	p := r.state.activeProfile()
+	if p == nil {
+		return nil, logger.Errorf("no active profile")
+	}
+
+	profile := *p
+	return &profile, nil
+}
+
+// SetActiveProfile makes the named profile the only active one
+func (r *MemoryRepository) SetActiveProfile(ctx context.Context, name string) error {
+	if name == "" {
+		return logger.Errorf("profile name cannot be empty")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := r.state.profileByName(name)
+	if p == nil {
+		return logger.Errorf("profile %q not found", name)
+	}
+
+	id := p.ID
+	for i := range r.state.profiles {
+		r.state.profiles[i].IsActive = r.state.profiles[i].ID == id
+	}
+	r.changed()
+
+	return nil
+}
+
+// SetProfileCache turns response caching on or off for the named profile
+func (r *MemoryRepository) SetProfileCache(ctx context.Context, name string, enabled bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := r.state.profileByName(name)
+	if p == nil {
+		return logger.Errorf("profile %q not found", name)
+	}
+
+	p.CacheEnabled = enabled
+	r.changed()
+
+	return nil
+}
+
+// Key repository
+func (r *MemoryRepository) CreateProviderKey(ctx context.Context, provider Provider, secret string, opts ProviderKeyOptions) (int64, error) {
+	if opts.Name == "" {
+		opts.Name = provider.Name
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state.providerByID(provider.ID) == nil {
+		return 0, logger.Errorf("failed to create key: provider %d not found", provider.ID)
+	}
+
+	id := r.state.insertKey(memoryKey{
+		ProviderKeyInfo: ProviderKeyInfo{
+			ProviderID:  provider.ID,
+			Name:        opts.Name,
+			IsActive:    true,
+			ExpiresAt:   memoryTime(opts.ExpiresAt),
+			RotateAfter: memoryTime(opts.RotateAfter),
+		},
+		Secret:      secret,
+		IsReference: opts.Reference,
+	})
+
+	// the active profile uses the new key unless it has one for the provider
+	if active := r.state.activeProfile(); active != nil {
+		selected := false
+		for _, ps := range r.state.settings {
+			if ps.ProfileID == active.ID && ps.ProviderID == provider.ID && ps.KeyID != 0 {
+				selected = true
+			}
+		}
+
+		if !selected {
+			for i := range r.state.settings {
+				if ps := &r.state.settings[i]; ps.ProfileID == active.ID && ps.ProviderID == provider.ID {
+					ps.KeyID = id
+				}
+			}
+		}
+	}
+
+	r.changed()
+
+	return id, nil
+}
+
+func (r *MemoryRepository) ListProviderKeys(ctx context.Context) ([]ProviderKeyInfo, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var keys []ProviderKeyInfo
+	for _, k := range r.state.keys {
+		info := k.ProviderKeyInfo
+		if p := r.state.providerByID(k.ProviderID); p != nil {
+			info.ProviderName = p.Name
+		}
+
+		keys = append(keys, info)
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].ProviderName < keys[j].ProviderName
+	})
+
+	return keys, nil
+}
+
+// GetProviderKey returns the provider with the key of the given ID, whatever
+// its status
+func (r *MemoryRepository) GetProviderKey(ctx context.Context, id int64) (*Provider, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	k := r.state.key(id)
+	if k == nil {
+		return nil, logger.Errorf("key %d not found", id)
+	}
+
+	provider := r.state.providerByID(k.ProviderID).withKey(k)
+	return &provider, nil
+}
+
+// updateKey applies update to the key of the given ID
+func (r *MemoryRepository) updateKey(id int64, update func(k *memoryKey)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := r.state.key(id)
+	if k == nil {
+		return logger.Errorf("key %d not found", id)
+	}
+
+	update(k)
+	r.changed()
+
+	return nil
+}
+
+// SetProviderKeyStatus records the outcome of a health check of the key,
+// deactivating a rejected key and activating it again once it is usable
+func (r *MemoryRepository) SetProviderKeyStatus(ctx context.Context, id int64, status KeyStatus) error {
+	return r.updateKey(id, func(k *memoryKey) {
+		switch {
+		case !status.Usable():
+			k.IsActive = false
+		case !k.Status.Usable():
+			k.IsActive = true
+		}
+
+		k.Status = status
+		k.LastCheckedAt = memoryNow()
+	})
+}
+
+// SetProviderKeyCooldown keeps a rate limited key out of use until the given
+// time, a zero time ends the cooldown
+func (r *MemoryRepository) SetProviderKeyCooldown(ctx context.Context, id int64, until time.Time) error {
+	return r.updateKey(id, func(k *memoryKey) {
+		k.CooldownUntil = memoryTime(until)
+	})
+}
+
+// NextKeyExpiry is when the next active key expires, zero when none will
+func (r *MemoryRepository) NextKeyExpiry(ctx context.Context) (time.Time, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := memoryNow()
+
+	next := ""
+	for _, k := range r.state.keys {
+		if k.IsActive && k.ExpiresAt > now && (next == "" || k.ExpiresAt < next) {
+			next = k.ExpiresAt
+		}
+	}
+
+	if next == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.ParseInLocation(time.DateTime, next, time.UTC)
+	if err != nil {
+		return time.Time{}, logger.Errorf("invalid key expiry %q: %w", next, err)
+	}
+
+	return t, nil
+}
+
+// Provider repository
+func (r *MemoryRepository) CreateProviders(ctx context.Context, providers ...Provider) ([]int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.createProviders(providers)
+}
+
+// createProviders stores all of the providers or, as the transaction of
+// SQLiteRepository, none. The caller holds the write lock.
+func (r *MemoryRepository) createProviders(providers []Provider) ([]int64, error) {
+	names := map[string]bool{}
+	for _, provider := range providers {
+		if provider.Name == "" || provider.BaseURL == "" || provider.Model == "" {
+			return nil, logger.Errorf("provider name, base URL, and model cannot be empty")
+		}
+
+		if names[provider.Name] || r.state.providerByName(provider.Name) != nil {
+			return nil, logger.Errorf("failed to create provider: provider %q already exists", provider.Name)
+		}
+
+		names[provider.Name] = true
+	}
+
+	ids := make([]int64, 0, len(providers))
+	for _, provider := range providers {
+		ids = append(ids, r.state.insertProvider(memoryProvider{
+			Name:    provider.Name,
+			BaseURL: provider.BaseURL,
+			Model:   provider.Model,
+		}))
+	}
+
+	if len(ids) > 0 {
+		r.changed()
+	}
+
+	return ids, nil
+}
+
+// CreateMissingProviders adds the providers whose name is not stored yet,
+// e.g. ones added to the registry after the repository was seeded.
+func (r *MemoryRepository) CreateMissingProviders(ctx context.Context, providers ...Provider) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var missing []Provider
+	for _, p := range providers {
+		if r.state.providerByName(p.Name) == nil {
+			missing = append(missing, p)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	_, err := r.createProviders(missing)
+
+	return err
+}
+
+func (r *MemoryRepository) GetProviderByName(ctx context.Context, name string) (*Provider, error) {
+	if name == "" {
+		return nil, logger.Errorf("provider name cannot be empty")
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	p := r.state.providerByName(name)
+	if p == nil {
+		return nil, logger.Errorf("provider not found")
+	}
+
+	provider := p.withKey(nil)
+	return &provider, nil
+}
+
+func (r *MemoryRepository) GetProviderByNameWithKey(ctx context.Context, name string) (*Provider, error) {
+	if name == "" {
+		return nil, logger.Errorf("provider name cannot be empty")
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	p := r.state.providerByName(name)
+	if p == nil {
+		return nil, logger.Errorf("provider not found")
+	}
+
+	provider := p.withKey(r.state.selectableKey(p.ID, memoryNow()))
+	return &provider, nil
+}
+
+func (r *MemoryRepository) ListProvidersWithKey(ctx context.Context) ([]Provider, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := memoryNow()
+
+	var providers []Provider
+	for i := range r.state.providers {
+		p := &r.state.providers[i]
+		providers = append(providers, p.withKey(r.state.selectableKey(p.ID, now)))
+	}
+
+	return providers, nil
+}
+
+// ListActiveKeys returns a Provider for every active key that is usable,
+// newest key first
+func (r *MemoryRepository) ListActiveKeys(ctx context.Context) ([]Provider, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := memoryNow()
+
+	var providers []Provider
+	for i := range r.state.providers {
+		p := &r.state.providers[i]
+
+		for j := len(r.state.keys) - 1; j >= 0; j-- {
+			k := &r.state.keys[j]
+			if k.ProviderID == p.ID && k.IsActive && k.usable(now) {
+				providers = append(providers, p.withKey(k))
+			}
+		}
+	}
+
+	return providers, nil
+}
+
+// Model alias repository
+func (r *MemoryRepository) SetModelAlias(ctx context.Context, profileName, alias, model string) error {
+	if profileName == "" || alias == "" || model == "" {
+		return logger.Errorf("profile, alias and model cannot be empty")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := r.state.profileByName(profileName)
+	if p == nil {
+		return logger.Errorf("profile %q not found", profileName)
+	}
+
+	r.changed()
+
+	for i := range r.state.aliases {
+		if a := &r.state.aliases[i]; a.ProfileID == p.ID && a.Alias == alias {
+			a.Model = model
+			return nil
+		}
+	}
+
+	r.state.aliases = append(r.state.aliases, ModelAlias{ProfileID: p.ID, Alias: alias, Model: model})
+
+	return nil
+}
+
+func (r *MemoryRepository) DeleteModelAlias(ctx context.Context, profileName, alias string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p := r.state.profileByName(profileName); p != nil {
+		for i, a := range r.state.aliases {
+			if a.ProfileID == p.ID && a.Alias == alias {
+				r.state.aliases = append(r.state.aliases[:i], r.state.aliases[i+1:]...)
+				r.changed()
+
+				return nil
+			}
+		}
+	}
+
+	return logger.Errorf("alias %q not found in profile %q", alias, profileName)
+}
+
+func (r *MemoryRepository) ListModelAliases(ctx context.Context) ([]ModelAlias, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var aliases []ModelAlias
+	for _, a := range r.state.aliases {
+		if p := r.state.profileByID(a.ProfileID); p != nil {
+			a.ProfileName = p.Name
+			aliases = append(aliases, a)
+		}
+	}
+
+	sort.Slice(aliases, func(i, j int) bool {
+		if aliases[i].ProfileName != aliases[j].ProfileName {
+			return aliases[i].ProfileName < aliases[j].ProfileName
+		}
+		return aliases[i].Alias < aliases[j].Alias
+	})
+
+	return aliases, nil
+}
+
+// User settings repository
+func (r *MemoryRepository) CreateProfileSettings(ctx context.Context, userSettings ProfileSettings) (int64, error) {
+	if userSettings.ProfileID <= 0 || userSettings.ProviderID <= 0 {
+		return 0, logger.Errorf("invalid user ID or selected provider ID")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state.profileByID(userSettings.ProfileID) == nil {
+		return 0, logger.Errorf("failed to create user settings: profile %d not found", userSettings.ProfileID)
+	}
+
+	if r.state.providerByID(userSettings.ProviderID) == nil {
+		return 0, logger.Errorf("failed to create user settings: provider %d not found", userSettings.ProviderID)
+	}
+
+	id := r.state.insertSettings(memorySettings{ProfileID: userSettings.ProfileID, ProviderID: userSettings.ProviderID})
+	r.changed()
+
+	return id, nil
+}
+
+func (r *MemoryRepository) GetActiveProfileSettingsWithKey(ctx context.Context) (*ProfileSettings, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.profileSettings(r.state.activeProfile())
+}
+
+func (r *MemoryRepository) GetProfileSettingsWithKey(ctx context.Context, profileName string) (*ProfileSettings, error) {
+	if profileName == "" {
+		return nil, logger.Errorf("profile name cannot be empty")
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.profileSettings(r.state.profileByName(profileName))
+}
+
+// profileSettings loads the settings of the profile, the caller holds the
+// read lock
+func (r *MemoryRepository) profileSettings(profile *Profile) (*ProfileSettings, error) {
+	var ps *memorySettings
+	if profile != nil {
+		ps = r.state.settingsOf(profile.ID)
+	}
+
+	if ps == nil {
+		return nil, logger.Errorf("profile settings not found")
+	}
+
+	settings := ProfileSettings{ProfileID: ps.ProfileID}
+
+	if p := r.state.providerByID(ps.ProviderID); p != nil {
+		settings.ProviderID = p.ID
+		settings.Provider = p.withKey(nil)
+	}
+
+	// an unusable key is left out so callers fall back to another one
+	if k := r.state.key(ps.KeyID); k != nil && k.usable(memoryNow()) {
+		settings.Provider.ProviderKey = ProviderKey{
+			ID:          k.ID,
+			Name:        k.Name,
+			Secret:      k.Secret,
+			IsReference: k.IsReference,
+		}
+	}
+
+	return &settings, nil
+}
+
+// Watch checks every interval whether the repository was written to and
+// signals on the returned channel when it was. The channel is closed once
+// ctx is done.
+func (r *MemoryRepository) Watch(ctx context.Context, interval time.Duration) (<-chan struct{}, error) {
+	version := r.currentVersion()
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		defer close(changes)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current := r.currentVersion()
+			if current == version {
+				continue
+			}
+
+			version = current
+
+			// coalesce bursts of changes into a single pending notification
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changes, nil
+}
+
+func (r *MemoryRepository) currentVersion() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.version
+}
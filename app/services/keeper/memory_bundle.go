@@ -0,0 +1,335 @@
+package keeper
+
+import (
+	"context"
+	"fmt"
+	"keeper/internal/logger"
+	"strings"
+)
+
+// Export copies the setup into a bundle, keys only when withKeys is set
+func (r *MemoryRepository) Export(ctx context.Context, withKeys bool) (*Bundle, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s := r.state
+	b := newBundle()
+
+	for _, p := range s.providers {
+		b.Providers = append(b.Providers, BundleProvider{Name: p.Name, BaseURL: p.BaseURL, Model: p.Model})
+	}
+
+	for _, p := range s.profiles {
+		profile := BundleProfile{Name: p.Name, CacheEnabled: p.CacheEnabled}
+
+		for _, a := range s.aliases {
+			if a.ProfileID != p.ID {
+				continue
+			}
+
+			if profile.Aliases == nil {
+				profile.Aliases = map[string]string{}
+			}
+			profile.Aliases[a.Alias] = a.Model
+		}
+
+		// one entry per settings row, as the LEFT JOIN of SQLiteRepository
+		exported := false
+		for _, ps := range s.settings {
+			if ps.ProfileID != p.ID {
+				continue
+			}
+
+			withSettings := profile
+			if provider := s.providerByID(ps.ProviderID); provider != nil {
+				withSettings.Provider = provider.Name
+			}
+			if k := s.key(ps.KeyID); k != nil {
+				withSettings.Key = k.Name
+			}
+
+			b.Profiles = append(b.Profiles, withSettings)
+			exported = true
+		}
+
+		if !exported {
+			b.Profiles = append(b.Profiles, profile)
+		}
+	}
+
+	if !withKeys {
+		return b, nil
+	}
+
+	for _, k := range s.keys {
+		provider := s.providerByID(k.ProviderID)
+		if provider == nil {
+			continue
+		}
+
+		b.Keys = append(b.Keys, BundleKey{
+			Provider:    provider.Name,
+			Name:        k.Name,
+			Secret:      k.Secret,
+			Reference:   k.IsReference,
+			IsActive:    k.IsActive,
+			ExpiresAt:   k.ExpiresAt,
+			RotateAfter: k.RotateAfter,
+		})
+	}
+
+	return b, nil
+}
+
+// Import adds a bundle to the setup at once, nothing is kept when a row
+// fails. The active profile stays as it is.
+func (r *MemoryRepository) Import(ctx context.Context, b *Bundle, opts ImportOptions) ([]ImportChange, error) {
+	opts, err := checkImport(b, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// the import works on a copy that replaces the state once it succeeded
+	imp := &memoryImporter{state: r.state.clone(), opts: opts, keys: map[string]int64{}}
+
+	if err := imp.providers(b.Providers); err != nil {
+		return nil, logger.Errorf("failed to import providers: %w", err)
+	}
+
+	if err := imp.importKeys(b.Keys); err != nil {
+		return nil, logger.Errorf("failed to import keys: %w", err)
+	}
+
+	if err := imp.profiles(b.Profiles); err != nil {
+		return nil, logger.Errorf("failed to import profiles: %w", err)
+	}
+
+	if opts.DryRun {
+		return imp.changes, nil
+	}
+
+	r.state = imp.state
+	r.changed()
+
+	return imp.changes, nil
+}
+
+// memoryImporter is the importer of MemoryRepository
+type memoryImporter struct {
+	importLog
+
+	state *memoryState
+	opts  ImportOptions
+	// keys maps provider/name of the bundle's keys to the stored key they
+	// ended up as, renamed ones included
+	keys map[string]int64
+}
+
+func (imp *memoryImporter) providers(providers []BundleProvider) error {
+	for _, p := range providers {
+		if p.Name == "" || p.BaseURL == "" || p.Model == "" {
+			return fmt.Errorf("provider name, base URL, and model cannot be empty")
+		}
+
+		stored := imp.state.providerByName(p.Name)
+
+		switch {
+		case stored == nil:
+			imp.state.insertProvider(memoryProvider{Name: p.Name, BaseURL: p.BaseURL, Model: p.Model})
+			imp.record("provider", p.Name, "created", "")
+
+		case stored.BaseURL == p.BaseURL && stored.Model == p.Model:
+
+		case imp.opts.OnConflict == ConflictOverwrite:
+			stored.BaseURL, stored.Model = p.BaseURL, p.Model
+			imp.record("provider", p.Name, "updated", fmt.Sprintf("%s, %s", p.BaseURL, p.Model))
+
+		default:
+			imp.record("provider", p.Name, "skipped", fmt.Sprintf("keeping %s, %s", stored.BaseURL, stored.Model))
+		}
+	}
+
+	return nil
+}
+
+func (imp *memoryImporter) importKeys(keys []BundleKey) error {
+	for _, k := range keys {
+		label := k.Provider + "/" + k.Name
+
+		if k.Secret == "" {
+			return fmt.Errorf("key %s has no secret", label)
+		}
+
+		provider := imp.state.providerByName(k.Provider)
+		if provider == nil {
+			imp.record("key", label, "skipped", "unknown provider "+k.Provider)
+			continue
+		}
+
+		var id int64
+		stored := imp.state.namedKey(provider.ID, k.Name)
+
+		switch {
+		case stored == nil:
+			id = imp.insertKey(provider.ID, k.Name, k)
+			imp.recordKey(label, "created", "", k)
+
+		// the same key imported again
+		case stored.Secret == k.Secret && stored.IsReference == k.Reference:
+			id = stored.ID
+
+		case imp.opts.OnConflict == ConflictOverwrite:
+			// the new secret was never checked, nor did it cool down
+			stored.Secret, stored.IsReference = k.Secret, k.Reference
+			stored.IsActive = k.IsActive
+			stored.ExpiresAt, stored.RotateAfter = k.ExpiresAt, k.RotateAfter
+			stored.Status, stored.LastCheckedAt, stored.CooldownUntil = KeyStatusUnknown, "", ""
+
+			id = stored.ID
+			imp.recordKey(label, "updated", "", k)
+
+		case imp.opts.OnConflict == ConflictRename:
+			name := imp.uniqueName(k.Name, func(name string) bool {
+				return imp.state.namedKey(provider.ID, name) != nil
+			})
+
+			id = imp.insertKey(provider.ID, name, k)
+			imp.recordKey(label, "renamed", k.Provider+"/"+name, k)
+
+		default:
+			id = stored.ID
+			imp.record("key", label, "skipped", "a different key has this name")
+		}
+
+		imp.keys[label] = id
+	}
+
+	return nil
+}
+
+func (imp *memoryImporter) insertKey(providerID int64, name string, k BundleKey) int64 {
+	return imp.state.insertKey(memoryKey{
+		ProviderKeyInfo: ProviderKeyInfo{
+			ProviderID:  providerID,
+			Name:        name,
+			IsActive:    k.IsActive,
+			ExpiresAt:   k.ExpiresAt,
+			RotateAfter: k.RotateAfter,
+		},
+		Secret:      k.Secret,
+		IsReference: k.Reference,
+	})
+}
+
+func (imp *memoryImporter) profiles(profiles []BundleProfile) error {
+	for _, p := range profiles {
+		if p.Name == "" {
+			return fmt.Errorf("profile name cannot be empty")
+		}
+
+		var id int64
+		var action string
+		var notes []string
+
+		stored := imp.state.profileByName(p.Name)
+
+		switch {
+		case stored == nil:
+			id = imp.state.insertProfile(Profile{Name: p.Name})
+			action = "created"
+
+		case imp.opts.OnConflict == ConflictOverwrite:
+			id = stored.ID
+			action = "updated"
+
+		case imp.opts.OnConflict == ConflictRename:
+			name := imp.uniqueName(p.Name, func(name string) bool {
+				return imp.state.profileByName(name) != nil
+			})
+
+			id = imp.state.insertProfile(Profile{Name: name})
+			action, notes = "renamed", []string{name}
+
+		default:
+			imp.record("profile", p.Name, "skipped", "a profile has this name")
+			continue
+		}
+
+		if note := imp.applyProfile(id, p); note != "" {
+			notes = append(notes, note)
+		}
+
+		imp.record("profile", p.Name, action, strings.Join(notes, ", "))
+	}
+
+	return nil
+}
+
+// applyProfile replaces the settings and aliases of the stored profile id
+// with the bundle's, the note says what could not be applied
+func (imp *memoryImporter) applyProfile(id int64, p BundleProfile) (note string) {
+	s := imp.state
+	s.profileByID(id).CacheEnabled = p.CacheEnabled
+
+	var providerID, keyID int64
+
+	if p.Provider != "" {
+		if provider := s.providerByName(p.Provider); provider != nil {
+			providerID = provider.ID
+		} else {
+			note = "unknown provider " + p.Provider + ", none selected"
+		}
+	}
+
+	if providerID != 0 && p.Key != "" {
+		label := p.Provider + "/" + p.Key
+
+		if kid, ok := imp.keys[label]; ok {
+			keyID = kid
+		} else if k := s.namedKey(providerID, p.Key); k != nil {
+			// a key of that name the importing user already has
+			keyID = k.ID
+		} else {
+			note = "no key " + label + ", using the provider's most recent key"
+		}
+	}
+
+	updated := false
+	for i := range s.settings {
+		if ps := &s.settings[i]; ps.ProfileID == id {
+			ps.ProviderID, ps.KeyID = providerID, keyID
+			updated = true
+		}
+	}
+
+	if !updated {
+		s.insertSettings(memorySettings{ProfileID: id, ProviderID: providerID, KeyID: keyID})
+	}
+
+	aliases := s.aliases[:0]
+	for _, a := range s.aliases {
+		if a.ProfileID != id {
+			aliases = append(aliases, a)
+		}
+	}
+	s.aliases = aliases
+
+	for alias, model := range p.Aliases {
+		s.aliases = append(s.aliases, ModelAlias{ProfileID: id, Alias: alias, Model: model})
+	}
+
+	return note
+}
+
+// uniqueName returns name with an -imported suffix, numbered until taken
+// reports the name is free
+func (imp *memoryImporter) uniqueName(name string, taken func(string) bool) string {
+	for i := 1; ; i++ {
+		if candidate := importedName(name, i); !taken(candidate) {
+			return candidate
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"fmt"
 	"keeper/internal/logger"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -18,6 +20,49 @@ type Profile struct {
 	Name      string `db:"name"`
 	IsActive  bool   `db:"is_active"`
 	IsDefault bool   `db:"is_default"`
+	// CacheEnabled lets the proxy answer deterministic requests from its cache
+	CacheEnabled bool `db:"cache_enabled"`
+}
+
+// KeyStatus is the outcome of the last health check of a key
+type KeyStatus string
+
+const (
+	KeyStatusUnknown       KeyStatus = "unknown"
+	KeyStatusValid         KeyStatus = "valid"
+	KeyStatusInvalid       KeyStatus = "invalid"
+	KeyStatusQuotaExceeded KeyStatus = "quota_exceeded"
+	KeyStatusRevoked       KeyStatus = "revoked"
+)
+
+// Usable reports whether the proxy may still send requests with the key
+func (s KeyStatus) Usable() bool {
+	return s != KeyStatusInvalid && s != KeyStatusRevoked
+}
+
+// Checked reports whether health checks cover the key: active keys and the
+// ones deactivated because the provider rejected them
+func (k ProviderKeyInfo) Checked() bool {
+	return k.IsActive || !k.Status.Usable()
+}
+
+// usableKey is the SQL condition on the provider_keys row aliased alias for
+// a key requests may be sent with: not rejected by its last health check,
+// not cooling down and not expired
+func usableKey(alias string) string {
+	return strings.NewReplacer("k.", alias+".").Replace(`(k.status NOT IN ('invalid', 'revoked')
+            AND (k.cooldown_until IS NULL OR k.cooldown_until <= CURRENT_TIMESTAMP)
+            AND (k.expires_at IS NULL OR k.expires_at > CURRENT_TIMESTAMP))`)
+}
+
+// dbTime stores t in the format of CURRENT_TIMESTAMP so the two compare as
+// text, NULL for the zero time
+func dbTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t.UTC().Format(time.DateTime)
 }
 
 // ProviderKey
@@ -25,6 +70,45 @@ type ProviderKey struct {
 	ID     int64  `db:"id"`
 	Name   string `db:"name"`
 	Secret string `db:"secret"`
+	// IsReference says Secret refers to an external source such as
+	// exec:pass show openai, a SecretResolver resolves it when used
+	IsReference bool `db:"is_reference"`
+}
+
+// ProviderKeyInfo describes a stored key without exposing its secret
+type ProviderKeyInfo struct {
+	ID           int64  `db:"id"`
+	ProviderID   int64  `db:"provider_id"`
+	ProviderName string `db:"provider_name"`
+	Name         string `db:"name"`
+	// IsActive follows the health checks: a key the provider rejects is
+	// deactivated and activated again once a check finds it usable
+	IsActive   bool   `db:"is_active"`
+	UsageCount int64  `db:"usage_count"`
+	CreatedAt  string `db:"created_at"`
+	// Status and LastCheckedAt record the last health check that was
+	// stored, the server's monitor only stores changes. LastCheckedAt is
+	// empty when the key was never checked
+	Status        KeyStatus `db:"status"`
+	LastCheckedAt string    `db:"last_checked_at"`
+	// CooldownUntil is when a rate limited key may be used again, empty
+	// when it is not cooling down
+	CooldownUntil string `db:"cooldown_until"`
+	// ExpiresAt is when the key stops being used and RotateAfter when it is
+	// due for rotation, both empty when not set
+	ExpiresAt   string `db:"expires_at"`
+	RotateAfter string `db:"rotate_after"`
+}
+
+// ProviderKeyOptions describe a new key, every field is optional
+type ProviderKeyOptions struct {
+	// Name defaults to the provider's name
+	Name        string
+	ExpiresAt   time.Time
+	RotateAfter time.Time
+	// Reference stores the secret as a reference resolved when the key is
+	// used
+	Reference bool
 }
 
 // Provider
@@ -51,6 +135,14 @@ type ProfileSettings struct {
 	ProviderID int64 `db:"selected_provider_id"`
 }
 
+// ModelAlias maps a model name clients send to the model forwarded upstream
+type ModelAlias struct {
+	ProfileID   int64  `db:"profile_id"`
+	ProfileName string `db:"profile_name"`
+	Alias       string `db:"alias"`
+	Model       string `db:"model"`
+}
+
 type UpdateUserSettingsRequest struct {
 	SelectedProviderID int64
 }
@@ -79,8 +171,107 @@ func (r *SQLiteRepository) CreateProfile(ctx context.Context, req CreateProfileR
 	return id, nil
 }
 
+func (r *SQLiteRepository) ListProfiles(ctx context.Context) ([]Profile, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT id, name, is_active, is_default, cache_enabled FROM profiles ORDER BY id")
+	if err != nil {
+		return nil, logger.Errorf("failed to list profiles: %w", err)
+	}
+
+	defer rows.Close()
+
+	var profiles []Profile
+	for rows.Next() {
+		var profile Profile
+		if err := rows.Scan(&profile.ID, &profile.Name, &profile.IsActive, &profile.IsDefault, &profile.CacheEnabled); err != nil {
+			return nil, logger.Errorf("failed to scan profile: %w", err)
+		}
+
+		profiles = append(profiles, profile)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, logger.Errorf("failed to list profiles: %w", err)
+	}
+
+	return profiles, nil
+}
+
+func (r *SQLiteRepository) GetActiveProfile(ctx context.Context) (*Profile, error) {
+	var profile Profile
+	err := r.db.QueryRowContext(ctx, "SELECT id, name, is_active, is_default, cache_enabled FROM profiles WHERE is_active = 1 LIMIT 1").
+		Scan(&profile.ID, &profile.Name, &profile.IsActive, &profile.IsDefault, &profile.CacheEnabled)
+	if err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, logger.Errorf("no active profile")
+		default:
+			return nil, logger.Errorf("failed to get active profile: %w", err)
+		}
+	}
+
+	return &profile, nil
+}
+
+// SetActiveProfile makes the named profile the only active one
+func (r *SQLiteRepository) SetActiveProfile(ctx context.Context, name string) error {
+	if name == "" {
+		return logger.Errorf("profile name cannot be empty")
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return logger.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id int64
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM profiles WHERE name = $1", name).Scan(&id); err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			return logger.Errorf("profile %q not found", name)
+		default:
+			return logger.Errorf("failed to get profile: %w", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+        UPDATE profiles
+        SET is_active = (id = $1), updated_at = CURRENT_TIMESTAMP
+    `, id); err != nil {
+		return logger.Errorf("failed to activate profile: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return logger.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// SetProfileCache turns response caching on or off for the named profile
+func (r *SQLiteRepository) SetProfileCache(ctx context.Context, name string, enabled bool) error {
+	result, err := r.db.ExecContext(ctx, `
+        UPDATE profiles
+        SET cache_enabled = $1, updated_at = CURRENT_TIMESTAMP
+        WHERE name = $2
+    `, enabled, name)
+	if err != nil {
+		return logger.Errorf("failed to update profile cache: %w", err)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return logger.Errorf("profile %q not found", name)
+	}
+
+	return nil
+}
+
 // Key repository
-func (r *SQLiteRepository) CreateProviderKey(ctx context.Context, provider Provider, secret string) (int64, error) {
+func (r *SQLiteRepository) CreateProviderKey(ctx context.Context, provider Provider, secret string, opts ProviderKeyOptions) (int64, error) {
+	if opts.Name == "" {
+		opts.Name = provider.Name
+	}
+
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, logger.Errorf("failed to begin transaction: %w", err)
@@ -88,7 +279,8 @@ func (r *SQLiteRepository) CreateProviderKey(ctx context.Context, provider Provi
 	defer tx.Rollback()
 
 	// Insert the new provider key
-	result, err := tx.ExecContext(ctx, "INSERT INTO provider_keys (provider_id, name, secret) VALUES ($1, $2, $3)", provider.ID, provider.Name, secret)
+	result, err := tx.ExecContext(ctx, "INSERT INTO provider_keys (provider_id, name, secret, expires_at, rotate_after, is_reference) VALUES ($1, $2, $3, $4, $5, $6)",
+		provider.ID, opts.Name, secret, dbTime(opts.ExpiresAt), dbTime(opts.RotateAfter), opts.Reference)
 	if err != nil {
 		return 0, logger.Errorf("failed to create key: %w", err)
 	}
@@ -130,6 +322,136 @@ func (r *SQLiteRepository) CreateProviderKey(ctx context.Context, provider Provi
 	return id, nil
 }
 
+func (r *SQLiteRepository) ListProviderKeys(ctx context.Context) ([]ProviderKeyInfo, error) {
+	rows, err := r.db.QueryContext(ctx, `
+        SELECT k.id, k.provider_id, p.name, COALESCE(k.name, ''), k.is_active, k.usage_count, k.created_at,
+               k.status, COALESCE(k.last_checked_at, ''), COALESCE(k.cooldown_until, ''),
+               COALESCE(k.expires_at, ''), COALESCE(k.rotate_after, '')
+        FROM provider_keys k
+        JOIN providers p ON k.provider_id = p.id
+        ORDER BY p.name, k.id`)
+	if err != nil {
+		return nil, logger.Errorf("failed to list provider keys: %w", err)
+	}
+
+	defer rows.Close()
+
+	var keys []ProviderKeyInfo
+	for rows.Next() {
+		var key ProviderKeyInfo
+		if err := rows.Scan(
+			&key.ID, &key.ProviderID, &key.ProviderName, &key.Name,
+			&key.IsActive, &key.UsageCount, &key.CreatedAt,
+			&key.Status, &key.LastCheckedAt, &key.CooldownUntil,
+			&key.ExpiresAt, &key.RotateAfter,
+		); err != nil {
+			return nil, logger.Errorf("failed to scan provider key: %w", err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, logger.Errorf("failed to list provider keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// GetProviderKey returns the provider with the key of the given ID, whatever
+// its status
+func (r *SQLiteRepository) GetProviderKey(ctx context.Context, id int64) (*Provider, error) {
+	var provider Provider
+	err := r.db.QueryRowContext(ctx, `
+        SELECT p.id, p.name, p.base_url, p.model,
+               k.id, COALESCE(k.name, ''), k.secret, k.is_reference
+        FROM provider_keys k
+        JOIN providers p ON k.provider_id = p.id
+        WHERE k.id = $1`, id).Scan(
+		&provider.ID, &provider.Name, &provider.BaseURL, &provider.Model,
+		&provider.ProviderKey.ID, &provider.ProviderKey.Name, &provider.Secret, &provider.IsReference,
+	)
+	if err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, logger.Errorf("key %d not found", id)
+		default:
+			return nil, logger.Errorf("failed to get key: %w", err)
+		}
+	}
+
+	provider.SelectedKeyID = new(string)
+	*provider.SelectedKeyID = fmt.Sprintf("%d", provider.ProviderKey.ID)
+
+	return &provider, nil
+}
+
+// SetProviderKeyStatus records the outcome of a health check of the key,
+// deactivating a rejected key and activating it again once it is usable
+func (r *SQLiteRepository) SetProviderKeyStatus(ctx context.Context, id int64, status KeyStatus) error {
+	result, err := r.db.ExecContext(ctx, `
+        UPDATE provider_keys
+        SET is_active = CASE
+                WHEN $1 IN ('invalid', 'revoked') THEN 0
+                WHEN status IN ('invalid', 'revoked') THEN 1
+                ELSE is_active
+            END,
+            status = $1, last_checked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $2
+    `, status, id)
+	if err != nil {
+		return logger.Errorf("failed to update key status: %w", err)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return logger.Errorf("key %d not found", id)
+	}
+
+	return nil
+}
+
+// SetProviderKeyCooldown keeps a rate limited key out of use until the given
+// time, a zero time ends the cooldown
+func (r *SQLiteRepository) SetProviderKeyCooldown(ctx context.Context, id int64, until time.Time) error {
+	result, err := r.db.ExecContext(ctx, `
+        UPDATE provider_keys
+        SET cooldown_until = $1, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $2
+    `, dbTime(until), id)
+	if err != nil {
+		return logger.Errorf("failed to update key cooldown: %w", err)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return logger.Errorf("key %d not found", id)
+	}
+
+	return nil
+}
+
+// NextKeyExpiry is when the next active key expires, zero when none will
+func (r *SQLiteRepository) NextKeyExpiry(ctx context.Context) (time.Time, error) {
+	var next sql.NullString
+	err := r.db.QueryRowContext(ctx, `
+        SELECT MIN(expires_at)
+        FROM provider_keys
+        WHERE is_active = 1 AND expires_at > CURRENT_TIMESTAMP`).Scan(&next)
+	if err != nil {
+		return time.Time{}, logger.Errorf("failed to get next key expiry: %w", err)
+	}
+
+	if !next.Valid {
+		return time.Time{}, nil
+	}
+
+	t, err := time.ParseInLocation(time.DateTime, next.String, time.UTC)
+	if err != nil {
+		return time.Time{}, logger.Errorf("invalid key expiry %q: %w", next.String, err)
+	}
+
+	return t, nil
+}
+
 // Provider repository
 func (r *SQLiteRepository) CreateProviders(ctx context.Context, providers ...Provider) ([]int64, error) {
 	tx, err := r.db.BeginTx(ctx, nil)
@@ -164,6 +486,48 @@ func (r *SQLiteRepository) CreateProviders(ctx context.Context, providers ...Pro
 	return ids, nil
 }
 
+// CreateMissingProviders adds the providers whose name is not stored yet,
+// e.g. ones added to the registry after the database was seeded.
+func (r *SQLiteRepository) CreateMissingProviders(ctx context.Context, providers ...Provider) error {
+	rows, err := r.db.QueryContext(ctx, "SELECT name FROM providers")
+	if err != nil {
+		return logger.Errorf("failed to list providers: %w", err)
+	}
+
+	defer rows.Close()
+
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return logger.Errorf("failed to scan provider: %w", err)
+		}
+
+		existing[name] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return logger.Errorf("failed to list providers: %w", err)
+	}
+
+	// only write when something is missing, every commit wakes up the
+	// running server's Watch
+	var missing []Provider
+	for _, p := range providers {
+		if !existing[p.Name] {
+			missing = append(missing, p)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	_, err = r.CreateProviders(ctx, missing...)
+
+	return err
+}
+
 func (r *SQLiteRepository) GetProviderByName(ctx context.Context, name string) (*Provider, error) {
 	if name == "" {
 		return nil, logger.Errorf("provider name cannot be empty")
@@ -192,17 +556,18 @@ func (r *SQLiteRepository) GetProviderByNameWithKey(ctx context.Context, name st
 	var provider Provider
 	var keyID sql.NullInt64
 	var keyName, secret sql.NullString
+	var isReference sql.NullBool
 
 	err := r.db.QueryRowContext(ctx, `
         SELECT p.id, p.name, p.base_url, p.model,
-               k.id, k.name, k.secret
+               k.id, k.name, k.secret, k.is_reference
         FROM providers p
-        LEFT JOIN provider_keys k ON k.provider_id = p.id AND k.is_active = 1
+        LEFT JOIN provider_keys k ON k.provider_id = p.id AND k.is_active = 1 AND `+usableKey("k")+`
         WHERE p.name = $1
         ORDER BY k.id DESC
         LIMIT 1`, name).Scan(
 		&provider.ID, &provider.Name, &provider.BaseURL, &provider.Model,
-		&keyID, &keyName, &secret,
+		&keyID, &keyName, &secret, &isReference,
 	)
 
 	if err != nil {
@@ -218,15 +583,177 @@ func (r *SQLiteRepository) GetProviderByNameWithKey(ctx context.Context, name st
 		provider.SelectedKeyID = new(string)
 		*provider.SelectedKeyID = fmt.Sprintf("%d", keyID.Int64)
 		provider.ProviderKey = ProviderKey{
-			ID:     keyID.Int64,
-			Name:   keyName.String,
-			Secret: secret.String,
+			ID:          keyID.Int64,
+			Name:        keyName.String,
+			Secret:      secret.String,
+			IsReference: isReference.Bool,
 		}
 	}
 
 	return &provider, nil
 }
 
+func (r *SQLiteRepository) ListProvidersWithKey(ctx context.Context) ([]Provider, error) {
+	rows, err := r.db.QueryContext(ctx, `
+        SELECT p.id, p.name, p.base_url, p.model,
+               k.id, k.name, k.secret, k.is_reference
+        FROM providers p
+        LEFT JOIN provider_keys k ON k.id = (
+            SELECT pk.id
+            FROM provider_keys pk
+            WHERE pk.provider_id = p.id AND pk.is_active = 1 AND `+usableKey("pk")+`
+            ORDER BY pk.id DESC
+            LIMIT 1
+        )
+        ORDER BY p.id`)
+	if err != nil {
+		return nil, logger.Errorf("failed to list providers: %w", err)
+	}
+
+	defer rows.Close()
+
+	var providers []Provider
+	for rows.Next() {
+		var provider Provider
+		var keyID sql.NullInt64
+		var keyName, secret sql.NullString
+		var isReference sql.NullBool
+
+		if err := rows.Scan(
+			&provider.ID, &provider.Name, &provider.BaseURL, &provider.Model,
+			&keyID, &keyName, &secret, &isReference,
+		); err != nil {
+			return nil, logger.Errorf("failed to scan provider: %w", err)
+		}
+
+		if keyID.Valid {
+			provider.SelectedKeyID = new(string)
+			*provider.SelectedKeyID = fmt.Sprintf("%d", keyID.Int64)
+			provider.ProviderKey = ProviderKey{
+				ID:          keyID.Int64,
+				Name:        keyName.String,
+				Secret:      secret.String,
+				IsReference: isReference.Bool,
+			}
+		}
+
+		providers = append(providers, provider)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, logger.Errorf("failed to list providers: %w", err)
+	}
+
+	return providers, nil
+}
+
+// ListActiveKeys returns a Provider for every active key that is usable,
+// newest key first
+func (r *SQLiteRepository) ListActiveKeys(ctx context.Context) ([]Provider, error) {
+	rows, err := r.db.QueryContext(ctx, `
+        SELECT p.id, p.name, p.base_url, p.model,
+               k.id, COALESCE(k.name, ''), k.secret, k.is_reference
+        FROM provider_keys k
+        JOIN providers p ON k.provider_id = p.id
+        WHERE k.is_active = 1 AND `+usableKey("k")+`
+        ORDER BY p.id, k.id DESC`)
+	if err != nil {
+		return nil, logger.Errorf("failed to list active keys: %w", err)
+	}
+
+	defer rows.Close()
+
+	var providers []Provider
+	for rows.Next() {
+		var provider Provider
+		if err := rows.Scan(
+			&provider.ID, &provider.Name, &provider.BaseURL, &provider.Model,
+			&provider.ProviderKey.ID, &provider.ProviderKey.Name, &provider.Secret, &provider.IsReference,
+		); err != nil {
+			return nil, logger.Errorf("failed to scan active key: %w", err)
+		}
+
+		provider.SelectedKeyID = new(string)
+		*provider.SelectedKeyID = fmt.Sprintf("%d", provider.ProviderKey.ID)
+
+		providers = append(providers, provider)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, logger.Errorf("failed to list active keys: %w", err)
+	}
+
+	return providers, nil
+}
+
+// Model alias repository
+func (r *SQLiteRepository) SetModelAlias(ctx context.Context, profileName, alias, model string) error {
+	if profileName == "" || alias == "" || model == "" {
+		return logger.Errorf("profile, alias and model cannot be empty")
+	}
+
+	result, err := r.db.ExecContext(ctx, `
+        INSERT INTO model_aliases (profile_id, alias, model)
+        SELECT id, $1, $2 FROM profiles WHERE name = $3
+        ON CONFLICT (profile_id, alias) DO UPDATE
+        SET model = excluded.model, updated_at = CURRENT_TIMESTAMP
+    `, alias, model, profileName)
+	if err != nil {
+		return logger.Errorf("failed to set model alias: %w", err)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return logger.Errorf("profile %q not found", profileName)
+	}
+
+	return nil
+}
+
+func (r *SQLiteRepository) DeleteModelAlias(ctx context.Context, profileName, alias string) error {
+	result, err := r.db.ExecContext(ctx, `
+        DELETE FROM model_aliases
+        WHERE alias = $1 AND profile_id = (SELECT id FROM profiles WHERE name = $2)
+    `, alias, profileName)
+	if err != nil {
+		return logger.Errorf("failed to delete model alias: %w", err)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return logger.Errorf("alias %q not found in profile %q", alias, profileName)
+	}
+
+	return nil
+}
+
+func (r *SQLiteRepository) ListModelAliases(ctx context.Context) ([]ModelAlias, error) {
+	rows, err := r.db.QueryContext(ctx, `
+        SELECT a.profile_id, p.name, a.alias, a.model
+        FROM model_aliases a
+        JOIN profiles p ON a.profile_id = p.id
+        ORDER BY p.name, a.alias`)
+	if err != nil {
+		return nil, logger.Errorf("failed to list model aliases: %w", err)
+	}
+
+	defer rows.Close()
+
+	var aliases []ModelAlias
+	for rows.Next() {
+		var alias ModelAlias
+		if err := rows.Scan(&alias.ProfileID, &alias.ProfileName, &alias.Alias, &alias.Model); err != nil {
+			return nil, logger.Errorf("failed to scan model alias: %w", err)
+		}
+
+		aliases = append(aliases, alias)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, logger.Errorf("failed to list model aliases: %w", err)
+	}
+
+	return aliases, nil
+}
+
 // User settings repository
 func (r *SQLiteRepository) CreateProfileSettings(ctx context.Context, userSettings ProfileSettings) (int64, error) {
 	if userSettings.ProfileID <= 0 || userSettings.ProviderID <= 0 {
@@ -247,26 +774,36 @@ func (r *SQLiteRepository) CreateProfileSettings(ctx context.Context, userSettin
 }
 
 func (r *SQLiteRepository) GetActiveProfileSettingsWithKey(ctx context.Context) (*ProfileSettings, error) {
+	return r.getProfileSettingsWithKey(ctx, "SELECT id FROM profiles WHERE is_active = 1 LIMIT 1")
+}
 
+func (r *SQLiteRepository) GetProfileSettingsWithKey(ctx context.Context, profileName string) (*ProfileSettings, error) {
+	if profileName == "" {
+		return nil, logger.Errorf("profile name cannot be empty")
+	}
+
+	return r.getProfileSettingsWithKey(ctx, "SELECT id FROM profiles WHERE name = $1", profileName)
+}
+
+// getProfileSettingsWithKey loads the settings of the profile selected by the
+// profileQuery subquery
+func (r *SQLiteRepository) getProfileSettingsWithKey(ctx context.Context, profileQuery string, args ...any) (*ProfileSettings, error) {
 	var settings ProfileSettings
 	var providerKeyID, providerID sql.NullInt64
 	var providerName, providerBaseURL, providerModel, keyName, keySecret sql.NullString
+	var keyIsReference sql.NullBool
 
 	err := r.db.QueryRowContext(ctx, `
-		SELECT ps.profile_id, ps.provider_id, ps.provider_key_id, p.name, p.base_url, p.model, k.name, k.secret
+		SELECT ps.profile_id, ps.provider_id, k.id, p.name, p.base_url, p.model, k.name, k.secret, k.is_reference
 		FROM profile_settings ps
 		LEFT JOIN providers p ON ps.provider_id = p.id
-		LEFT JOIN provider_keys k ON ps.provider_key_id = k.id
-		WHERE ps.profile_id = (
-			SELECT id
-			FROM profiles
-			WHERE is_active = 1
-			LIMIT 1
-		)`).
+		-- an unusable key is left out so callers fall back to another one
+		LEFT JOIN provider_keys k ON ps.provider_key_id = k.id AND `+usableKey("k")+`
+		WHERE ps.profile_id = (`+profileQuery+`)`, args...).
 		Scan(
 			&settings.ProfileID, &providerID, &providerKeyID,
 			&providerName, &providerBaseURL, &providerModel,
-			&keyName, &keySecret,
+			&keyName, &keySecret, &keyIsReference,
 		)
 
 	if err != nil {
@@ -293,11 +830,68 @@ func (r *SQLiteRepository) GetActiveProfileSettingsWithKey(ctx context.Context)
 	// Set ProviderKey details if available
 	if providerKeyID.Valid {
 		settings.Provider.ProviderKey = ProviderKey{
-			ID:     providerKeyID.Int64,
-			Name:   keyName.String,
-			Secret: keySecret.String,
+			ID:          providerKeyID.Int64,
+			Name:        keyName.String,
+			Secret:      keySecret.String,
+			IsReference: keyIsReference.Bool,
 		}
 	}
 
 	return &settings, nil
 }
+
+// Watch polls PRAGMA data_version on a dedicated connection and signals on the
+// returned channel whenever another connection or process commits a change.
+// The channel is closed once ctx is done.
+func (r *SQLiteRepository) Watch(ctx context.Context, interval time.Duration) (<-chan struct{}, error) {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return nil, logger.Errorf("failed to open watch connection: %w", err)
+	}
+
+	var version int64
+	if err := conn.QueryRowContext(ctx, "PRAGMA data_version").Scan(&version); err != nil {
+		conn.Close()
+		return nil, logger.Errorf("failed to read data version: %w", err)
+	}
+
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		defer close(changes)
+		defer conn.Close()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			var current int64
+			if err := conn.QueryRowContext(ctx, "PRAGMA data_version").Scan(&current); err != nil {
+				if ctx.Err() == nil {
+					logger.Errorf("failed to read data version: %v", err)
+				}
+				continue
+			}
+
+			if current == version {
+				continue
+			}
+
+			version = current
+
+			// coalesce bursts of changes into a single pending notification
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changes, nil
+}
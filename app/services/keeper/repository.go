@@ -0,0 +1,89 @@
+package keeper
+
+import (
+	"context"
+	"keeper/internal/logger"
+	"time"
+)
+
+// Repository stores profiles, providers, keys, model aliases and profile
+// settings. SQLiteRepository keeps them in a database file, MemoryRepository
+// in memory; keepertest.Conformance checks that both behave the same.
+type Repository interface {
+	// Profile repository
+	CreateProfile(ctx context.Context, req CreateProfileReq) (int64, error)
+	ListProfiles(ctx context.Context) ([]Profile, error)
+	GetActiveProfile(ctx context.Context) (*Profile, error)
+	SetActiveProfile(ctx context.Context, name string) error
+	SetProfileCache(ctx context.Context, name string, enabled bool) error
+
+	// Provider repository
+	CreateProviders(ctx context.Context, providers ...Provider) ([]int64, error)
+	CreateMissingProviders(ctx context.Context, providers ...Provider) error
+	GetProviderByName(ctx context.Context, name string) (*Provider, error)
+	GetProviderByNameWithKey(ctx context.Context, name string) (*Provider, error)
+	ListProvidersWithKey(ctx context.Context) ([]Provider, error)
+
+	// Key repository
+	CreateProviderKey(ctx context.Context, provider Provider, secret string, opts ProviderKeyOptions) (int64, error)
+	ListProviderKeys(ctx context.Context) ([]ProviderKeyInfo, error)
+	GetProviderKey(ctx context.Context, id int64) (*Provider, error)
+	ListActiveKeys(ctx context.Context) ([]Provider, error)
+	SetProviderKeyStatus(ctx context.Context, id int64, status KeyStatus) error
+	SetProviderKeyCooldown(ctx context.Context, id int64, until time.Time) error
+	NextKeyExpiry(ctx context.Context) (time.Time, error)
+
+	// Model alias repository
+	SetModelAlias(ctx context.Context, profileName, alias, model string) error
+	DeleteModelAlias(ctx context.Context, profileName, alias string) error
+	ListModelAliases(ctx context.Context) ([]ModelAlias, error)
+
+	// Profile settings repository
+	CreateProfileSettings(ctx context.Context, userSettings ProfileSettings) (int64, error)
+	GetActiveProfileSettingsWithKey(ctx context.Context) (*ProfileSettings, error)
+	GetProfileSettingsWithKey(ctx context.Context, profileName string) (*ProfileSettings, error)
+
+	// Watch signals on the returned channel whenever the stored setup
+	// changes, checking every interval. The channel is closed once ctx is
+	// done.
+	Watch(ctx context.Context, interval time.Duration) (<-chan struct{}, error)
+
+	Export(ctx context.Context, withKeys bool) (*Bundle, error)
+	Import(ctx context.Context, b *Bundle, opts ImportOptions) ([]ImportChange, error)
+}
+
+var (
+	_ Repository = (*SQLiteRepository)(nil)
+	_ Repository = (*MemoryRepository)(nil)
+)
+
+// Seed fills an empty repository: the default profile, active, and the
+// providers, the profile selecting the first one
+func Seed(ctx context.Context, repo Repository, providers ...Provider) error {
+	if len(providers) == 0 {
+		return logger.Errorf("no providers to seed")
+	}
+
+	userID, err := repo.CreateProfile(ctx, CreateProfileReq{
+		Name:      "default",
+		IsActive:  true,
+		IsDefault: true,
+	})
+	if err != nil {
+		return logger.Errorf("failed to create user: %v", err)
+	}
+
+	ps, err := repo.CreateProviders(ctx, providers...)
+	if err != nil {
+		return logger.Errorf("failed to create providers: %v", err)
+	}
+
+	if _, err := repo.CreateProfileSettings(ctx, ProfileSettings{
+		ProfileID:  userID,
+		ProviderID: ps[0],
+	}); err != nil {
+		return logger.Errorf("failed to create user settings: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package keeper_test
+
+import (
+	"testing"
+
+	"keeper/services/keeper"
+	"keeper/services/keeper/keepertest"
+)
+
+func TestSQLiteRepository(t *testing.T) {
+	keepertest.Conformance(t, func(t *testing.T) keeper.Repository {
+		_, repo, _ := keepertest.NewDatabase(t)
+		return repo
+	})
+}
+
+func TestMemoryRepository(t *testing.T) {
+	keepertest.Conformance(t, func(t *testing.T) keeper.Repository {
+		return keepertest.NewMemory(t)
+	})
+}
@@ -0,0 +1,272 @@
+package keeper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// maxResolvedSecret bounds what a resolver reads
+	maxResolvedSecret = 64 << 10
+	// execTimeout bounds an exec: command, e.g. a password manager waiting
+	// for an unlock that never comes
+	execTimeout = 10 * time.Second
+	// resolveTimeout bounds a lookup shared by concurrent callers, it
+	// outlives any one of them
+	resolveTimeout = 30 * time.Second
+)
+
+// Resolver turns the part of a secret reference after its scheme into the
+// secret, e.g. "/run/secrets/openai" for "file:/run/secrets/openai"
+type Resolver interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// ResolverFunc adapts a function to a Resolver
+type ResolverFunc func(ctx context.Context, ref string) (string, error)
+
+func (f ResolverFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+// SecretResolver resolves keys stored as references to an external source
+// such as "exec:pass show openai/team", "file:/run/secrets/openai" or
+// "env:OPENAI_KEY", so the raw secret never lands in the database. Only keys
+// stored as references are resolved, a key that merely looks like one is
+// used as it is. Resolved secrets are cached for the TTL, and concurrent
+// requests for the same reference share one lookup.
+type SecretResolver struct {
+	ttl    time.Duration
+	flight singleflight.Group
+
+	mu        sync.Mutex
+	resolvers map[string]Resolver
+	cache     map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// NewSecretResolver returns a resolver for the exec, file and env schemes,
+// caching for ttl, not at all when zero
+func NewSecretResolver(ttl time.Duration) *SecretResolver {
+	r := &SecretResolver{
+		ttl:       ttl,
+		resolvers: map[string]Resolver{},
+		cache:     map[string]cachedSecret{},
+	}
+
+	r.Register("exec", ResolverFunc(resolveExec))
+	r.Register("file", ResolverFunc(resolveFile))
+	r.Register("env", ResolverFunc(resolveEnv))
+
+	return r
+}
+
+// Register makes references starting with "<scheme>:" resolve through res
+func (r *SecretResolver) Register(scheme string, res Resolver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.resolvers[scheme] = res
+}
+
+// Schemes lists the registered reference schemes
+func (r *SecretResolver) Schemes() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	schemes := make([]string, 0, len(r.resolvers))
+	for scheme := range r.resolvers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// IsReference reports whether secret is a reference with a registered
+// scheme, e.g. to validate one before it is stored
+func (r *SecretResolver) IsReference(secret string) bool {
+	_, _, ok := r.resolver(secret)
+	return ok
+}
+
+func (r *SecretResolver) resolver(secret string) (Resolver, string, bool) {
+	scheme, ref, ok := strings.Cut(secret, ":")
+	if !ok {
+		return nil, "", false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res, ok := r.resolvers[scheme]
+	return res, ref, ok
+}
+
+// ResolveKey returns the secret of a stored key: the key itself, or what it
+// refers to when it was stored as a reference
+func (r *SecretResolver) ResolveKey(ctx context.Context, key ProviderKey) (string, error) {
+	if !key.IsReference {
+		return key.Secret, nil
+	}
+
+	return r.Resolve(ctx, key.Secret)
+}
+
+// Resolve returns the secret a reference stands for
+func (r *SecretResolver) Resolve(ctx context.Context, secret string) (string, error) {
+	if r == nil {
+		return "", fmt.Errorf("secret references are not resolved")
+	}
+
+	res, ref, ok := r.resolver(secret)
+	if !ok {
+		scheme, _, _ := strings.Cut(secret, ":")
+		return "", fmt.Errorf("unknown reference scheme %q, expected one of %s", scheme, strings.Join(r.Schemes(), ", "))
+	}
+
+	r.mu.Lock()
+	cached, hit := r.cache[secret]
+	r.mu.Unlock()
+
+	if hit && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	// a prompt or a slow command runs once however many requests wait on it
+	ch := r.flight.DoChan(secret, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), resolveTimeout)
+		defer cancel()
+
+		return r.lookup(ctx, res, secret, ref)
+	})
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case result := <-ch:
+		if result.Err != nil {
+			return "", result.Err
+		}
+		return result.Val.(string), nil
+	}
+}
+
+// lookup resolves ref and caches the secret
+func (r *SecretResolver) lookup(ctx context.Context, res Resolver, secret, ref string) (string, error) {
+	value, err := res.Resolve(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", fmt.Errorf("secret reference resolved to nothing")
+	}
+
+	if r.ttl > 0 {
+		r.mu.Lock()
+		r.cache[secret] = cachedSecret{value: value, expires: time.Now().Add(r.ttl)}
+		r.mu.Unlock()
+	}
+
+	return value, nil
+}
+
+// resolveExec runs a command and reads the secret from its output. The
+// command is split on spaces and run without a shell.
+func resolveExec(ctx context.Context, ref string) (string, error) {
+	args := strings.Fields(ref)
+	if len(args) == 0 {
+		return "", fmt.Errorf("exec: reference names no command")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, execTimeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{max: maxResolvedSecret}
+	stderr := &limitedBuffer{max: maxResolvedSecret}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if stdout.full {
+			return "", fmt.Errorf("%s printed more than a secret", args[0])
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s failed: %w: %s", args[0], err, msg)
+		}
+		return "", fmt.Errorf("%s failed: %w", args[0], err)
+	}
+
+	// password managers such as pass print the secret on the first line
+	first, _, _ := strings.Cut(stdout.String(), "\n")
+
+	return first, nil
+}
+
+// errOutputLimit stops copying the output of a command that prints too much
+var errOutputLimit = errors.New("output limit reached")
+
+// limitedBuffer holds up to max bytes of a command's output. Writing more
+// fails, which ends the command rather than buffering all it prints.
+type limitedBuffer struct {
+	// buf is not embedded, its ReadFrom would bypass Write
+	buf  bytes.Buffer
+	max  int
+	full bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.max {
+		b.full = true
+		return 0, errOutputLimit
+	}
+
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
+
+func resolveFile(_ context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxResolvedSecret))
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func resolveEnv(_ context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,50 @@
+package keeper_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"keeper/services/keeper"
+)
+
+func TestResolveShared(t *testing.T) {
+	var lookups atomic.Int32
+	release := make(chan struct{})
+
+	r := keeper.NewSecretResolver(time.Minute)
+	r.Register("slow", keeper.ResolverFunc(func(ctx context.Context, ref string) (string, error) {
+		lookups.Add(1)
+		<-release
+		return "sk-" + ref, nil
+	}))
+
+	// a caller giving up leaves the lookup to the others
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.Resolve(canceled, "slow:openai"); err != context.Canceled {
+		t.Errorf("Resolve with a canceled context = %v, want %v", err, context.Canceled)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if got, err := r.Resolve(context.Background(), "slow:openai"); err != nil || got != "sk-openai" {
+				t.Errorf("Resolve = %q, %v, want sk-openai", got, err)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("resolved the reference %d times, want once", n)
+	}
+}
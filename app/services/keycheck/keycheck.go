@@ -0,0 +1,158 @@
+// Package keycheck tells whether a provider key works by sending the cheap
+// request the registry declares for the provider, such as listing models.
+package keycheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	provider_registry "keeper/internal/provider-registry"
+	"keeper/services/keeper"
+)
+
+const (
+	// maxErrorBody bounds how much of an error response is read
+	maxErrorBody = 64 << 10
+	// maxDetail bounds the message kept from it
+	maxDetail = 200
+)
+
+// Result is the outcome of a check
+type Result struct {
+	Status keeper.KeyStatus
+	// Detail is the provider's message when it rejected the key
+	Detail string
+	// RateLimited is set when a valid key was throttled, RetryAfter is how
+	// long the provider asked to wait, zero when it did not say
+	RateLimited bool
+	RetryAfter  time.Duration
+}
+
+type Checker struct {
+	client *http.Client
+}
+
+func New() *Checker {
+	return &Checker{client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+// Check sends the provider's health check to baseURL with secret. An error
+// means the check itself failed, e.g. the provider was unreachable, and
+// says nothing about the key.
+func (c *Checker) Check(ctx context.Context, provider provider_registry.Provider, baseURL, secret string) (Result, error) {
+	if provider.Builtin {
+		return Result{Status: keeper.KeyStatusValid}, nil
+	}
+
+	check := provider.HealthCheck
+	if check.Path == "" {
+		return Result{}, fmt.Errorf("provider %s declares no health check", provider.Name)
+	}
+
+	method := check.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+check.Path, nil)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	for k, v := range check.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set(provider.AuthHeader(secret))
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to reach %s: %w", provider.Name, err)
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+
+	status, ok := Classify(res.StatusCode, body)
+	if !ok {
+		return Result{}, fmt.Errorf("%s answered the health check with %s", provider.Name, res.Status)
+	}
+
+	result := Result{Status: status}
+	if status != keeper.KeyStatusValid {
+		result.Detail = errorMessage(body)
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests && status == keeper.KeyStatusValid {
+		result.RateLimited = true
+		result.RetryAfter = retryAfter(res.Header.Get("Retry-After"))
+	}
+
+	return result, nil
+}
+
+// retryAfter reads a Retry-After header given in seconds or as a date
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+
+	return 0
+}
+
+// Classify maps a provider response to the status of the key it was sent
+// with, false when the response says nothing about the key such as a 5xx.
+// A rate limited key still authenticated, only running out of credit
+// counts as exceeding the quota.
+func Classify(code int, body []byte) (keeper.KeyStatus, bool) {
+	switch {
+	case code >= 200 && code < 300:
+		return keeper.KeyStatusValid, true
+	case code == http.StatusUnauthorized:
+		return keeper.KeyStatusInvalid, true
+	case code == http.StatusForbidden:
+		return keeper.KeyStatusRevoked, true
+	case code == http.StatusPaymentRequired:
+		return keeper.KeyStatusQuotaExceeded, true
+	case code == http.StatusTooManyRequests:
+		text := strings.ToLower(string(body))
+		if strings.Contains(text, "quota") || strings.Contains(text, "billing") || strings.Contains(text, "credit") {
+			return keeper.KeyStatusQuotaExceeded, true
+		}
+		return keeper.KeyStatusValid, true
+	default:
+		return "", false
+	}
+}
+
+// errorMessage reads the message out of the OpenAI and Anthropic error shapes
+func errorMessage(body []byte) string {
+	var payload struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	message := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Error.Message != "" {
+		message = payload.Error.Message
+	}
+
+	if len(message) > maxDetail {
+		message = message[:maxDetail] + "..."
+	}
+
+	return message
+}
@@ -0,0 +1,43 @@
+package keycheck_test
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"keeper/services/keeper"
+	"keeper/services/keycheck"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		code   int
+		body   string
+		status keeper.KeyStatus
+		ok     bool
+	}{
+		{code: http.StatusOK, status: keeper.KeyStatusValid, ok: true},
+		{code: http.StatusNoContent, status: keeper.KeyStatusValid, ok: true},
+		{code: http.StatusUnauthorized, body: `{"error":{"message":"Incorrect API key provided"}}`, status: keeper.KeyStatusInvalid, ok: true},
+		{code: http.StatusForbidden, body: `{"error":{"message":"This key has been revoked"}}`, status: keeper.KeyStatusRevoked, ok: true},
+		{code: http.StatusPaymentRequired, status: keeper.KeyStatusQuotaExceeded, ok: true},
+		{code: http.StatusTooManyRequests, body: `{"error":{"message":"Rate limit reached for requests","type":"requests"}}`, status: keeper.KeyStatusValid, ok: true},
+		{code: http.StatusTooManyRequests, status: keeper.KeyStatusValid, ok: true},
+		{code: http.StatusTooManyRequests, body: `{"error":{"message":"You exceeded your current quota, please check your plan","type":"insufficient_quota"}}`, status: keeper.KeyStatusQuotaExceeded, ok: true},
+		{code: http.StatusTooManyRequests, body: `{"type":"error","error":{"message":"Your credit balance is too low"}}`, status: keeper.KeyStatusQuotaExceeded, ok: true},
+		{code: http.StatusTooManyRequests, body: `{"error":{"message":"Check your Billing details"}}`, status: keeper.KeyStatusQuotaExceeded, ok: true},
+		{code: http.StatusBadRequest},
+		{code: http.StatusNotFound},
+		{code: http.StatusInternalServerError},
+		{code: http.StatusServiceUnavailable, body: `{"error":{"message":"quota service unavailable"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.code)+" "+tt.body, func(t *testing.T) {
+			status, ok := keycheck.Classify(tt.code, []byte(tt.body))
+			if status != tt.status || ok != tt.ok {
+				t.Errorf("Classify(%d, %q) = %q, %v, want %q, %v", tt.code, tt.body, status, ok, tt.status, tt.ok)
+			}
+		})
+	}
+}
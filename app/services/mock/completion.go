@@ -0,0 +1,179 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// completion is a generated answer, rendered in the shape of either API
+type completion struct {
+	id     string
+	model  string
+	text   string
+	input  int
+	output int
+}
+
+func (c completion) openAI(chat bool) map[string]any {
+	res := map[string]any{
+		"id":      "chatcmpl-" + c.id,
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   c.model,
+		"choices": []map[string]any{{
+			"index":         0,
+			"message":       map[string]any{"role": "assistant", "content": c.text},
+			"finish_reason": "stop",
+		}},
+		"usage": c.openAIUsage(),
+	}
+
+	// the legacy completions endpoint answers with plain text choices
+	if !chat {
+		res["id"] = "cmpl-" + c.id
+		res["object"] = "text_completion"
+		res["choices"] = []map[string]any{{"index": 0, "text": c.text, "finish_reason": "stop"}}
+	}
+
+	return res
+}
+
+func (c completion) openAIUsage() map[string]any {
+	return map[string]any{
+		"prompt_tokens":     c.input,
+		"completion_tokens": c.output,
+		"total_tokens":      c.input + c.output,
+	}
+}
+
+func (c completion) anthropic() map[string]any {
+	return map[string]any{
+		"id":            "msg_" + c.id,
+		"type":          "message",
+		"role":          "assistant",
+		"model":         c.model,
+		"content":       []map[string]any{{"type": "text", "text": c.text}},
+		"stop_reason":   "end_turn",
+		"stop_sequence": nil,
+		"usage":         map[string]any{"input_tokens": c.input, "output_tokens": c.output},
+	}
+}
+
+// chunks splits the text into words, keeping the spaces so the pieces
+// join back into the original
+func (c completion) chunks() []string {
+	var chunks []string
+	for _, word := range strings.SplitAfter(c.text, " ") {
+		if word != "" {
+			chunks = append(chunks, word)
+		}
+	}
+
+	return chunks
+}
+
+func (s *Server) streamOpenAI(w http.ResponseWriter, r *http.Request, c completion) {
+	stream := newEventStream(w)
+
+	chunk := func(delta map[string]any, finish any) map[string]any {
+		return map[string]any{
+			"id":      "chatcmpl-" + c.id,
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   c.model,
+			"choices": []map[string]any{{"index": 0, "delta": delta, "finish_reason": finish}},
+		}
+	}
+
+	stream.send("", chunk(map[string]any{"role": "assistant", "content": ""}, nil))
+
+	for _, text := range c.chunks() {
+		if !sleep(r, s.cfg.ChunkDelay) {
+			return
+		}
+		stream.send("", chunk(map[string]any{"content": text}, nil))
+	}
+
+	final := chunk(map[string]any{}, "stop")
+	final["usage"] = c.openAIUsage()
+	stream.send("", final)
+	stream.done()
+}
+
+func (s *Server) streamAnthropic(w http.ResponseWriter, r *http.Request, c completion) {
+	stream := newEventStream(w)
+
+	message := c.anthropic()
+	message["content"] = []any{}
+	message["stop_reason"] = nil
+	message["usage"] = map[string]any{"input_tokens": c.input, "output_tokens": 0}
+
+	stream.send("message_start", map[string]any{"type": "message_start", "message": message})
+	stream.send("content_block_start", map[string]any{
+		"type": "content_block_start", "index": 0,
+		"content_block": map[string]any{"type": "text", "text": ""},
+	})
+
+	for _, text := range c.chunks() {
+		if !sleep(r, s.cfg.ChunkDelay) {
+			return
+		}
+		stream.send("content_block_delta", map[string]any{
+			"type": "content_block_delta", "index": 0,
+			"delta": map[string]any{"type": "text_delta", "text": text},
+		})
+	}
+
+	stream.send("content_block_stop", map[string]any{"type": "content_block_stop", "index": 0})
+	stream.send("message_delta", map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": "end_turn", "stop_sequence": nil},
+		"usage": map[string]any{"output_tokens": c.output},
+	})
+	stream.send("message_stop", map[string]any{"type": "message_stop"})
+}
+
+// eventStream writes server-sent events, flushing each one
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newEventStream(w http.ResponseWriter) *eventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+
+	return &eventStream{w: w, flusher: flusher}
+}
+
+func (s *eventStream) send(event string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	if event != "" {
+		fmt.Fprintf(s.w, "event: %s\n", event)
+	}
+	fmt.Fprintf(s.w, "data: %s\n\n", payload)
+
+	s.flush()
+}
+
+// done ends an OpenAI stream
+func (s *eventStream) done() {
+	fmt.Fprint(s.w, "data: [DONE]\n\n")
+	s.flush()
+}
+
+func (s *eventStream) flush() {
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
@@ -0,0 +1,356 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "keeper/internal/logger"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Headers that override the configuration for a single request
+const (
+	statusHeader  = "X-Keeper-Mock-Status"
+	latencyHeader = "X-Keeper-Mock-Latency"
+)
+
+// RequestHeaders are the headers above, the proxy strips them from requests
+// to other providers
+var RequestHeaders = []string{statusHeader, latencyHeader}
+
+const defaultResponse = "This is a mock response from keeper to: {{ .Prompt }}"
+
+// Config shapes the responses of the mock provider
+type Config struct {
+	// Latency is waited before answering
+	Latency time.Duration `yaml:"latency"`
+	// ChunkDelay is waited between the chunks of a streamed response
+	ChunkDelay time.Duration `yaml:"chunk_delay"`
+	// Response is the text answered, a text/template over .Model, .Prompt
+	// and .Request, the number of the request
+	Response string `yaml:"response"`
+	// Schedule is cycled through request by request, every request succeeds
+	// when empty
+	Schedule []Step `yaml:"schedule"`
+}
+
+// Step answers Times requests in a row with Status
+type Step struct {
+	// Status defaults to 200
+	Status int `yaml:"status"`
+	// Times defaults to 1
+	Times int `yaml:"times"`
+	// RetryAfter is sent with 429 and 503 responses
+	RetryAfter time.Duration `yaml:"retry_after"`
+	// Latency replaces the configured latency for these requests
+	Latency time.Duration `yaml:"latency"`
+}
+
+// Load reads a YAML config, the defaults when path is empty
+func Load(path string) (Config, error) {
+	cfg := Config{
+		ChunkDelay: 20 * time.Millisecond,
+		Response:   defaultResponse,
+	}
+
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read mock config: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse mock config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Server answers OpenAI and Anthropic shaped requests without any upstream
+type Server struct {
+	cfg      Config
+	response *template.Template
+
+	mu       sync.Mutex
+	requests int
+}
+
+func New(cfg Config) (*Server, error) {
+	if cfg.Response == "" {
+		cfg.Response = defaultResponse
+	}
+
+	tmpl, err := template.New("response").Parse(cfg.Response)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mock response template: %w", err)
+	}
+
+	for i, step := range cfg.Schedule {
+		if step.Status != 0 && !validStatus(step.Status) {
+			return nil, fmt.Errorf("invalid status %d in mock schedule step %d", step.Status, i+1)
+		}
+	}
+
+	return &Server{cfg: cfg, response: tmpl}, nil
+}
+
+// request is the part of a completion request the mock looks at
+type request struct {
+	Model    string    `json:"model"`
+	Stream   bool      `json:"stream"`
+	Prompt   any       `json:"prompt"`
+	Messages []message `json:"messages"`
+}
+
+type message struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// listing models is no completion, the schedule neither applies to it
+	// nor advances
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/models") {
+		if !sleep(r, s.cfg.Latency) {
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"object": "list",
+			"data":   []map[string]any{{"id": "mock-1", "object": "model", "owned_by": "keeper"}},
+		})
+		return
+	}
+
+	n, step := s.next()
+
+	if v := r.Header.Get(statusHeader); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil || !validStatus(status) {
+			http.Error(w, "invalid "+statusHeader, http.StatusBadRequest)
+			return
+		}
+		step = Step{Status: status}
+	}
+
+	latency := s.cfg.Latency
+	if step.Latency > 0 {
+		latency = step.Latency
+	}
+	if v := r.Header.Get(latencyHeader); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "invalid "+latencyHeader, http.StatusBadRequest)
+			return
+		}
+		latency = d
+	}
+
+	if !sleep(r, latency) {
+		return
+	}
+
+	anthropic := strings.HasSuffix(r.URL.Path, "/messages")
+
+	if step.Status != 0 && step.Status != http.StatusOK {
+		log.Debugf("Mock answering request %d with %d", n, step.Status)
+		writeFailure(w, step, anthropic)
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFailure(w, Step{Status: http.StatusBadRequest}, anthropic)
+		return
+	}
+
+	if req.Model == "" {
+		req.Model = "mock-1"
+	}
+
+	var text bytes.Buffer
+	if err := s.response.Execute(&text, map[string]any{
+		"Model":   req.Model,
+		"Prompt":  req.prompt(),
+		"Request": n,
+	}); err != nil {
+		http.Error(w, "failed to render mock response", http.StatusInternalServerError)
+		return
+	}
+
+	c := completion{
+		id:     fmt.Sprintf("mock-%d", n),
+		model:  req.Model,
+		text:   text.String(),
+		input:  countTokens(req.prompt()),
+		output: countTokens(text.String()),
+	}
+
+	switch {
+	case anthropic && req.Stream:
+		s.streamAnthropic(w, r, c)
+	case anthropic:
+		writeJSON(w, http.StatusOK, c.anthropic())
+	case req.Stream:
+		s.streamOpenAI(w, r, c)
+	default:
+		writeJSON(w, http.StatusOK, c.openAI(strings.HasSuffix(r.URL.Path, "/chat/completions")))
+	}
+}
+
+// next numbers the request and returns the schedule step it falls on
+func (s *Server) next() (int, Step) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+
+	total := 0
+	for _, step := range s.cfg.Schedule {
+		total += max(step.Times, 1)
+	}
+
+	if total == 0 {
+		return s.requests, Step{Status: http.StatusOK}
+	}
+
+	pos := (s.requests - 1) % total
+	for _, step := range s.cfg.Schedule {
+		if pos < max(step.Times, 1) {
+			return s.requests, step
+		}
+		pos -= max(step.Times, 1)
+	}
+
+	return s.requests, Step{Status: http.StatusOK}
+}
+
+// prompt is the text of the last user message, or the legacy prompt
+func (r request) prompt() string {
+	for i := len(r.Messages) - 1; i >= 0; i-- {
+		if r.Messages[i].Role == "user" {
+			return contentText(r.Messages[i].Content)
+		}
+	}
+
+	return contentText(r.Prompt)
+}
+
+// contentText flattens string content and arrays of text blocks
+func contentText(content any) string {
+	switch c := content.(type) {
+	case string:
+		return c
+	case []any:
+		var parts []string
+		for _, block := range c {
+			switch b := block.(type) {
+			case string:
+				parts = append(parts, b)
+			case map[string]any:
+				if text, ok := b["text"].(string); ok {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, " ")
+	default:
+		return ""
+	}
+}
+
+// validStatus accepts final statuses, a 1xx response is informational and
+// never answers a request on its own
+func validStatus(status int) bool {
+	return status >= 200 && status <= 599
+}
+
+// countTokens roughly estimates tokens as words
+func countTokens(text string) int {
+	return len(strings.Fields(text))
+}
+
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	select {
+	case <-r.Context().Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func writeFailure(w http.ResponseWriter, step Step, anthropic bool) {
+	if step.RetryAfter > 0 && (step.Status == http.StatusTooManyRequests || step.Status == http.StatusServiceUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(step.RetryAfter.Round(time.Second).Seconds())))
+	}
+
+	message := fmt.Sprintf("mock error %d", step.Status)
+	if text := http.StatusText(step.Status); text != "" {
+		message = fmt.Sprintf("mock %s", strings.ToLower(text))
+	}
+
+	if anthropic {
+		writeJSON(w, step.Status, map[string]any{
+			"type":  "error",
+			"error": map[string]any{"type": anthropicErrorType(step.Status), "message": message},
+		})
+		return
+	}
+
+	writeJSON(w, step.Status, map[string]any{
+		"error": map[string]any{"message": message, "type": openAIErrorType(step.Status), "code": nil},
+	})
+}
+
+func openAIErrorType(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_exceeded"
+	case status == http.StatusUnauthorized:
+		return "invalid_api_key"
+	case status >= http.StatusInternalServerError:
+		return "server_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+func anthropicErrorType(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusServiceUnavailable, status == 529:
+		return "overloaded_error"
+	case status >= http.StatusInternalServerError:
+		return "api_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("failed to encode mock response: %v", err)
+	}
+}
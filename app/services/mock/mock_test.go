@@ -0,0 +1,145 @@
+package mock_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"keeper/services/mock"
+)
+
+const completion = `{"model":"mock-1","messages":[{"role":"user","content":"hi"}]}`
+
+func serve(s *mock.Server, method, path string, header http.Header) *httptest.ResponseRecorder {
+	body := ""
+	if method == http.MethodPost {
+		body = completion
+	}
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for name, values := range header {
+		r.Header[name] = values
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestSchedule(t *testing.T) {
+	s, err := mock.New(mock.Config{Schedule: []mock.Step{
+		{Status: http.StatusTooManyRequests, Times: 2, RetryAfter: 3 * time.Second},
+		{},
+		{Status: http.StatusServiceUnavailable},
+	}})
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+
+	// the requests run in order through the cycle of 4 steps
+	tests := []struct {
+		method     string
+		path       string
+		status     int
+		retryAfter string
+	}{
+		{method: http.MethodPost, path: "/v1/chat/completions", status: http.StatusTooManyRequests, retryAfter: "3"},
+		{method: http.MethodGet, path: "/v1/models", status: http.StatusOK},
+		{method: http.MethodPost, path: "/v1/messages", status: http.StatusTooManyRequests, retryAfter: "3"},
+		{method: http.MethodPost, path: "/v1/chat/completions", status: http.StatusOK},
+		{method: http.MethodGet, path: "/v1/models", status: http.StatusOK},
+		{method: http.MethodGet, path: "/v1/models", status: http.StatusOK},
+		{method: http.MethodPost, path: "/v1/completions", status: http.StatusServiceUnavailable},
+		{method: http.MethodPost, path: "/v1/chat/completions", status: http.StatusTooManyRequests, retryAfter: "3"},
+		{method: http.MethodPost, path: "/v1/chat/completions", status: http.StatusTooManyRequests, retryAfter: "3"},
+		{method: http.MethodPost, path: "/v1/chat/completions", status: http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		w := serve(s, tt.method, tt.path, nil)
+
+		if w.Code != tt.status {
+			t.Errorf("request %d %s %s: status %d, want %d", i+1, tt.method, tt.path, w.Code, tt.status)
+		}
+
+		if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("request %d %s %s: Retry-After %q, want %q", i+1, tt.method, tt.path, got, tt.retryAfter)
+		}
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	s, err := mock.New(mock.Config{Schedule: []mock.Step{{Status: http.StatusInternalServerError}}})
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		status  string
+		latency string
+		want    int
+		// waited is the least time the response takes
+		waited time.Duration
+	}{
+		{name: "schedule", want: http.StatusInternalServerError},
+		{name: "status", status: "200", want: http.StatusOK},
+		{name: "error status", status: "429", want: http.StatusTooManyRequests},
+		{name: "informational status", status: "101", want: http.StatusBadRequest},
+		{name: "status out of range", status: "600", want: http.StatusBadRequest},
+		{name: "status not a number", status: "ok", want: http.StatusBadRequest},
+		{name: "latency", status: "200", latency: "50ms", want: http.StatusOK, waited: 50 * time.Millisecond},
+		{name: "latency with an error", latency: "50ms", want: http.StatusInternalServerError, waited: 50 * time.Millisecond},
+		{name: "latency not a duration", latency: "soon", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.status != "" {
+				header.Set("X-Keeper-Mock-Status", tt.status)
+			}
+			if tt.latency != "" {
+				header.Set("X-Keeper-Mock-Latency", tt.latency)
+			}
+
+			start := time.Now()
+			w := serve(s, http.MethodPost, "/v1/chat/completions", header)
+
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			if waited := time.Since(start); waited < tt.waited {
+				t.Errorf("answered after %s, want at least %s", waited, tt.waited)
+			}
+		})
+	}
+}
+
+func TestScheduleStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		valid  bool
+	}{
+		{status: 0, valid: true},
+		{status: 200, valid: true},
+		{status: 429, valid: true},
+		{status: 599, valid: true},
+		{status: 100},
+		{status: 199},
+		{status: 600},
+		{status: -1},
+	}
+
+	for _, tt := range tests {
+		_, err := mock.New(mock.Config{Schedule: []mock.Step{{Status: tt.status}}})
+		if (err == nil) != tt.valid {
+			t.Errorf("schedule with status %d: error %v, want valid %v", tt.status, err, tt.valid)
+		}
+	}
+}
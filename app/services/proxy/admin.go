@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "keeper/internal/logger"
+)
+
+// Status is the live state reported by /admin/status
+type Status struct {
+	PID       int       `json:"pid"`
+	Addr      string    `json:"addr"`
+	Socket    string    `json:"socket,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	Uptime    string    `json:"uptime"`
+	Requests  int64     `json:"requests"`
+	Errors    int64     `json:"errors"`
+	Profile   string    `json:"profile"`
+	Provider  string    `json:"provider"`
+	Key       string    `json:"key"`
+	LoadedAt  time.Time `json:"loaded_at"`
+}
+
+// UsageEntry aggregates the requests served with one profile, provider and key
+type UsageEntry struct {
+	Profile    string    `json:"profile"`
+	Provider   string    `json:"provider"`
+	Key        string    `json:"key"`
+	Requests   int64     `json:"requests"`
+	Errors     int64     `json:"errors"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// KeyHealth describes a stored key and how it has fared since the server started
+type KeyHealth struct {
+	ID         int64     `json:"id"`
+	Provider   string    `json:"provider"`
+	Name       string    `json:"name"`
+	Active     bool      `json:"active"`
+	Status     string    `json:"status"`
+	Selected   bool      `json:"selected"`
+	Requests   int64     `json:"requests"`
+	Errors     int64     `json:"errors"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// ProfileRequest selects the active profile through /admin/profile
+type ProfileRequest struct {
+	Name string `json:"name"`
+}
+
+type usageKey struct {
+	profile  string
+	provider string
+	key      string
+}
+
+type usageStats struct {
+	mu       sync.Mutex
+	requests int64
+	errors   int64
+	entries  map[usageKey]*UsageEntry
+}
+
+func newUsageStats() *usageStats {
+	return &usageStats{entries: map[usageKey]*UsageEntry{}}
+}
+
+func (u *usageStats) record(profile, provider, key string, status int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	k := usageKey{profile: profile, provider: provider, key: key}
+	entry, ok := u.entries[k]
+	if !ok {
+		entry = &UsageEntry{Profile: profile, Provider: provider, Key: key}
+		u.entries[k] = entry
+	}
+
+	u.requests++
+	entry.Requests++
+	entry.LastUsedAt = time.Now()
+
+	if status >= http.StatusBadRequest {
+		u.errors++
+		entry.Errors++
+	}
+}
+
+func (u *usageStats) totals() (requests, errors int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.requests, u.errors
+}
+
+func (u *usageStats) list() []UsageEntry {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	entries := make([]UsageEntry, 0, len(u.entries))
+	for _, e := range u.entries {
+		entries = append(entries, *e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Profile != entries[j].Profile {
+			return entries[i].Profile < entries[j].Profile
+		}
+		if entries[i].Provider != entries[j].Provider {
+			return entries[i].Provider < entries[j].Provider
+		}
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries
+}
+
+func (h *Service) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /admin/status", h.adminStatus)
+	mux.HandleFunc("POST /admin/reload", h.adminReload)
+	mux.HandleFunc("GET /admin/profile", h.adminGetProfile)
+	mux.HandleFunc("PUT /admin/profile", h.adminSetProfile)
+	mux.HandleFunc("GET /admin/usage", h.adminUsage)
+	mux.HandleFunc("GET /admin/keys/health", h.adminKeysHealth)
+	mux.HandleFunc("POST /admin/tokens", h.adminIssueToken)
+	mux.Handle("GET /metrics", h.metrics.registry.Handler())
+
+	return mux
+}
+
+// startAdmin serves the admin API on a Unix domain socket only the current
+// user can connect to.
+func (h *Service) startAdmin() error {
+	if h.opts.AdminSocket == "" {
+		return nil
+	}
+
+	l, err := listenUnix(h.opts.AdminSocket)
+	if err != nil {
+		return err
+	}
+
+	h.admin = &http.Server{Handler: h.adminMux()}
+
+	go func() {
+		if err := h.admin.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("admin server failed: %v", err)
+		}
+	}()
+
+	log.Debugf("Admin API listening on %s", h.opts.AdminSocket)
+
+	return nil
+}
+
+func (h *Service) stopAdmin(ctx context.Context) error {
+	if h.admin == nil {
+		return nil
+	}
+
+	defer os.Remove(h.opts.AdminSocket)
+
+	return h.admin.Shutdown(ctx)
+}
+
+func (h *Service) adminStatus(w http.ResponseWriter, r *http.Request) {
+	requests, errors := h.usage.totals()
+
+	status := Status{
+		PID:       os.Getpid(),
+		Addr:      h.server.Addr,
+		Socket:    h.socket,
+		StartedAt: h.startedAt,
+		Uptime:    time.Since(h.startedAt).Round(time.Second).String(),
+		Requests:  requests,
+		Errors:    errors,
+	}
+
+	if snap := h.snapshot.Load(); snap != nil {
+		status.Profile = snap.profile.Name
+		status.Provider = snap.settings.Name
+		status.Key = snap.settings.ProviderKey.Name
+		status.LoadedAt = snap.loadedAt
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (h *Service) adminReload(w http.ResponseWriter, r *http.Request) {
+	if err := h.Reload(r.Context()); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.adminStatus(w, r)
+}
+
+func (h *Service) adminGetProfile(w http.ResponseWriter, r *http.Request) {
+	snap := h.snapshot.Load()
+	if snap == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("settings not loaded"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ProfileRequest{Name: snap.profile.Name})
+}
+
+func (h *Service) adminSetProfile(w http.ResponseWriter, r *http.Request) {
+	var req ProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.keeper.SetActiveProfile(r.Context(), req.Name); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.Reload(r.Context()); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Infof("Switched active profile to %s", req.Name)
+
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (h *Service) adminUsage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.usage.list())
+}
+
+func (h *Service) adminKeysHealth(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.keeper.ListProviderKeys(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var selectedID int64
+	if snap := h.snapshot.Load(); snap != nil {
+		selectedID = snap.settings.ProviderKey.ID
+	}
+
+	usage := map[usageKey]UsageEntry{}
+	for _, e := range h.usage.list() {
+		k := usageKey{provider: e.Provider, key: e.Key}
+		agg := usage[k]
+		agg.Requests += e.Requests
+		agg.Errors += e.Errors
+		if e.LastUsedAt.After(agg.LastUsedAt) {
+			agg.LastUsedAt = e.LastUsedAt
+		}
+		usage[k] = agg
+	}
+
+	health := make([]KeyHealth, 0, len(keys))
+	for _, k := range keys {
+		u := usage[usageKey{provider: k.ProviderName, key: k.Name}]
+
+		health = append(health, KeyHealth{
+			ID:         k.ID,
+			Provider:   k.ProviderName,
+			Name:       k.Name,
+			Active:     k.IsActive,
+			Status:     string(k.Status),
+			Selected:   k.ID == selectedID,
+			Requests:   u.Requests,
+			Errors:     u.Errors,
+			LastUsedAt: u.LastUsedAt,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, health)
+}
+
+func (h *Service) adminIssueToken(w http.ResponseWriter, r *http.Request) {
+	var req TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	snap := h.snapshot.Load()
+	if snap == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("settings not loaded"))
+		return
+	}
+
+	if _, ok := snap.provider(req.Provider); !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown provider %s", req.Provider))
+		return
+	}
+
+	if _, err := snap.settingsFor(req.Profile, req.Provider, req.Key); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.TTL <= 0 {
+		req.TTL = defaultTokenTTL
+	}
+
+	token, err := h.tokens.issue(req)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Debugf("Issued token for %s (profile %q), expires %s", req.Provider, req.Profile, token.ExpiresAt.Format(time.RFC3339))
+
+	writeJSON(w, http.StatusOK, token)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("failed to encode admin response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
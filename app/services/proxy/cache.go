@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "keeper/internal/logger"
+	"keeper/services/cache"
+	"keeper/services/keeper"
+)
+
+const (
+	defaultCacheTTL = 24 * time.Hour
+
+	// cacheHeader tells the client whether the response came from the cache
+	cacheHeader = "X-Keeper-Cache"
+)
+
+// UseCache stores responses in repo for the profiles that enable caching,
+// nothing is cached otherwise. It must be called before Serve.
+func (h *Service) UseCache(repo *cache.SQLiteRepository) {
+	h.cache = repo
+}
+
+// cacheMiddleware answers repeated deterministic requests from the cache for
+// profiles that enable it. Only JSON requests with an explicit temperature of
+// 0 are cached; Cache-Control: no-cache skips the lookup and no-store skips
+// the cache altogether.
+func (h *Service) cacheMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.cache == nil || r.Method != http.MethodPost || !isJSON(r) || r.ContentLength > maxRewriteBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		settings, ok := r.Context().Value("settings").(keeper.ProfileSettings)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if snap := h.snapshot.Load(); snap == nil || !snap.cached[settings.ProfileID] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, ok, err := readBody(r)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		// a body too large to buffer streams on uncached
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, ok := cacheKey(settings.Name, r.URL.Path, body)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		noCache, noStore := cacheControl(r.Header.Get("Cache-Control"))
+		if noStore {
+			w.Header().Set(cacheHeader, "BYPASS")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !noCache {
+			entry, err := h.cache.Get(r.Context(), key)
+			if err != nil {
+				log.Errorf("failed to look up cached response: %v", err)
+			}
+
+			if entry != nil {
+				log.Debugf("Serving %s %s from cache", settings.Name, r.URL.Path)
+
+				if entry.ContentType != "" {
+					w.Header().Set("Content-Type", entry.ContentType)
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(entry.Body)))
+				w.Header().Set(cacheHeader, "HIT")
+				w.WriteHeader(entry.Status)
+				w.Write(entry.Body)
+
+				return
+			}
+
+			w.Header().Set(cacheHeader, "MISS")
+		} else {
+			w.Header().Set(cacheHeader, "BYPASS")
+		}
+
+		// let the transport negotiate compression, so the body is stored and
+		// replayed decoded whatever the next client accepts
+		r.Header.Del("Accept-Encoding")
+
+		rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if rec.status != http.StatusOK || rec.overflow {
+			return
+		}
+
+		now := time.Now()
+		if err := h.cache.Put(r.Context(), cache.Entry{
+			Key:         key,
+			Provider:    settings.Name,
+			Path:        r.URL.Path,
+			Status:      rec.status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(h.opts.CacheTTL),
+		}); err != nil {
+			log.Errorf("failed to cache response: %v", err)
+		}
+	})
+}
+
+// cacheKey hashes the provider, path and normalized body of a request. It
+// returns false for requests that may not produce the same response twice.
+func cacheKey(provider, path string, body []byte) (string, bool) {
+	var fields map[string]any
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return "", false
+	}
+
+	if temperature, ok := fields["temperature"].(float64); !ok || temperature != 0 {
+		return "", false
+	}
+
+	// re-encoding sorts the keys, drops insignificant whitespace and spells
+	// equal numbers the same way
+	normalized, err := json.Marshal(fields)
+	if err != nil {
+		return "", false
+	}
+
+	sum := sha256.New()
+	sum.Write([]byte(provider + "\n" + path + "\n"))
+	sum.Write(normalized)
+
+	return hex.EncodeToString(sum.Sum(nil)), true
+}
+
+func cacheControl(header string) (noCache, noStore bool) {
+	for _, directive := range strings.Split(header, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache":
+			noCache = true
+		case "no-store":
+			noStore = true
+		}
+	}
+
+	return noCache, noStore
+}
+
+// bodyRecorder passes the response through while keeping a copy of it, up
+// to maxRewriteBody.
+type bodyRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *bodyRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *bodyRecorder) Write(p []byte) (int, error) {
+	if !r.overflow {
+		if r.body.Len()+len(p) > maxRewriteBody {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(p)
+		}
+	}
+
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *bodyRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *bodyRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"keeper/services/cache"
+)
+
+func TestCacheKey(t *testing.T) {
+	const body = `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+
+	key, ok := cacheKey("openai", "/v1/chat/completions", []byte(body))
+	if !ok {
+		t.Fatalf("a request with temperature 0 is not cached")
+	}
+
+	tests := []struct {
+		name     string
+		provider string
+		path     string
+		body     string
+		// cached is false for requests that are never cached, same tells
+		// whether the others share the key of body
+		cached bool
+		same   bool
+	}{
+		{name: "same request", body: body, cached: true, same: true},
+		{name: "reordered and spaced", body: `{ "messages": [{"content": "hi", "role": "user"}], "temperature": 0, "model": "gpt-4o" }`, cached: true, same: true},
+		{name: "temperature 0.0", body: `{"model":"gpt-4o","temperature":0.0,"messages":[{"role":"user","content":"hi"}]}`, cached: true, same: true},
+		{name: "other message", body: `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hello"}]}`, cached: true},
+		{name: "other provider", provider: "anthropic", body: body, cached: true},
+		{name: "other path", path: "/v1/completions", body: body, cached: true},
+		{name: "no temperature", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`},
+		{name: "temperature 0.7", body: `{"model":"gpt-4o","temperature":0.7,"messages":[{"role":"user","content":"hi"}]}`},
+		{name: "temperature as a string", body: `{"model":"gpt-4o","temperature":"0","messages":[{"role":"user","content":"hi"}]}`},
+		{name: "temperature null", body: `{"model":"gpt-4o","temperature":null,"messages":[{"role":"user","content":"hi"}]}`},
+		{name: "not an object", body: `[{"temperature":0}]`},
+		{name: "invalid JSON", body: `{"temperature":0`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, path := tt.provider, tt.path
+			if provider == "" {
+				provider = "openai"
+			}
+			if path == "" {
+				path = "/v1/chat/completions"
+			}
+
+			got, ok := cacheKey(provider, path, []byte(tt.body))
+			if ok != tt.cached {
+				t.Fatalf("cacheKey cached = %v, want %v", ok, tt.cached)
+			}
+
+			if ok && (got == key) != tt.same {
+				t.Errorf("cacheKey same key = %v, want %v", got == key, tt.same)
+			}
+		})
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	tests := []struct {
+		header  string
+		noCache bool
+		noStore bool
+	}{
+		{header: ""},
+		{header: "max-age=0"},
+		{header: "no-cache", noCache: true},
+		{header: "No-Cache", noCache: true},
+		{header: "no-store", noStore: true},
+		{header: "max-age=0, no-store", noStore: true},
+		{header: " no-cache ,no-store", noCache: true, noStore: true},
+		{header: "no-cache-please"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			noCache, noStore := cacheControl(tt.header)
+			if noCache != tt.noCache || noStore != tt.noStore {
+				t.Errorf("cacheControl(%q) = %v, %v, want %v, %v", tt.header, noCache, noStore, tt.noCache, tt.noStore)
+			}
+		})
+	}
+}
+
+func TestCacheMiddleware(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatalf("failed to open cache database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	responses, err := cache.NewSQLite(db)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+
+	h := newTestService(t, Options{})
+	h.UseCache(responses)
+	if err := h.keeper.SetProfileCache(context.Background(), "default", true); err != nil {
+		t.Fatalf("failed to enable the cache: %v", err)
+	}
+	if err := h.Reload(context.Background()); err != nil {
+		t.Fatalf("failed to load settings: %v", err)
+	}
+
+	var calls int
+	handler := h.userSettingsMiddleware(h.cacheMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1"}`))
+	})))
+
+	const (
+		deterministic = `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+		unstored      = `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"not stored"}]}`
+	)
+
+	// the requests run in order, each sees what the ones before it cached
+	tests := []struct {
+		name         string
+		body         string
+		cacheControl string
+		profile      string
+		// header is the X-Keeper-Cache of the response, upstream whether
+		// the request reached the provider
+		header   string
+		upstream bool
+	}{
+		{name: "first request", body: deterministic, header: "MISS", upstream: true},
+		{name: "repeated request", body: deterministic, header: "HIT"},
+		{name: "no-cache", body: deterministic, cacheControl: "no-cache", header: "BYPASS", upstream: true},
+		{name: "no-store", body: unstored, cacheControl: "no-store", header: "BYPASS", upstream: true},
+		{name: "after no-store", body: unstored, header: "MISS", upstream: true},
+		{name: "nonzero temperature", body: `{"model":"gpt-4o","temperature":1,"messages":[{"role":"user","content":"hi"}]}`, upstream: true},
+		{name: "profile without cache", body: deterministic, profile: "work", upstream: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			if tt.cacheControl != "" {
+				r.Header.Set("Cache-Control", tt.cacheControl)
+			}
+			if tt.profile != "" {
+				r.Header.Set(profileHeader, tt.profile)
+			}
+
+			before := calls
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK || w.Body.String() != `{"id":"chatcmpl-1"}` {
+				t.Fatalf("response %d %s, want the upstream response", w.Code, w.Body)
+			}
+
+			if got := w.Header().Get(cacheHeader); got != tt.header {
+				t.Errorf("%s = %q, want %q", cacheHeader, got, tt.header)
+			}
+
+			if upstream := calls > before; upstream != tt.upstream {
+				t.Errorf("request reached the provider = %v, want %v", upstream, tt.upstream)
+			}
+		})
+	}
+}
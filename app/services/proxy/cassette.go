@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "keeper/internal/logger"
+	"keeper/services/cassette"
+	"keeper/services/keeper"
+)
+
+// CassetteMode selects whether a cassette is recorded or replayed
+type CassetteMode int
+
+const (
+	Record CassetteMode = iota + 1
+	Replay
+)
+
+func (m CassetteMode) String() string {
+	switch m {
+	case Record:
+		return "record"
+	case Replay:
+		return "replay"
+	default:
+		return ""
+	}
+}
+
+// MatchFields lists the request fields a replayed request can be matched on
+var MatchFields = []string{"method", "path", "query", "body"}
+
+// CassetteOptions configures recording or replaying
+type CassetteOptions struct {
+	Mode CassetteMode
+	// Match names the request fields that must equal a recorded request's
+	// for its response to be replayed, all but query when empty
+	Match []string
+}
+
+// responseHeadersSkipped are not recorded, the server sets them on replay or,
+// as the cache header, they describe the recording server only
+var responseHeadersSkipped = []string{"Content-Length", "Content-Encoding", "Transfer-Encoding", "Connection", "Date", cacheHeader}
+
+// tape is the cassette in use and, when replaying, what was recorded on it
+type tape struct {
+	repo  *cassette.SQLiteRepository
+	opts  CassetteOptions
+	mu    sync.Mutex
+	byKey map[string][]cassette.Interaction
+	plays map[string]int
+}
+
+// UseCassette records every upstream exchange to repo, or serves requests
+// from what repo holds without reaching the network. It must be called
+// before Serve.
+func (h *Service) UseCassette(repo *cassette.SQLiteRepository, opts CassetteOptions) error {
+	if len(opts.Match) == 0 {
+		opts.Match = []string{"method", "path", "body"}
+	}
+
+	for _, field := range opts.Match {
+		if !slices.Contains(MatchFields, field) {
+			return log.Errorf("unknown match field %q, expected one of %s", field, strings.Join(MatchFields, ", "))
+		}
+	}
+
+	t := &tape{repo: repo, opts: opts}
+
+	if opts.Mode == Replay {
+		interactions, err := repo.List(context.Background())
+		if err != nil {
+			return err
+		}
+
+		t.byKey = map[string][]cassette.Interaction{}
+		t.plays = map[string]int{}
+		for _, in := range interactions {
+			key := t.matchKey(in.Provider, in.Method, in.Path, in.Query, in.BodyHash)
+			t.byKey[key] = append(t.byKey[key], in)
+		}
+
+		log.Infof("Replaying %d recorded interactions", len(interactions))
+	}
+
+	h.tape = t
+
+	return nil
+}
+
+// matchKey joins the provider and the fields the tape matches requests on,
+// providers sharing a path never replay each other's responses
+func (t *tape) matchKey(provider, method, path, query, bodyHash string) string {
+	values := map[string]string{"method": method, "path": path, "query": query, "body": bodyHash}
+
+	parts := make([]string, 1, len(t.opts.Match)+1)
+	parts[0] = provider
+	for _, field := range t.opts.Match {
+		parts = append(parts, values[field])
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+// replaying reports whether requests are served from a cassette
+func (t *tape) replaying() bool {
+	return t != nil && t.opts.Mode == Replay
+}
+
+// next returns the recording to replay for key. Requests recorded more than
+// once are replayed in recording order, the last one repeating.
+func (t *tape) next(key string) (cassette.Interaction, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	recorded := t.byKey[key]
+	if len(recorded) == 0 {
+		return cassette.Interaction{}, false
+	}
+
+	i := t.plays[key]
+	if i < len(recorded)-1 {
+		t.plays[key] = i + 1
+	}
+
+	return recorded[min(i, len(recorded)-1)], true
+}
+
+// cassetteMiddleware records the upstream exchange or replays it in place
+// of the proxy, depending on the cassette in use.
+func (h *Service) cassetteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.tape == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		ok := r.ContentLength <= maxRewriteBody
+		if ok {
+			var err error
+			if body, ok, err = readBody(r); err != nil {
+				http.Error(w, "failed to read request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// a body too large to buffer is neither matched nor recorded
+		if !ok {
+			if h.tape.opts.Mode == Replay {
+				log.Errorf("request body of %s %s is too large to replay", r.Method, r.URL.Path)
+				http.Error(w, fmt.Sprintf("request body of %s %s is too large to replay", r.Method, r.URL.Path), http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			log.Infof("Not recording %s %s, its request body is too large", r.Method, r.URL.Path)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		provider := ""
+		if settings, ok := r.Context().Value("settings").(keeper.ProfileSettings); ok {
+			provider = settings.Name
+		}
+
+		if h.tape.opts.Mode == Replay {
+			h.replay(w, r, provider, body)
+			return
+		}
+
+		// record bodies decoded so they replay to any client
+		r.Header.Del("Accept-Encoding")
+
+		rec := &chunkRecorder{ResponseWriter: w, status: http.StatusOK, last: time.Now()}
+		next.ServeHTTP(rec, r)
+
+		header := rec.Header().Clone()
+		for _, name := range responseHeadersSkipped {
+			header.Del(name)
+		}
+
+		if err := h.tape.repo.Save(r.Context(), cassette.Interaction{
+			Provider:    provider,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			Query:       r.URL.RawQuery,
+			BodyHash:    bodyHash(body),
+			RequestBody: body,
+			Status:      rec.status,
+			Header:      header,
+			Chunks:      rec.chunks,
+		}); err != nil {
+			log.Errorf("failed to record interaction: %v", err)
+		}
+	})
+}
+
+func (h *Service) replay(w http.ResponseWriter, r *http.Request, provider string, body []byte) {
+	key := h.tape.matchKey(provider, r.Method, r.URL.Path, r.URL.RawQuery, bodyHash(body))
+
+	in, ok := h.tape.next(key)
+	if !ok {
+		log.Errorf("no recorded %s response for %s %s", provider, r.Method, r.URL.Path)
+		http.Error(w, fmt.Sprintf("no recorded %s response for %s %s", provider, r.Method, r.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	chunks, err := h.tape.repo.Chunks(r.Context(), in.ID)
+	if err != nil {
+		http.Error(w, "failed to load recorded response", http.StatusInternalServerError)
+		return
+	}
+
+	for name, values := range in.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(in.Status)
+
+	flusher, _ := w.(http.Flusher)
+
+	for _, c := range chunks {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(c.Delay):
+		}
+
+		if _, err := w.Write(c.Data); err != nil {
+			return
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// bodyHash identifies a request body, JSON bodies by their normalized form so
+// key order and whitespace don't matter.
+func bodyHash(body []byte) string {
+	var v any
+	if err := json.Unmarshal(body, &v); err == nil {
+		if normalized, err := json.Marshal(v); err == nil {
+			body = normalized
+		}
+	}
+
+	sum := sha256.Sum256(body)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// chunkRecorder passes the response through and keeps every write with the
+// time elapsed since the previous one.
+type chunkRecorder struct {
+	http.ResponseWriter
+	status int
+	chunks []cassette.Chunk
+	last   time.Time
+}
+
+func (r *chunkRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *chunkRecorder) Write(p []byte) (int, error) {
+	now := time.Now()
+	r.chunks = append(r.chunks, cassette.Chunk{Delay: now.Sub(r.last), Data: append([]byte(nil), p...)})
+	r.last = now
+
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *chunkRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *chunkRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"keeper/services/cassette"
+	"keeper/services/keeper"
+)
+
+type cassetteRequest struct {
+	provider string
+	method   string
+	target   string
+	body     string
+}
+
+func (c cassetteRequest) send(t *testing.T, handler http.Handler) *httptest.ResponseRecorder {
+	t.Helper()
+
+	method := c.method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	target := c.target
+	if target == "" {
+		target = "/v1/chat/completions"
+	}
+
+	r := httptest.NewRequest(method, target, strings.NewReader(c.body))
+	r.Header.Set("Content-Type", "application/json")
+	if c.provider != "" {
+		r.Header.Set(providerHeader, c.provider)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+// recordCassette records requests to a new cassette, the upstream answering
+// each with its provider and the number of the request
+func recordCassette(t *testing.T, requests []cassetteRequest) *cassette.SQLiteRepository {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "cassette.db"))
+	if err != nil {
+		t.Fatalf("failed to open cassette: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	repo, err := cassette.NewSQLite(db)
+	if err != nil {
+		t.Fatalf("failed to create cassette: %v", err)
+	}
+
+	h := newTestService(t, Options{})
+	if err := h.UseCassette(repo, CassetteOptions{Mode: Record}); err != nil {
+		t.Fatalf("failed to record: %v", err)
+	}
+
+	var calls int
+	handler := h.userSettingsMiddleware(h.cassetteMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		settings := r.Context().Value("settings").(keeper.ProfileSettings)
+		io.WriteString(w, settings.Name+" "+strconv.Itoa(calls))
+	})))
+
+	for _, req := range requests {
+		if w := req.send(t, handler); w.Code != http.StatusOK {
+			t.Fatalf("recording %v: status %d: %s", req, w.Code, w.Body)
+		}
+	}
+
+	return repo
+}
+
+func TestCassetteReplay(t *testing.T) {
+	repo := recordCassette(t, []cassetteRequest{
+		{body: `{"a":1}`},
+		{provider: "anthropic", body: `{"a":1}`},
+		{body: `{"a":2}`},
+		{body: `{"a":2}`},
+		{method: http.MethodGet, target: "/v1/models?limit=1"},
+	})
+
+	tests := []struct {
+		name     string
+		match    []string
+		requests []cassetteRequest
+		// want are the response bodies in order, "404" where nothing was
+		// recorded for the request
+		want []string
+	}{
+		{
+			name:     "same request",
+			requests: []cassetteRequest{{body: `{"a":1}`}},
+			want:     []string{"openai 1"},
+		},
+		{
+			name:     "provider sharing the path",
+			requests: []cassetteRequest{{provider: "anthropic", body: `{"a":1}`}},
+			want:     []string{"anthropic 2"},
+		},
+		{
+			name:     "provider without recordings",
+			requests: []cassetteRequest{{provider: "mock", body: `{"a":1}`}},
+			want:     []string{"404"},
+		},
+		{
+			name:     "reordered JSON body",
+			requests: []cassetteRequest{{body: ` { "a" : 1 } `}},
+			want:     []string{"openai 1"},
+		},
+		{
+			name:     "other body",
+			requests: []cassetteRequest{{body: `{"a":3}`}},
+			want:     []string{"404"},
+		},
+		{
+			name:     "repeated request",
+			requests: []cassetteRequest{{body: `{"a":2}`}, {body: `{"a":2}`}, {body: `{"a":2}`}},
+			want:     []string{"openai 3", "openai 4", "openai 4"},
+		},
+		{
+			name:     "other method",
+			requests: []cassetteRequest{{method: http.MethodPut, body: `{"a":1}`}},
+			want:     []string{"404"},
+		},
+		{
+			name:     "query not matched",
+			requests: []cassetteRequest{{method: http.MethodGet, target: "/v1/models?limit=2"}},
+			want:     []string{"openai 5"},
+		},
+		{
+			name:     "query matched",
+			match:    []string{"method", "path", "query", "body"},
+			requests: []cassetteRequest{{method: http.MethodGet, target: "/v1/models?limit=2"}, {method: http.MethodGet, target: "/v1/models?limit=1"}},
+			want:     []string{"404", "openai 5"},
+		},
+		{
+			name:     "body not matched",
+			match:    []string{"method", "path"},
+			requests: []cassetteRequest{{body: `{"a":9}`}, {body: `{"a":9}`}, {body: `{"a":9}`}, {provider: "anthropic"}},
+			want:     []string{"openai 1", "openai 3", "openai 4", "anthropic 2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestService(t, Options{})
+			if err := h.UseCassette(repo, CassetteOptions{Mode: Replay, Match: tt.match}); err != nil {
+				t.Fatalf("failed to replay: %v", err)
+			}
+
+			handler := h.userSettingsMiddleware(h.cassetteMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("%s %s reached the provider during a replay", r.Method, r.URL)
+			})))
+
+			for i, req := range tt.requests {
+				w := req.send(t, handler)
+
+				got := w.Body.String()
+				if w.Code == http.StatusNotFound {
+					got = "404"
+				}
+
+				if got != tt.want[i] {
+					t.Errorf("request %d replayed %q, want %q", i+1, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCassetteMatchFields(t *testing.T) {
+	h := newTestService(t, Options{})
+
+	if err := h.UseCassette(nil, CassetteOptions{Mode: Record, Match: []string{"path", "headers"}}); err == nil || !strings.Contains(err.Error(), `unknown match field "headers"`) {
+		t.Errorf("UseCassette with an unknown match field = %v, want an error", err)
+	}
+}
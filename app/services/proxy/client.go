@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AdminClient talks to the admin API of a running server over its Unix socket
+type AdminClient struct {
+	client *http.Client
+}
+
+func NewAdminClient(socket string) *AdminClient {
+	return &AdminClient{
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (c *AdminClient) Status(ctx context.Context) (*Status, error) {
+	var status Status
+	if err := c.do(ctx, http.MethodGet, "/admin/status", nil, &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+func (c *AdminClient) Reload(ctx context.Context) (*Status, error) {
+	var status Status
+	if err := c.do(ctx, http.MethodPost, "/admin/reload", nil, &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+func (c *AdminClient) Profile(ctx context.Context) (string, error) {
+	var res ProfileRequest
+	if err := c.do(ctx, http.MethodGet, "/admin/profile", nil, &res); err != nil {
+		return "", err
+	}
+
+	return res.Name, nil
+}
+
+func (c *AdminClient) SetProfile(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodPut, "/admin/profile", ProfileRequest{Name: name}, nil)
+}
+
+func (c *AdminClient) Usage(ctx context.Context) ([]UsageEntry, error) {
+	var usage []UsageEntry
+	if err := c.do(ctx, http.MethodGet, "/admin/usage", nil, &usage); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+func (c *AdminClient) KeysHealth(ctx context.Context) ([]KeyHealth, error) {
+	var health []KeyHealth
+	if err := c.do(ctx, http.MethodGet, "/admin/keys/health", nil, &health); err != nil {
+		return nil, err
+	}
+
+	return health, nil
+}
+
+// IssueToken asks the server for a virtual token for the provider
+func (c *AdminClient) IssueToken(ctx context.Context, req TokenRequest) (*Token, error) {
+	var token Token
+	if err := c.do(ctx, http.MethodPost, "/admin/tokens", req, &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (c *AdminClient) do(ctx context.Context, method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	// the host is ignored, every request is dialed over the socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://keeper"+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return fmt.Errorf("admin API returned %s", res.Status)
+		}
+		return fmt.Errorf("%s", apiErr.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode admin response: %w", err)
+	}
+
+	return nil
+}
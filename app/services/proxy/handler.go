@@ -2,25 +2,100 @@ package proxy
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"keeper/internal/logger"
 	log "keeper/internal/logger"
+	provider_registry "keeper/internal/provider-registry"
+	"keeper/internal/tracing"
+	"keeper/services/cache"
 	"keeper/services/keeper"
+	"keeper/services/keycheck"
+	"keeper/services/mock"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Headers that let a client override the active profile and its selected
+// provider for a single request
+const (
+	profileHeader  = "X-Keeper-Profile"
+	providerHeader = "X-Keeper-Provider"
+)
+
+// Options configures the proxy service
+type Options struct {
+	// ReloadInterval is how often the database is polled for changes
+	ReloadInterval time.Duration
+	// AdminSocket is the Unix socket the admin API listens on, disabled when empty
+	AdminSocket string
+	// CacheTTL is how long a cached response is served
+	CacheTTL time.Duration
+	// Mock answers requests for builtin providers
+	Mock *mock.Server
+	// Tracer records spans of proxied requests, disabled when nil
+	Tracer *tracing.Tracer
+	// KeyCheckInterval is how often active keys are re-validated, disabled
+	// when zero
+	KeyCheckInterval time.Duration
+	// Secrets resolves keys stored as references to an external source,
+	// keys are used as stored when nil
+	Secrets *keeper.SecretResolver
+}
+
 // Service defines the proxy handler
 type Service struct {
-	server *http.Server
-	keeper *keeper.SQLiteRepository
+	server   *http.Server
+	admin    *http.Server
+	keeper   keeper.Repository
+	registry provider_registry.Registry
+	checker  *keycheck.Checker
+	opts     Options
+
+	tokens      *tokenStore
+	snapshot    atomic.Pointer[snapshot]
+	reloadMu    sync.Mutex
+	expiryTimer *time.Timer
+	cancel      context.CancelFunc
+	listeners   []net.Listener
+	socket      string
+	usage       *usageStats
+	tape        *tape
+	cache       *cache.SQLiteRepository
+	metrics     *proxyMetrics
+	startedAt   time.Time
+
+	metricsListener net.Listener
+	metricsServer   *http.Server
+
+	// stopped is closed once Stop has shut the server down
+	stopped  chan struct{}
+	stopOnce sync.Once
 }
 
-func New(keeper *keeper.SQLiteRepository) *Service {
+func New(keeper keeper.Repository, registry provider_registry.Registry, opts Options) *Service {
+	if opts.ReloadInterval <= 0 {
+		opts.ReloadInterval = time.Second
+	}
+
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = defaultCacheTTL
+	}
+
 	h := &Service{
-		keeper: keeper,
+		keeper:   keeper,
+		registry: registry,
+		checker:  keycheck.New(),
+		opts:     opts,
+		usage:    newUsageStats(),
+		tokens:   newTokenStore(),
+		metrics:  newProxyMetrics(),
+		stopped:  make(chan struct{}),
 	}
 
 	return h.init()
@@ -29,8 +104,10 @@ func New(keeper *keeper.SQLiteRepository) *Service {
 func (h *Service) init() *Service {
 	mux := http.NewServeMux()
 
+	// the cassette comes before the cache, so a recording holds every
+	// request, cache hits included, and a replay never reaches the cache
 	h.server = &http.Server{
-		Handler: h.logMiddleware(h.userSettingsMiddleware(h.apiKeyMiddleware(h.proxyMiddleware(mux)))),
+		Handler: h.traceMiddleware(h.logMiddleware(h.userSettingsMiddleware(h.usageMiddleware(h.apiKeyMiddleware(h.modelMiddleware(h.metricsMiddleware(h.cassetteMiddleware(h.cacheMiddleware(h.mockMiddleware(h.proxyMiddleware(mux))))))))))),
 	}
 
 	return h
@@ -48,21 +125,88 @@ func (h *Service) userSettingsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		settings, err := h.keeper.GetActiveProfileSettingsWithKey(ctx)
-		if err != nil {
-			http.Error(w, "failed to get user settings", http.StatusInternalServerError)
+		snap := h.snapshot.Load()
+		if snap == nil {
+			http.Error(w, "settings not loaded", http.StatusServiceUnavailable)
 
-			log.Errorf("failed to get active profile settings: %v", err)
+			return
+		}
+
+		_, span := h.opts.Tracer.Start(ctx, "keeper.settings", tracing.KindInternal)
+		defer span.End()
+
+		// explicit headers select the profile and provider of the request,
+		// they are meant for keeper only and never reach the provider
+		profile, provider := r.Header.Get(profileHeader), r.Header.Get(providerHeader)
+		r.Header.Del(profileHeader)
+		r.Header.Del(providerHeader)
+
+		var key string
+
+		// a virtual token issued for `keeper exec` is bound to its profile and
+		// provider, the headers may repeat them but not pick others
+		if credential := clientCredential(r, snap.authHeaders()); isVirtualToken(credential) {
+			token, ok := h.tokens.lookup(credential)
+			if !ok {
+				span.SetError("invalid or expired keeper token")
+				http.Error(w, "invalid or expired keeper token", http.StatusUnauthorized)
+
+				return
+			}
+
+			if (profile != "" && profile != token.Profile) || (provider != "" && provider != token.Provider) {
+				span.SetError("keeper token used for another profile or provider")
+				http.Error(w, fmt.Sprintf("keeper token is bound to profile %q and provider %q, %s and %s cannot change them",
+					token.Profile, token.Provider, profileHeader, providerHeader), http.StatusForbidden)
+
+				return
+			}
+
+			profile, provider, key = token.Profile, token.Provider, token.Key
+		}
+
+		settings, err := snap.settingsFor(profile, provider, key)
+		if err != nil {
+			span.SetError("%v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 
 			return
 		}
 
+		// the mock headers are meant for the mock provider only
+		if p, ok := snap.registry.Provider(settings.Name); !ok || !p.Builtin {
+			for _, name := range mock.RequestHeaders {
+				r.Header.Del(name)
+			}
+		}
+
+		span.SetAttr("keeper.profile", snap.profileName(settings.ProfileID))
+		span.SetAttr("keeper.provider", settings.Name)
+		span.End()
+
 		next.ServeHTTP(w, r.WithContext(
-			context.WithValue(ctx, "settings", *settings),
+			context.WithValue(ctx, "settings", settings),
 		))
 	})
 }
 
+func (h *Service) usageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		settings, _ := r.Context().Value("settings").(keeper.ProfileSettings)
+
+		var profile string
+		if snap := h.snapshot.Load(); snap != nil {
+			profile = snap.profileName(settings.ProfileID)
+		}
+
+		h.usage.record(profile, settings.Name, settings.ProviderKey.Name, rec.status)
+	})
+}
+
 func (h *Service) apiKeyMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		settings, ok := r.Context().Value("settings").(keeper.ProfileSettings)
@@ -72,7 +216,46 @@ func (h *Service) apiKeyMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", settings.Secret))
+		ctx, span := h.opts.Tracer.Start(r.Context(), "keeper.key_selection", tracing.KindInternal)
+
+		// never forward whatever credential the client sent
+		r.Header.Del("Authorization")
+
+		var auth provider_registry.Provider
+		if snap := h.snapshot.Load(); snap != nil {
+			for _, header := range snap.authHeaders() {
+				r.Header.Del(header)
+			}
+
+			auth, _ = snap.registry.Provider(settings.Name)
+		}
+
+		// a replayed response needs no key, cassettes replay on machines
+		// without access to the secrets they were recorded with
+		if h.tape.replaying() {
+			span.End()
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		secret, err := h.opts.Secrets.ResolveKey(ctx, settings.ProviderKey)
+		if err != nil {
+			log.Errorf("failed to resolve secret of key %s: %v", settings.ProviderKey.Name, err)
+
+			span.SetError("%v", err)
+			span.End()
+
+			http.Error(w, "failed to resolve provider key", http.StatusBadGateway)
+
+			return
+		}
+
+		r.Header.Set(auth.AuthHeader(secret))
+
+		span.SetAttr("keeper.key", settings.ProviderKey.Name)
+		span.SetAttr("keeper.key_id", settings.ProviderKey.ID)
+		span.End()
 
 		next.ServeHTTP(w, r)
 	})
@@ -87,28 +270,41 @@ func (h *Service) proxyMiddleware(_ http.Handler) http.Handler {
 			return
 		}
 
-		var targetURL *url.URL
-		if r.URL.Query().Get("debug") == "true" {
-			targetURL = &url.URL{
-				Scheme: "http",
-				Host:   "localhost:3000",
-			}
-		} else {
-			url, err := url.Parse(settings.BaseURL)
-			if err != nil {
-				http.Error(w, "invalid target URL", http.StatusInternalServerError)
-				return
-			}
-			targetURL = url
+		targetURL, err := url.Parse(h.upstreamBaseURL(settings, r.URL.Path))
+		if err != nil {
+			http.Error(w, "invalid target URL", http.StatusInternalServerError)
+			return
 		}
 
 		log.Debugf("Proxying to %s", targetURL)
 
+		// the upstream span lasts until the response headers arrive, the
+		// stream span covers the body that follows
+		_, upstream := h.opts.Tracer.Start(r.Context(), "keeper.upstream", tracing.KindClient)
+		upstream.SetAttr("server.address", targetURL.Host)
+		defer upstream.End()
+
+		var stream *tracing.Span
+		defer func() { stream.End() }()
+
 		proxy := &httputil.ReverseProxy{
 			Rewrite: func(r *httputil.ProxyRequest) {
 				r.SetURL(targetURL)
+
+				if upstream != nil {
+					r.Out.Header.Set("traceparent", upstream.TraceParent())
+				}
+			},
+			ModifyResponse: func(res *http.Response) error {
+				upstream.SetAttr("http.response.status_code", res.StatusCode)
+				upstream.End()
+
+				_, stream = h.opts.Tracer.Start(r.Context(), "keeper.stream", tracing.KindInternal)
+
+				return nil
 			},
 			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				upstream.SetError("%v", err)
 				http.Error(w, "failed to proxy request", http.StatusInternalServerError)
 				log.Errorf("failed to proxy request: %v", err)
 			},
@@ -118,34 +314,118 @@ func (h *Service) proxyMiddleware(_ http.Handler) http.Handler {
 	})
 }
 
-func (h *Service) Start(addr string) error {
-	h.server.Addr = addr
+// upstreamBaseURL returns the provider's base URL, without the path prefix its
+// SDKs add themselves when the request path already carries it.
+func (h *Service) upstreamBaseURL(settings keeper.ProfileSettings, path string) string {
+	snap := h.snapshot.Load()
+	if snap == nil {
+		return settings.BaseURL
+	}
 
-	url := url.URL{
-		Scheme: "https",
-		Host:   h.server.Addr,
+	p, ok := snap.registry.Provider(settings.Name)
+	if !ok || p.Env.SDKPathPrefix == "" || !strings.HasPrefix(path, p.Env.SDKPathPrefix+"/") {
+		return settings.BaseURL
 	}
-	res, err := http.Head(url.String())
 
-	logger.Errorf("%v %v", res, err)
-	switch {
-	case res != nil && res.StatusCode == http.StatusBadGateway:
-		// do nothing
-	case err != nil && errors.Is(err, http.ErrAbortHandler):
-		// do nothing
-	default:
-		return errors.New(fmt.Sprintf("address %s is already in use", h.server.Addr))
+	return p.SDKBaseURL(settings.BaseURL)
+}
+
+// Serve loads the settings, starts the admin API and serves the listeners
+// bound by Listen until Stop is called.
+func (h *Service) Serve() error {
+	if len(h.listeners) == 0 {
+		return log.Errorf("server is not listening")
 	}
 
-	log.Infof("Starting server on %s", addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
 
-	if err := h.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err := h.Reload(ctx); err != nil {
+		cancel()
+		closeListeners(h.listeners)
 		return err
 	}
 
+	h.watchReloads(ctx)
+	h.monitorKeys(ctx)
+
+	if err := h.startAdmin(); err != nil {
+		cancel()
+		closeListeners(h.listeners)
+		return err
+	}
+
+	h.startMetrics()
+
+	h.startedAt = time.Now()
+
+	errs := make(chan error, len(h.listeners))
+	for _, l := range h.listeners {
+		log.Infof("Starting server on %s", l.Addr())
+
+		go func(l net.Listener) {
+			errs <- h.server.Serve(l)
+		}(l)
+	}
+
+	// every Serve call returns once the server is shut down, the first one
+	// to return decides the outcome
+	if err := <-errs; err != nil && err != http.ErrServerClosed {
+		h.server.Close()
+		return err
+	}
+
+	// Serve returns as soon as Shutdown starts, wait for the requests in
+	// flight so the caller doesn't close the tracer or the database under
+	// them
+	<-h.stopped
+
 	return nil
 }
 
 func (h *Service) Stop() error {
+	defer h.stopOnce.Do(func() { close(h.stopped) })
+
+	if h.cancel != nil {
+		h.cancel()
+	}
+
+	h.reloadMu.Lock()
+	h.scheduleExpiry(time.Time{})
+	h.reloadMu.Unlock()
+
+	if err := h.stopAdmin(context.Background()); err != nil {
+		log.Errorf("failed to stop admin server: %v", err)
+	}
+
+	if err := h.stopMetrics(context.Background()); err != nil {
+		log.Errorf("failed to stop metrics server: %v", err)
+	}
+
+	if h.socket != "" {
+		defer os.Remove(h.socket)
+	}
+
 	return h.server.Shutdown(context.Background())
 }
+
+// statusRecorder captures the status code written by downstream handlers
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	provider_registry "keeper/internal/provider-registry"
+	"keeper/services/keeper"
+	"keeper/services/keeper/keepertest"
+)
+
+// newTestService returns a service over a seeded in-memory repository with
+// its snapshot loaded: the active profile default selects openai, the
+// profile work selects anthropic
+func newTestService(t *testing.T, opts Options) *Service {
+	t.Helper()
+
+	ctx := context.Background()
+
+	reg, err := provider_registry.New()
+	if err != nil {
+		t.Fatalf("failed to load providers: %v", err)
+	}
+
+	repo := keepertest.NewMemory(t)
+
+	anthropic, err := repo.GetProviderByName(ctx, "anthropic")
+	if err != nil {
+		t.Fatalf("failed to get provider: %v", err)
+	}
+
+	work, err := repo.CreateProfile(ctx, keeper.CreateProfileReq{Name: "work"})
+	if err != nil {
+		t.Fatalf("failed to create profile: %v", err)
+	}
+
+	if _, err := repo.CreateProfileSettings(ctx, keeper.ProfileSettings{ProfileID: work, ProviderID: anthropic.ID}); err != nil {
+		t.Fatalf("failed to create profile settings: %v", err)
+	}
+
+	h := New(repo, reg, opts)
+	if err := h.Reload(ctx); err != nil {
+		t.Fatalf("failed to load settings: %v", err)
+	}
+
+	return h
+}
+
+func TestUserSettingsHeaders(t *testing.T) {
+	h := newTestService(t, Options{})
+
+	scoped, err := h.tokens.issue(TokenRequest{Profile: "default", Provider: "openai", TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		profile  string
+		provider string
+		status   int
+		// want is the provider the request is sent to
+		want string
+	}{
+		{name: "active profile", status: http.StatusOK, want: "openai"},
+		{name: "profile header", profile: "work", status: http.StatusOK, want: "anthropic"},
+		{name: "provider header", provider: "anthropic", status: http.StatusOK, want: "anthropic"},
+		{name: "unknown profile", profile: "nobody", status: http.StatusBadRequest},
+		{name: "token", token: scoped.Token, status: http.StatusOK, want: "openai"},
+		{name: "token with its own scope", token: scoped.Token, profile: "default", provider: "openai", status: http.StatusOK, want: "openai"},
+		{name: "token with another profile", token: scoped.Token, profile: "work", status: http.StatusForbidden},
+		{name: "token with another provider", token: scoped.Token, provider: "anthropic", status: http.StatusForbidden},
+		{name: "unknown token", token: virtualTokenPrefix + "unknown", status: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got keeper.ProfileSettings
+			var leaked bool
+
+			handler := h.userSettingsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = r.Context().Value("settings").(keeper.ProfileSettings)
+				leaked = r.Header.Get(profileHeader) != "" || r.Header.Get(providerHeader) != ""
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.profile != "" {
+				r.Header.Set(profileHeader, tt.profile)
+			}
+			if tt.provider != "" {
+				r.Header.Set(providerHeader, tt.provider)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			if got.Name != tt.want {
+				t.Errorf("request goes to %q, want %q", got.Name, tt.want)
+			}
+
+			if leaked {
+				t.Error("the keeper headers reach the provider")
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "keeper/internal/logger"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation
+const listenFDsStart = 3
+
+// ListenOptions describes where the proxy accepts connections
+type ListenOptions struct {
+	// Addr is the TCP host:port to listen on, port 0 picks a free port
+	Addr string
+	// Socket is an optional Unix socket path served alongside Addr
+	Socket string
+	// Retries is how many more times Addr is tried while it is in use
+	Retries int
+	// RetryDelay is the wait between attempts
+	RetryDelay time.Duration
+	// TLS, when set, terminates TLS on the TCP listeners
+	TLS *tls.Config
+	// MetricsAddr is an optional TCP host:port serving /metrics, which the
+	// admin socket always serves
+	MetricsAddr string
+}
+
+// Listen binds the proxy's listeners and returns their actual addresses, so
+// callers learn which port was picked for port 0. Listeners handed over by
+// systemd-style socket activation take precedence over opts.
+func (h *Service) Listen(opts ListenOptions) ([]net.Addr, error) {
+	listeners, err := activationListeners()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(listeners) > 0 {
+		log.Infof("Using %d socket-activated listener(s)", len(listeners))
+
+		// TLS terminates on the activated TCP sockets as on the one bound
+		// here, Unix sockets stay plain
+		if opts.TLS != nil {
+			for i, l := range listeners {
+				if _, ok := l.Addr().(*net.TCPAddr); ok {
+					listeners[i] = tls.NewListener(l, opts.TLS)
+				}
+			}
+		}
+	} else {
+		l, err := listenTCP(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.TLS != nil {
+			l = tls.NewListener(l, opts.TLS)
+		}
+
+		listeners = append(listeners, l)
+
+		if opts.Socket != "" {
+			l, err := listenUnix(opts.Socket)
+			if err != nil {
+				closeListeners(listeners)
+				return nil, err
+			}
+			listeners = append(listeners, l)
+
+			h.socket = opts.Socket
+		}
+	}
+
+	if opts.MetricsAddr != "" {
+		if err := h.listenMetrics(opts.MetricsAddr); err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+	}
+
+	h.listeners = listeners
+
+	addrs := make([]net.Addr, 0, len(listeners))
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr())
+
+		if _, ok := l.Addr().(*net.TCPAddr); ok && h.server.Addr == "" {
+			h.server.Addr = l.Addr().String()
+		}
+	}
+
+	return addrs, nil
+}
+
+func listenTCP(opts ListenOptions) (net.Listener, error) {
+	for attempt := 0; ; attempt++ {
+		l, err := net.Listen("tcp", opts.Addr)
+		if err == nil {
+			return l, nil
+		}
+
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, log.Errorf("failed to listen on %s: %w", opts.Addr, err)
+		}
+
+		if attempt >= opts.Retries {
+			return nil, log.Errorf("address %s is already in use", opts.Addr)
+		}
+
+		log.Infof("Address %s is in use, retrying in %s", opts.Addr, opts.RetryDelay)
+
+		time.Sleep(opts.RetryDelay)
+	}
+}
+
+// activationListeners returns the listeners passed in through LISTEN_PID,
+// LISTEN_FDS and LISTEN_FDNAMES, or none when the process was not activated.
+func activationListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// the variables describe this process only and must not leak to children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := fmt.Sprintf("fd%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, log.Errorf("failed to use activated socket %s: %w", name, err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// listenUnix listens on a Unix socket that only the current user can
+// connect to, replacing a stale socket file left behind by a dead server.
+func listenUnix(path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	// create the socket without group or world access, the chmod below only
+	// guards against filesystems that ignore the umask
+	mask := syscall.Umask(0077)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, log.Errorf("failed to listen on socket %s: %w", path, err)
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		os.Remove(path)
+		return nil, log.Errorf("failed to restrict socket permissions: %w", err)
+	}
+
+	return l, nil
+}
+
+// removeStaleSocket deletes a socket file left behind by a server that is no
+// longer accepting connections.
+func removeStaleSocket(path string) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return log.Errorf("socket %s is already in use", path)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return log.Errorf("failed to remove stale socket %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
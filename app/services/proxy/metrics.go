@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "keeper/internal/logger"
+	"keeper/internal/metrics"
+	"keeper/internal/tracing"
+	"keeper/services/keeper"
+)
+
+// proxyMetrics are exposed on /metrics. Keys appear by name only, their
+// secrets never leave the snapshot.
+type proxyMetrics struct {
+	registry  *metrics.Registry
+	requests  *metrics.CounterVec
+	duration  *metrics.HistogramVec
+	tokens    *metrics.CounterVec
+	cost      *metrics.CounterVec
+	cacheHits *metrics.CounterVec
+
+	keyChecks    *metrics.CounterVec
+	keysDisabled *metrics.CounterVec
+}
+
+func newProxyMetrics() *proxyMetrics {
+	r := metrics.NewRegistry()
+
+	return &proxyMetrics{
+		registry: r,
+		requests: r.CounterVec("keeper_requests_total",
+			"Requests served, by the status code returned upstream or by keeper.",
+			"profile", "provider", "model", "key", "code"),
+		duration: r.HistogramVec("keeper_request_duration_seconds",
+			"Time until the response was fully written.",
+			metrics.DefBuckets, "profile", "provider", "model"),
+		tokens: r.CounterVec("keeper_tokens_total",
+			"Tokens reported in the usage of responses, by type input or output.",
+			"profile", "provider", "model", "key", "type"),
+		cost: r.CounterVec("keeper_cost_usd_total",
+			"Estimated spend from reported usage and registry pricing.",
+			"profile", "provider", "model", "key"),
+		cacheHits: r.CounterVec("keeper_cache_hits_total",
+			"Requests answered from the response cache, which cost nothing.",
+			"profile", "provider", "model"),
+		keyChecks: r.CounterVec("keeper_key_checks_total",
+			"Background key health checks, by the status found, rate_limited or error.",
+			"provider", "key", "result"),
+		keysDisabled: r.CounterVec("keeper_keys_disabled_total",
+			"Keys disabled because the provider rejected them.",
+			"provider", "key"),
+	}
+}
+
+// metricsMiddleware measures every request once its model is resolved. It
+// sits before the cache so hits are counted, but not charged.
+func (h *Service) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		settings, _ := r.Context().Value("settings").(keeper.ProfileSettings)
+
+		model := requestModel(r)
+
+		rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		usage := responseUsage(rec)
+		if model == "" {
+			model = usage.Model
+		}
+
+		var profile string
+		snap := h.snapshot.Load()
+		if snap != nil {
+			profile = snap.profileName(settings.ProfileID)
+		}
+
+		key := settings.ProviderKey.Name
+
+		span := tracing.FromContext(r.Context())
+		span.SetAttr("gen_ai.system", settings.Name)
+		span.SetAttr("gen_ai.request.model", model)
+
+		h.metrics.requests.Inc(profile, settings.Name, model, key, strconv.Itoa(rec.status))
+		h.metrics.duration.Observe(time.Since(start).Seconds(), profile, settings.Name, model)
+
+		if rec.Header().Get(cacheHeader) == "HIT" {
+			span.SetAttr("keeper.cache_hit", true)
+			h.metrics.cacheHits.Inc(profile, settings.Name, model)
+			return
+		}
+
+		if usage.Input == 0 && usage.Output == 0 {
+			return
+		}
+
+		span.SetAttr("gen_ai.usage.input_tokens", usage.Input)
+		span.SetAttr("gen_ai.usage.output_tokens", usage.Output)
+
+		h.metrics.tokens.Add(float64(usage.Input), profile, settings.Name, model, key, "input")
+		h.metrics.tokens.Add(float64(usage.Output), profile, settings.Name, model, key, "output")
+
+		if snap == nil {
+			return
+		}
+
+		if p, ok := snap.registry.Provider(settings.Name); ok {
+			if cost, ok := p.Cost(model, usage.Input, usage.Output); ok {
+				h.metrics.cost.Add(cost, profile, settings.Name, model, key)
+			}
+		}
+	})
+}
+
+// requestModel reads the model from a JSON request body the model middleware
+// already buffered.
+func requestModel(r *http.Request) string {
+	if r.GetBody == nil || !isJSON(r) {
+		return ""
+	}
+
+	body, err := r.GetBody()
+	if err != nil {
+		return ""
+	}
+	defer body.Close()
+
+	var req struct {
+		Model string `json:"model"`
+	}
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return ""
+	}
+
+	return req.Model
+}
+
+// tokenUsage is what a response reports about its own cost
+type tokenUsage struct {
+	Model  string
+	Input  int64
+	Output int64
+}
+
+// usageFields covers both the OpenAI and the Anthropic usage objects
+type usageFields struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	InputTokens      int64 `json:"input_tokens"`
+	OutputTokens     int64 `json:"output_tokens"`
+}
+
+type usagePayload struct {
+	Model   string       `json:"model"`
+	Usage   *usageFields `json:"usage"`
+	Message *struct {
+		Model string       `json:"model"`
+		Usage *usageFields `json:"usage"`
+	} `json:"message"`
+}
+
+// responseUsage extracts the token usage from a JSON response or from the
+// events of a stream. OpenAI streams only report usage when the request
+// sets stream_options.include_usage.
+func responseUsage(rec *bodyRecorder) tokenUsage {
+	if rec.overflow || rec.status != http.StatusOK {
+		return tokenUsage{}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+
+	var usage tokenUsage
+
+	switch mediaType {
+	case "application/json":
+		var p usagePayload
+		if err := json.Unmarshal(rec.body.Bytes(), &p); err == nil {
+			usage.add(p)
+		}
+
+	case "text/event-stream":
+		scanner := bufio.NewScanner(bytes.NewReader(rec.body.Bytes()))
+		scanner.Buffer(nil, maxRewriteBody)
+
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data:")
+			if !ok {
+				continue
+			}
+
+			var p usagePayload
+			if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &p); err == nil {
+				usage.add(p)
+			}
+		}
+	}
+
+	return usage
+}
+
+// add merges a payload into the usage. Streams repeat counts as they grow,
+// so the largest reported value wins.
+func (u *tokenUsage) add(p usagePayload) {
+	if p.Message != nil {
+		if u.Model == "" {
+			u.Model = p.Message.Model
+		}
+		if p.Message.Usage != nil {
+			u.merge(*p.Message.Usage)
+		}
+	}
+
+	if u.Model == "" {
+		u.Model = p.Model
+	}
+
+	if p.Usage != nil {
+		u.merge(*p.Usage)
+	}
+}
+
+func (u *tokenUsage) merge(f usageFields) {
+	u.Input = max(u.Input, f.PromptTokens, f.InputTokens)
+	u.Output = max(u.Output, f.CompletionTokens, f.OutputTokens)
+}
+
+// listenMetrics binds the optional TCP listener that serves /metrics for
+// scrapers that cannot reach the admin socket.
+func (h *Service) listenMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return log.Errorf("failed to listen for metrics on %s: %w", addr, err)
+	}
+
+	h.metricsListener = l
+
+	return nil
+}
+
+func (h *Service) startMetrics() {
+	if h.metricsListener == nil {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", h.metrics.registry.Handler())
+
+	h.metricsServer = &http.Server{Handler: mux}
+
+	go func() {
+		if err := h.metricsServer.Serve(h.metricsListener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("metrics server failed: %v", err)
+		}
+	}()
+
+	log.Infof("Serving metrics on %s", h.metricsListener.Addr())
+}
+
+func (h *Service) stopMetrics(ctx context.Context) error {
+	if h.metricsServer == nil {
+		return nil
+	}
+
+	return h.metricsServer.Shutdown(ctx)
+}
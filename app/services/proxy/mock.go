@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net/http"
+
+	"keeper/services/keeper"
+)
+
+// mockMiddleware answers requests for builtin providers in process instead
+// of proxying them.
+func (h *Service) mockMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings, _ := r.Context().Value("settings").(keeper.ProfileSettings)
+
+		snap := h.snapshot.Load()
+		if snap == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if p, ok := snap.registry.Provider(settings.Name); !ok || !p.Builtin {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if h.opts.Mock == nil {
+			http.Error(w, "mock provider is not configured", http.StatusBadGateway)
+			return
+		}
+
+		h.opts.Mock.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	log "keeper/internal/logger"
+	"keeper/services/keeper"
+)
+
+// maxRewriteBody caps the request bodies buffered to rewrite their model
+const maxRewriteBody = 32 << 20
+
+// modelMiddleware resolves the profile's model aliases in JSON request bodies
+// and fills in the provider's default model when a completion-style request
+// leaves it out.
+func (h *Service) modelMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !isJSON(r) || r.ContentLength > maxRewriteBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		settings, ok := r.Context().Value("settings").(keeper.ProfileSettings)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, ok, err := readBody(r)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		// a body too large to buffer streams on as it is
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var aliases map[string]string
+		if snap := h.snapshot.Load(); snap != nil {
+			aliases = snap.aliases[settings.ProfileID]
+		}
+
+		if rewritten, ok := rewriteModel(body, aliases, settings.Model); ok {
+			setBody(r, rewritten)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rewriteModel returns body with its model resolved, or false when nothing
+// had to change. Bodies that are not JSON objects are left alone.
+func rewriteModel(body []byte, aliases map[string]string, defaultModel string) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, false
+	}
+
+	var model string
+	if raw, ok := fields["model"]; ok {
+		if err := json.Unmarshal(raw, &model); err != nil {
+			return nil, false
+		}
+	}
+
+	resolved := model
+	switch {
+	case model != "":
+		if target, ok := aliases[model]; ok {
+			resolved = target
+		}
+
+	// only requests that generate something take a model, don't add one to
+	// bodies of other endpoints
+	case defaultModel != "" && (fields["messages"] != nil || fields["prompt"] != nil):
+		resolved = defaultModel
+	}
+
+	if resolved == model {
+		return nil, false
+	}
+
+	raw, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, false
+	}
+	fields["model"] = raw
+
+	rewritten, err := json.Marshal(fields)
+	if err != nil {
+		return nil, false
+	}
+
+	log.Debugf("Rewrote model %q to %q", model, resolved)
+
+	return rewritten, true
+}
+
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// readBody buffers the request body, up to maxRewriteBody bytes, and returns
+// false when it is larger. The request then reads what was buffered followed
+// by the rest, so it streams on whole.
+func readBody(r *http.Request) ([]byte, bool, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRewriteBody+1))
+	if err != nil {
+		r.Body.Close()
+		return nil, false, err
+	}
+
+	if len(body) > maxRewriteBody {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+
+	r.Body.Close()
+	setBody(r, body)
+
+	return body, true, nil
+}
+
+// readCloser reads from one reader and closes another, e.g. the body a
+// reader was put in front of
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// setBody replaces the request body and keeps its length headers in sync
+func setBody(r *http.Request, body []byte) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
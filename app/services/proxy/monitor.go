@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "keeper/internal/logger"
+	"keeper/services/keeper"
+)
+
+// defaultKeyCooldown applies when a rate limited provider does not say how
+// long to wait
+const defaultKeyCooldown = time.Minute
+
+// monitorKeys re-validates every active key at startup and then on every
+// KeyCheckInterval until ctx is done, along with the keys it deactivated.
+// Keys the provider rejects are deactivated until a later check finds them
+// usable, rate limited keys cool down. Only changes are written, and those
+// reload the snapshot so requests stop or start using the keys.
+func (h *Service) monitorKeys(ctx context.Context) {
+	if h.opts.KeyCheckInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(h.opts.KeyCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			h.checkKeys(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (h *Service) checkKeys(ctx context.Context) {
+	keys, err := h.keeper.ListProviderKeys(ctx)
+	if err != nil {
+		log.Errorf("failed to list keys to check: %v", err)
+		return
+	}
+
+	for _, k := range keys {
+		if !k.Checked() || ctx.Err() != nil {
+			continue
+		}
+
+		h.checkKey(ctx, k)
+	}
+}
+
+func (h *Service) checkKey(ctx context.Context, k keeper.ProviderKeyInfo) {
+	provider, ok := h.registry.Provider(k.ProviderName)
+	if !ok {
+		return
+	}
+
+	key, err := h.keeper.GetProviderKey(ctx, k.ID)
+	if err != nil {
+		log.Errorf("failed to load key %s: %v", keyLabel(k), err)
+		return
+	}
+
+	secret, err := h.opts.Secrets.ResolveKey(ctx, key.ProviderKey)
+	if err != nil {
+		h.metrics.keyChecks.Inc(k.ProviderName, k.Name, "error")
+		log.Errorf("failed to resolve secret of key %s: %v", keyLabel(k), err)
+		return
+	}
+
+	result, err := h.checker.Check(ctx, provider, key.BaseURL, secret)
+	if err != nil {
+		h.metrics.keyChecks.Inc(k.ProviderName, k.Name, "error")
+		log.Errorf("failed to check key %s: %v", keyLabel(k), err)
+		return
+	}
+
+	switch {
+	case !result.Status.Usable():
+		h.metrics.keyChecks.Inc(k.ProviderName, k.Name, string(result.Status))
+
+		if err := h.setKeyStatus(ctx, k, result.Status); err != nil {
+			log.Errorf("failed to disable key %s: %v", keyLabel(k), err)
+			return
+		}
+
+		// a key already rejected was disabled by an earlier check
+		if k.Status.Usable() {
+			h.metrics.keysDisabled.Inc(k.ProviderName, k.Name)
+			log.Infof("Disabled key %s, the provider reports it %s: %s", keyLabel(k), result.Status, result.Detail)
+		}
+
+	case result.RateLimited:
+		h.metrics.keyChecks.Inc(k.ProviderName, k.Name, "rate_limited")
+
+		cooldown := result.RetryAfter
+		if cooldown <= 0 {
+			cooldown = defaultKeyCooldown
+		}
+
+		// the stored time has a resolution of seconds
+		until := time.Now().Add(cooldown).Truncate(time.Second).Add(time.Second)
+
+		// the key authenticated, it is only throttled
+		if err := h.setKeyStatus(ctx, k, result.Status); err != nil {
+			log.Errorf("failed to record status of key %s: %v", keyLabel(k), err)
+			return
+		}
+
+		if err := h.keeper.SetProviderKeyCooldown(ctx, k.ID, until); err != nil {
+			log.Errorf("failed to cool down key %s: %v", keyLabel(k), err)
+			return
+		}
+
+		log.Infof("Key %s is rate limited, skipping it until %s", keyLabel(k), until.Format(time.TimeOnly))
+
+		// nothing is written when the cooldown ends, reload to pick the key up again
+		time.AfterFunc(time.Until(until), func() {
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err := h.Reload(ctx); err != nil {
+				log.Errorf("failed to reload settings: %v", err)
+			}
+		})
+
+	default:
+		h.metrics.keyChecks.Inc(k.ProviderName, k.Name, string(result.Status))
+
+		if err := h.setKeyStatus(ctx, k, result.Status); err != nil {
+			log.Errorf("failed to record status of key %s: %v", keyLabel(k), err)
+			return
+		}
+
+		if k.CooldownUntil != "" {
+			if err := h.keeper.SetProviderKeyCooldown(ctx, k.ID, time.Time{}); err != nil {
+				log.Errorf("failed to end cooldown of key %s: %v", keyLabel(k), err)
+			}
+		}
+
+		switch {
+		case !k.Status.Usable():
+			log.Infof("Enabled key %s again, it is %s", keyLabel(k), result.Status)
+		case result.Status != k.Status:
+			log.Infof("Key %s is %s", keyLabel(k), result.Status)
+		}
+	}
+}
+
+// setKeyStatus stores the status a check found unless the key already has
+// it: every write reloads the snapshot, checks that change nothing must not
+func (h *Service) setKeyStatus(ctx context.Context, k keeper.ProviderKeyInfo, status keeper.KeyStatus) error {
+	if status == k.Status {
+		return nil
+	}
+
+	return h.keeper.SetProviderKeyStatus(ctx, k.ID, status)
+}
+
+// keyLabel names a key in logs, keys are named after their provider by default
+func keyLabel(k keeper.ProviderKeyInfo) string {
+	return fmt.Sprintf("%s (#%d) of %s", k.Name, k.ID, k.ProviderName)
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "keeper/internal/logger"
+	provider_registry "keeper/internal/provider-registry"
+	"keeper/services/keeper"
+)
+
+// snapshot is the in-memory view of the configuration the proxy serves
+// requests from. It is replaced wholesale on every reload and never mutated.
+type snapshot struct {
+	profile   keeper.Profile
+	settings  keeper.ProfileSettings
+	profiles  map[string]keeper.ProfileSettings
+	providers map[string]keeper.Provider
+	keys      map[string][]keeper.ProviderKey
+	aliases   map[int64]map[string]string
+	cached    map[int64]bool
+	registry  provider_registry.Registry
+	loadedAt  time.Time
+}
+
+func (s *snapshot) provider(name string) (keeper.Provider, bool) {
+	p, ok := s.providers[name]
+	return p, ok
+}
+
+// settingsFor returns the settings of the named profile, the active one when
+// empty, with the named provider selected. A profile keeps its own key for
+// its selected provider, otherwise the provider's most recent active key is
+// used unless a key is named explicitly.
+func (s *snapshot) settingsFor(profile, provider, key string) (keeper.ProfileSettings, error) {
+	settings := s.settings
+	if profile != "" {
+		var ok bool
+		if settings, ok = s.profiles[profile]; !ok {
+			return keeper.ProfileSettings{}, fmt.Errorf("unknown profile %s", profile)
+		}
+	}
+
+	if provider == "" {
+		provider = settings.Name
+	}
+
+	if provider != settings.Name || settings.ProviderKey.ID == 0 {
+		p, ok := s.provider(provider)
+		if !ok {
+			return keeper.ProfileSettings{}, fmt.Errorf("unknown provider %s", provider)
+		}
+
+		settings = keeper.ProfileSettings{
+			Provider:   p,
+			ProfileID:  settings.ProfileID,
+			ProviderID: p.ID,
+		}
+	}
+
+	if key != "" {
+		k, ok := s.namedKey(provider, key)
+		if !ok {
+			return keeper.ProfileSettings{}, fmt.Errorf("no active key %s for provider %s", key, provider)
+		}
+
+		settings.ProviderKey = k
+	}
+
+	return settings, nil
+}
+
+func (s *snapshot) namedKey(provider, name string) (keeper.ProviderKey, bool) {
+	for _, k := range s.keys[provider] {
+		if k.Name == name {
+			return k, true
+		}
+	}
+
+	return keeper.ProviderKey{}, false
+}
+
+// profileName returns the name of the profile with the given ID
+func (s *snapshot) profileName(id int64) string {
+	for name, settings := range s.profiles {
+		if settings.ProfileID == id {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// authHeaders lists every header a provider in the registry reads its
+// credential from, besides Authorization.
+func (s *snapshot) authHeaders() []string {
+	var headers []string
+	for _, p := range s.registry.Providers {
+		if p.Auth.Type == "header" && p.Auth.Key != "" {
+			headers = append(headers, p.Auth.Key)
+		}
+	}
+
+	return headers
+}
+
+// Reload rebuilds the snapshot from the database and swaps it in atomically.
+// Requests in flight keep using the snapshot they started with.
+func (h *Service) Reload(ctx context.Context) error {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+
+	profile, err := h.keeper.GetActiveProfile(ctx)
+	if err != nil {
+		return log.Errorf("failed to load active profile: %w", err)
+	}
+
+	settings, err := h.keeper.GetActiveProfileSettingsWithKey(ctx)
+	if err != nil {
+		return log.Errorf("failed to load active profile settings: %w", err)
+	}
+
+	profiles, err := h.keeper.ListProfiles(ctx)
+	if err != nil {
+		return log.Errorf("failed to load profiles: %w", err)
+	}
+
+	providers, err := h.keeper.ListProvidersWithKey(ctx)
+	if err != nil {
+		return log.Errorf("failed to load providers: %w", err)
+	}
+
+	keys, err := h.keeper.ListActiveKeys(ctx)
+	if err != nil {
+		return log.Errorf("failed to load keys: %w", err)
+	}
+
+	aliases, err := h.keeper.ListModelAliases(ctx)
+	if err != nil {
+		return log.Errorf("failed to load model aliases: %w", err)
+	}
+
+	nextExpiry, err := h.keeper.NextKeyExpiry(ctx)
+	if err != nil {
+		return log.Errorf("failed to load key expiry: %w", err)
+	}
+
+	snap := &snapshot{
+		profile:   *profile,
+		settings:  *settings,
+		profiles:  make(map[string]keeper.ProfileSettings, len(profiles)),
+		providers: make(map[string]keeper.Provider, len(providers)),
+		keys:      map[string][]keeper.ProviderKey{},
+		aliases:   map[int64]map[string]string{},
+		cached:    map[int64]bool{},
+		registry:  h.registry,
+		loadedAt:  time.Now(),
+	}
+
+	for _, p := range profiles {
+		settings, err := h.keeper.GetProfileSettingsWithKey(ctx, p.Name)
+		if err != nil {
+			return log.Errorf("failed to load settings of profile %s: %w", p.Name, err)
+		}
+
+		snap.profiles[p.Name] = *settings
+		snap.cached[p.ID] = p.CacheEnabled
+	}
+
+	for _, p := range providers {
+		snap.providers[p.Name] = p
+	}
+
+	for _, k := range keys {
+		snap.keys[k.Name] = append(snap.keys[k.Name], k.ProviderKey)
+	}
+
+	for _, a := range aliases {
+		if snap.aliases[a.ProfileID] == nil {
+			snap.aliases[a.ProfileID] = map[string]string{}
+		}
+		snap.aliases[a.ProfileID][a.Alias] = a.Model
+	}
+
+	h.snapshot.Store(snap)
+	h.scheduleExpiry(nextExpiry)
+
+	log.Debugf("Reloaded settings: profile %s, provider %s, key %s", profile.Name, settings.Name, settings.ProviderKey.Name)
+
+	return nil
+}
+
+// scheduleExpiry reloads once the next key expires, nothing is written to
+// the database then. Callers hold reloadMu.
+func (h *Service) scheduleExpiry(next time.Time) {
+	if h.expiryTimer != nil {
+		h.expiryTimer.Stop()
+		h.expiryTimer = nil
+	}
+
+	if next.IsZero() {
+		return
+	}
+
+	h.expiryTimer = time.AfterFunc(time.Until(next), func() {
+		log.Infof("Reloading settings (key expired)")
+
+		if err := h.Reload(context.Background()); err != nil {
+			log.Errorf("failed to reload settings: %v", err)
+		}
+	})
+}
+
+// watchReloads refreshes the snapshot on SIGHUP and whenever the database
+// reports a change made by another connection (e.g. the CLI).
+func (h *Service) watchReloads(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	changes, err := h.keeper.Watch(ctx, h.opts.ReloadInterval)
+	if err != nil {
+		log.Errorf("failed to watch database, changes require SIGHUP: %v", err)
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+
+		for {
+			var reason string
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				reason = "SIGHUP"
+			case _, ok := <-changes:
+				if !ok {
+					changes = nil
+					continue
+				}
+				reason = "database change"
+			}
+
+			log.Infof("Reloading settings (%s)", reason)
+
+			if err := h.Reload(ctx); err != nil {
+				log.Errorf("failed to reload settings: %v", err)
+			}
+		}
+	}()
+}
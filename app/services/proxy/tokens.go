@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// virtualTokenPrefix marks credentials issued by keeper rather than a provider
+	virtualTokenPrefix = "kpr_"
+
+	defaultTokenTTL = time.Hour
+)
+
+// Token is a short-lived credential that lets a client use a provider's key
+// through the proxy without ever seeing the key itself
+type Token struct {
+	Token     string    `json:"token"`
+	Profile   string    `json:"profile,omitempty"`
+	Provider  string    `json:"provider"`
+	Key       string    `json:"key,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenRequest asks /admin/tokens for a virtual token, bound to the active
+// profile unless Profile is set and to the profile's key unless Key names one
+type TokenRequest struct {
+	Profile  string        `json:"profile,omitempty"`
+	Provider string        `json:"provider"`
+	Key      string        `json:"key,omitempty"`
+	TTL      time.Duration `json:"ttl"`
+}
+
+type tokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]Token
+}
+
+func newTokenStore() *tokenStore {
+	return &tokenStore{tokens: map[string]Token{}}
+}
+
+func (s *tokenStore) issue(req TokenRequest) (Token, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return Token{}, err
+	}
+
+	token := Token{
+		Token:     virtualTokenPrefix + hex.EncodeToString(b),
+		Profile:   req.Profile,
+		Provider:  req.Provider,
+		Key:       req.Key,
+		ExpiresAt: time.Now().Add(req.TTL),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, t := range s.tokens {
+		if now.After(t.ExpiresAt) {
+			delete(s.tokens, k)
+		}
+	}
+
+	s.tokens[token.Token] = token
+
+	return token, nil
+}
+
+func (s *tokenStore) lookup(token string) (Token, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[token]
+	if !ok || time.Now().After(t.ExpiresAt) {
+		return Token{}, false
+	}
+
+	return t, true
+}
+
+// clientCredential extracts the credential a client sent, whichever header
+// its SDK uses for it.
+func clientCredential(r *http.Request, headers []string) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	for _, h := range headers {
+		if v := r.Header.Get(h); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+func isVirtualToken(credential string) bool {
+	return strings.HasPrefix(credential, virtualTokenPrefix)
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net/http"
+
+	"keeper/internal/tracing"
+)
+
+// traceMiddleware wraps every request in a server span, continuing the
+// caller's trace when it sends a traceparent header.
+func (h *Service) traceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.opts.Tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := tracing.Extract(r.Context(), r.Header.Get("traceparent"))
+		ctx, span := h.opts.Tracer.Start(ctx, "keeper.proxy", tracing.KindServer)
+		defer span.End()
+
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttr("http.response.status_code", rec.status)
+		if rec.status >= http.StatusInternalServerError {
+			span.SetError("%s", http.StatusText(rec.status))
+		}
+	})
+}
@@ -0,0 +1,491 @@
+// Package vault reads provider keys from a HashiCorp Vault KV v2 secrets
+// engine, so keys referenced as "vault:secret/team/openai#api_key" never
+// leave Vault except into the proxy's memory.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "keeper/internal/logger"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// maxResponse bounds how much of a Vault response is read
+	maxResponse = 1 << 20
+	// authTimeout bounds the Vault calls no single caller owns: shared
+	// logins and lookups, and background token renewals
+	authTimeout = 30 * time.Second
+)
+
+// Options configures the Vault client
+type Options struct {
+	// Addr is Vault's address, e.g. https://vault.example.com:8200
+	Addr string
+	// Token authenticates to Vault, ~/.vault-token is used when neither it
+	// nor an AppRole is set
+	Token string
+	// RoleID and SecretID log in with AppRole instead of a token
+	RoleID   string
+	SecretID string
+	// AppRoleMount is where the AppRole auth method is mounted, approle when
+	// empty
+	AppRoleMount string
+	// Namespace is the Vault Enterprise namespace, the root one when empty
+	Namespace string
+	// HTTPClient sends the requests, a client with a 15 second timeout when
+	// nil
+	HTTPClient *http.Client
+}
+
+// Client resolves secret references against Vault. Tokens are looked up on
+// first use and renewed in the background before their lease runs out, an
+// AppRole logs in again when renewal is not possible.
+type Client struct {
+	opts   Options
+	client *http.Client
+	// authErr is why the client has no credentials, returned on use so
+	// commands that never read from Vault keep working
+	authErr error
+	// auth runs one login or token lookup at a time, outside mu so reads
+	// with a valid token never wait on Vault
+	auth singleflight.Group
+
+	mu         sync.Mutex
+	token      string
+	expires    time.Time
+	renewTimer *time.Timer
+	closed     bool
+}
+
+// New returns a client for the Vault at opts.Addr
+func New(opts Options) (*Client, error) {
+	if opts.Addr == "" {
+		return nil, fmt.Errorf("no Vault address")
+	}
+
+	var authErr error
+	switch {
+	case (opts.RoleID == "") != (opts.SecretID == ""):
+		authErr = fmt.Errorf("AppRole login needs both a role ID and a secret ID")
+	case opts.Token == "" && opts.RoleID == "":
+		opts.Token, authErr = tokenFile()
+	}
+
+	if opts.AppRoleMount == "" {
+		opts.AppRoleMount = "approle"
+	}
+
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 15 * time.Second}
+	}
+
+	return &Client{
+		opts:    opts,
+		client:  client,
+		authErr: authErr,
+	}, nil
+}
+
+// tokenFile reads the token the vault CLI stores after `vault login`
+func tokenFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+	if err != nil {
+		return "", fmt.Errorf("no Vault token or AppRole and failed to read ~/.vault-token: %w", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Close stops renewing the token
+func (c *Client) Close() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	c.stopRenewal()
+}
+
+// Resolve reads the field of a KV v2 secret named by ref,
+// "<mount>/<path>#<field>". The field may be left out when the secret has
+// only one.
+func (c *Client) Resolve(ctx context.Context, ref string) (string, error) {
+	mount, path, field, err := parseRef(ref)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := c.read(ctx, mount, path)
+
+	// an AppRole token may have been revoked or expired early, log in again
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.status == http.StatusForbidden && c.opts.RoleID != "" {
+		c.dropToken()
+		data, err = c.read(ctx, mount, path)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if field == "" {
+		if len(data) != 1 {
+			return "", fmt.Errorf("secret %s/%s has fields %s, name one with #<field>", mount, path, strings.Join(fields(data), ", "))
+		}
+
+		for name := range data {
+			field = name
+		}
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no field %s", mount, path, field)
+	}
+
+	secret, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("field %s of secret %s/%s is not a string", field, mount, path)
+	}
+
+	return secret, nil
+}
+
+func parseRef(ref string) (mount, path, field string, err error) {
+	ref, field, _ = strings.Cut(ref, "#")
+
+	mount, path, _ = strings.Cut(strings.Trim(ref, "/"), "/")
+	if mount == "" || path == "" {
+		return "", "", "", fmt.Errorf("invalid Vault reference %q, expected vault:<mount>/<path>#<field>", ref)
+	}
+
+	return mount, path, field, nil
+}
+
+func fields(data map[string]any) []string {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (c *Client) read(ctx context.Context, mount, path string) (map[string]any, error) {
+	token, err := c.authToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+
+	if err := c.do(ctx, http.MethodGet, "/v1/"+mount+"/data/"+path, token, nil, &res); err != nil {
+		return nil, fmt.Errorf("failed to read secret %s/%s: %w", mount, path, err)
+	}
+
+	// a deleted version reads as null data
+	if res.Data.Data == nil {
+		return nil, fmt.Errorf("secret %s/%s has no current version", mount, path)
+	}
+
+	return res.Data.Data, nil
+}
+
+// authToken returns a token that has not expired, logging in with AppRole or
+// looking up the configured token first if needed
+func (c *Client) authToken(ctx context.Context) (string, error) {
+	if c.authErr != nil {
+		return "", c.authErr
+	}
+
+	if token, ok := c.validToken(); ok {
+		return token, nil
+	}
+
+	token, err, _ := c.auth.Do("token", func() (any, error) {
+		if token, ok := c.validToken(); ok {
+			return token, nil
+		}
+
+		// the callers waiting on this login share it, one giving up must
+		// not fail the others
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), authTimeout)
+		defer cancel()
+
+		var (
+			lease tokenLease
+			err   error
+		)
+
+		if c.opts.RoleID != "" {
+			lease, err = c.login(ctx)
+		} else {
+			lease, err = c.lookup(ctx)
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.setToken(lease)
+
+		return lease.token, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token.(string), nil
+}
+
+// validToken returns the token unless there is none or it expired
+func (c *Client) validToken() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && (c.expires.IsZero() || time.Now().Before(c.expires)) {
+		return c.token, true
+	}
+
+	return "", false
+}
+
+// tokenLease is a token and how long it is valid
+type tokenLease struct {
+	token     string
+	ttl       time.Duration
+	renewable bool
+}
+
+// authResponse is the auth block Vault answers logins and renewals with
+type authResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+func (r authResponse) lease() tokenLease {
+	return tokenLease{
+		token:     r.Auth.ClientToken,
+		ttl:       time.Duration(r.Auth.LeaseDuration) * time.Second,
+		renewable: r.Auth.Renewable,
+	}
+}
+
+func (c *Client) login(ctx context.Context) (tokenLease, error) {
+	body := map[string]string{
+		"role_id":   c.opts.RoleID,
+		"secret_id": c.opts.SecretID,
+	}
+
+	var res authResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/auth/"+c.opts.AppRoleMount+"/login", "", body, &res); err != nil {
+		return tokenLease{}, fmt.Errorf("failed to log in to Vault with AppRole: %w", err)
+	}
+
+	if res.Auth.ClientToken == "" {
+		return tokenLease{}, fmt.Errorf("failed to log in to Vault with AppRole: no token in the response")
+	}
+
+	log.Debugf("Logged in to Vault with AppRole, token valid for %s", res.lease().ttl)
+
+	return res.lease(), nil
+}
+
+func (c *Client) lookup(ctx context.Context) (tokenLease, error) {
+	var res struct {
+		Data struct {
+			TTL       int64 `json:"ttl"`
+			Renewable bool  `json:"renewable"`
+		} `json:"data"`
+	}
+
+	if err := c.do(ctx, http.MethodGet, "/v1/auth/token/lookup-self", c.opts.Token, nil, &res); err != nil {
+		return tokenLease{}, fmt.Errorf("failed to look up Vault token: %w", err)
+	}
+
+	return tokenLease{
+		token:     c.opts.Token,
+		ttl:       time.Duration(res.Data.TTL) * time.Second,
+		renewable: res.Data.Renewable,
+	}, nil
+}
+
+// setToken stores a token and schedules its renewal. Callers hold mu.
+func (c *Client) setToken(lease tokenLease) {
+	c.stopRenewal()
+
+	c.token = lease.token
+	c.expires = time.Time{}
+
+	// root and periodic tokens without a TTL never expire
+	if lease.ttl <= 0 {
+		return
+	}
+
+	c.expires = time.Now().Add(lease.ttl)
+
+	if !lease.renewable || c.closed {
+		return
+	}
+
+	// renew with a third of the lease left, a failed renewal can still be
+	// retried or replaced by a new login before the token expires
+	c.renewTimer = time.AfterFunc(lease.ttl*2/3, c.renew)
+}
+
+// stopRenewal stops a scheduled renewal. Callers hold mu.
+func (c *Client) stopRenewal() {
+	if c.renewTimer != nil {
+		c.renewTimer.Stop()
+		c.renewTimer = nil
+	}
+}
+
+func (c *Client) renew() {
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+
+	var res authResponse
+	err := c.do(ctx, http.MethodPost, "/v1/auth/token/renew-self", token, map[string]string{}, &res)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// replaced or closed while renewing
+	if c.closed || c.token != token {
+		return
+	}
+
+	if err != nil {
+		// the token stays usable until it expires, an AppRole logs in again then
+		log.Errorf("failed to renew Vault token: %v", err)
+		return
+	}
+
+	lease := res.lease()
+	if lease.token == "" {
+		lease.token = token
+	}
+
+	c.setToken(lease)
+
+	log.Debugf("Renewed Vault token, valid for %s", lease.ttl)
+}
+
+// dropToken forgets the token so the next request logs in again
+func (c *Client) dropToken() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stopRenewal()
+	c.token = ""
+	c.expires = time.Time{}
+}
+
+// apiError is an error response from Vault
+type apiError struct {
+	status int
+	errors []string
+}
+
+func (e *apiError) Error() string {
+	if len(e.errors) == 0 {
+		return fmt.Sprintf("Vault responded %d %s", e.status, http.StatusText(e.status))
+	}
+
+	return fmt.Sprintf("Vault responded %d: %s", e.status, strings.Join(e.errors, "; "))
+}
+
+func (c *Client) do(ctx context.Context, method, path, token string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.opts.Addr, "/")+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.opts.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.opts.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach Vault: %w", err)
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxResponse))
+	if err != nil {
+		return fmt.Errorf("failed to read Vault response: %w", err)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var apiErr struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(data, &apiErr)
+
+		return &apiError{status: res.StatusCode, errors: apiErr.Errors}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode Vault response: %w", err)
+	}
+
+	return nil
+}
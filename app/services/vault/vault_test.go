@@ -0,0 +1,324 @@
+package vault_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"keeper/services/vault"
+)
+
+const (
+	roleID   = "role"
+	secretID = "secret"
+)
+
+// fakeVault answers the Vault endpoints the client uses. Logins hand out
+// the tokens "approle-1", "approle-2" and so on.
+type fakeVault struct {
+	t *testing.T
+
+	// secrets are the KV v2 secrets by path under the mount "secret"
+	secrets map[string]map[string]any
+	// ttl and renewable describe every token handed out
+	ttl       int64
+	renewable bool
+	// loginDelay holds up every login
+	loginDelay time.Duration
+
+	mu       sync.Mutex
+	logins   int
+	renewals []time.Time
+	loggedIn time.Time
+	// revoked tokens are refused with 403
+	revoked map[string]bool
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	token := r.Header.Get("X-Vault-Token")
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/auth/approle/login":
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["role_id"] != roleID || body["secret_id"] != secretID {
+			f.error(w, http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+
+		f.mu.Unlock()
+		time.Sleep(f.loginDelay)
+		f.mu.Lock()
+
+		f.logins++
+		f.loggedIn = time.Now()
+		f.auth(w, "approle-"+strconv.Itoa(f.logins))
+
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/auth/token/lookup-self":
+		if !f.valid(token) {
+			f.error(w, http.StatusForbidden, "permission denied")
+			return
+		}
+
+		f.json(w, map[string]any{"data": map[string]any{"ttl": f.ttl, "renewable": f.renewable}})
+
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/auth/token/renew-self":
+		if !f.valid(token) {
+			f.error(w, http.StatusForbidden, "permission denied")
+			return
+		}
+
+		f.renewals = append(f.renewals, time.Now())
+		f.auth(w, token)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		if !f.valid(token) {
+			f.error(w, http.StatusForbidden, "permission denied")
+			return
+		}
+
+		data, ok := f.secrets[strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")]
+		if !ok {
+			f.error(w, http.StatusNotFound)
+			return
+		}
+
+		f.json(w, map[string]any{"data": map[string]any{"data": data}})
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		f.error(w, http.StatusNotFound)
+	}
+}
+
+func (f *fakeVault) valid(token string) bool {
+	return token != "" && !f.revoked[token]
+}
+
+func (f *fakeVault) auth(w http.ResponseWriter, token string) {
+	f.json(w, map[string]any{"auth": map[string]any{
+		"client_token":   token,
+		"lease_duration": f.ttl,
+		"renewable":      f.renewable,
+	}})
+}
+
+func (f *fakeVault) json(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeVault) error(w http.ResponseWriter, status int, errors ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"errors": append([]string{}, errors...)})
+}
+
+func (f *fakeVault) revoke(token string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.revoked == nil {
+		f.revoked = map[string]bool{}
+	}
+	f.revoked[token] = true
+}
+
+func (f *fakeVault) stats() (logins int, renewals []time.Time, loggedIn time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.logins, append([]time.Time(nil), f.renewals...), f.loggedIn
+}
+
+// newClient starts f and returns a client for it, logging in with AppRole
+// unless token is set
+func newClient(t *testing.T, f *fakeVault, token string) *vault.Client {
+	t.Helper()
+
+	f.t = t
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	opts := vault.Options{Addr: srv.URL, HTTPClient: srv.Client(), Token: token}
+	if token == "" {
+		opts.RoleID, opts.SecretID = roleID, secretID
+	}
+
+	c, err := vault.New(opts)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+func TestResolve(t *testing.T) {
+	f := &fakeVault{secrets: map[string]map[string]any{
+		"team/openai": {"api_key": "sk-openai"},
+		"team/shared": {"openai": "sk-shared-openai", "anthropic": "sk-shared-anthropic"},
+		"team/number": {"api_key": 42},
+	}}
+	c := newClient(t, f, "root-token")
+
+	tests := []struct {
+		ref  string
+		want string
+		err  string
+	}{
+		{ref: "secret/team/openai#api_key", want: "sk-openai"},
+		{ref: "secret/team/openai", want: "sk-openai"},
+		{ref: "/secret/team/shared#anthropic", want: "sk-shared-anthropic"},
+		{ref: "secret/team/shared", err: "has fields anthropic, openai"},
+		{ref: "secret/team/openai#missing", err: "has no field missing"},
+		{ref: "secret/team/number#api_key", err: "is not a string"},
+		{ref: "secret/team/absent#api_key", err: "404"},
+		{ref: "secret", err: "invalid Vault reference"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := c.Resolve(context.Background(), tt.ref)
+
+			switch {
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("Resolve(%q) = %q, %v, want an error containing %q", tt.ref, got, err, tt.err)
+			case tt.err == "" && (err != nil || got != tt.want):
+				t.Errorf("Resolve(%q) = %q, %v, want %q", tt.ref, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppRoleLogin(t *testing.T) {
+	f := &fakeVault{
+		secrets:    map[string]map[string]any{"team/openai": {"api_key": "sk-openai"}},
+		ttl:        3600,
+		loginDelay: 50 * time.Millisecond,
+	}
+	c := newClient(t, f, "")
+
+	// concurrent reads share one login
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if got, err := c.Resolve(context.Background(), "secret/team/openai#api_key"); err != nil || got != "sk-openai" {
+				t.Errorf("Resolve = %q, %v, want sk-openai", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := c.Resolve(context.Background(), "secret/team/openai#api_key"); err != nil {
+		t.Fatalf("Resolve with the token of the login: %v", err)
+	}
+
+	if logins, _, _ := f.stats(); logins != 1 {
+		t.Errorf("logged in %d times, want once", logins)
+	}
+}
+
+func TestAppRoleLoginFails(t *testing.T) {
+	f := &fakeVault{}
+	srv := httptest.NewServer(f)
+	f.t = t
+	t.Cleanup(srv.Close)
+
+	c, err := vault.New(vault.Options{Addr: srv.URL, HTTPClient: srv.Client(), RoleID: roleID, SecretID: "wrong"})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(c.Close)
+
+	if _, err := c.Resolve(context.Background(), "secret/team/openai#api_key"); err == nil || !strings.Contains(err.Error(), "failed to log in to Vault with AppRole") {
+		t.Errorf("Resolve with a wrong secret ID = %v, want a login error", err)
+	}
+}
+
+func TestTokenRenewal(t *testing.T) {
+	f := &fakeVault{
+		secrets:   map[string]map[string]any{"team/openai": {"api_key": "sk-openai"}},
+		ttl:       3,
+		renewable: true,
+	}
+	c := newClient(t, f, "")
+
+	if _, err := c.Resolve(context.Background(), "secret/team/openai#api_key"); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	// the token is renewed with a third of its 3 second lease left
+	deadline := time.Now().Add(4 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, renewals, _ := f.stats(); len(renewals) > 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	logins, renewals, loggedIn := f.stats()
+	if len(renewals) == 0 {
+		t.Fatal("the token was not renewed")
+	}
+
+	if after := renewals[0].Sub(loggedIn); after < 1900*time.Millisecond || after > 2500*time.Millisecond {
+		t.Errorf("the token was renewed %s after the login, want 2s", after)
+	}
+
+	if _, err := c.Resolve(context.Background(), "secret/team/openai#api_key"); err != nil {
+		t.Fatalf("Resolve after the renewal: %v", err)
+	}
+
+	if logins != 1 {
+		t.Errorf("logged in %d times, want once", logins)
+	}
+}
+
+func TestLoginAgainOnForbidden(t *testing.T) {
+	f := &fakeVault{
+		secrets: map[string]map[string]any{"team/openai": {"api_key": "sk-openai"}},
+		ttl:     3600,
+	}
+	c := newClient(t, f, "")
+
+	if _, err := c.Resolve(context.Background(), "secret/team/openai#api_key"); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	// the token is revoked long before its lease runs out
+	f.revoke("approle-1")
+
+	if got, err := c.Resolve(context.Background(), "secret/team/openai#api_key"); err != nil || got != "sk-openai" {
+		t.Fatalf("Resolve with a revoked token = %q, %v, want sk-openai", got, err)
+	}
+
+	if logins, _, _ := f.stats(); logins != 2 {
+		t.Errorf("logged in %d times, want twice", logins)
+	}
+}
+
+func TestForbiddenToken(t *testing.T) {
+	f := &fakeVault{revoked: map[string]bool{"revoked-token": true}}
+	c := newClient(t, f, "revoked-token")
+
+	// a configured token can't log in again
+	if _, err := c.Resolve(context.Background(), "secret/team/openai#api_key"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Resolve with a revoked token = %v, want a 403 error", err)
+	}
+
+	if logins, _, _ := f.stats(); logins != 0 {
+		t.Errorf("logged in %d times with a configured token", logins)
+	}
+}